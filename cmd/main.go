@@ -1,18 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/llm-d-incubation/llm-d-async/internal/logging"
 	"github.com/llm-d-incubation/llm-d-async/pkg/async"
 	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/kafka"
 	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"github.com/llm-d-incubation/llm-d-async/pkg/nats"
+	"github.com/llm-d-incubation/llm-d-async/pkg/otellogs"
 	"github.com/llm-d-incubation/llm-d-async/pkg/pubsub"
 	"github.com/llm-d-incubation/llm-d-async/pkg/redis"
+	"github.com/llm-d-incubation/llm-d-async/pkg/sqs"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -27,21 +38,148 @@ func main() {
 	var loggerVerbosity int
 
 	var metricsPort int
+	var healthPort int
 	var metricsEndpointAuth bool
 
 	var concurrency int
+	var coalesceWindow time.Duration
+	var drainTimeout time.Duration
+	var retryBackoffBase time.Duration
+	var retryBackoffMax time.Duration
+	var maxRetries int
+	var requestTimeout time.Duration
+	var orderedDispatch bool
+	var channelAffinityWorkers int
+	var maxInFlight int
+	var maxInFlightRetries int
+	var modelConcurrencyLimits string
+	var metricLabelModels string
+	var metricLabelTenants string
+	var metricLabelMaxValues int
+	var responseCacheTTL time.Duration
+	var responseCacheImpl string
+	var httpProxy string
+	var maxResponseHeaderBytes int64
+	var latencyBreakdown bool
+	var slowRequestThreshold time.Duration
+	var compressionMinBytes int
+	var requestTotalBudget time.Duration
+	var endpointFieldPath string
+	var endpointOrigins string
+	var bodyURLOrigins string
+	var maxBodyURLBytes int64
+	var objectiveFieldPath string
+	var retryJitterSeed int64
+	var drainMode bool
+	var tenantRateLimit float64
+	var tenantRateLimits string
+	var tenantRateBurst int
+	var retryOnlyIdempotent bool
+	var responseRequiredFields string
+	var failEmptyResponses bool
+	var modelRewrites string
+	var responseAdapters string
+	var maxResultBytes int
+	var oversizedResultPolicy string
+	var resultStoreDir string
+	var auditFile string
+	var auditWebhookURL string
+	var auditFailurePolicy string
+	var auditEndpointHeader string
+	var resultServedBy string
+	var otelLogs bool
+	var otelLogsSampleRate float64
+	var mirrorDir string
+	var mirrorSampleRate float64
+	var mirrorMaxFileSize int64
+	var mirrorMaxFileAge time.Duration
 	var requestMergePolicy string
+	var requestMergeWeights string
+	var priorityAgingThreshold int
+	var priorityBufferSize int
 	var messageQueueImpl string
+	var resultBackpressurePolicy string
+	var resultBackpressureBufferSize int
+	var resultSpillSize int
+	var resultSpillDir string
+	var fallbackCheckInterval time.Duration
+	var startupDelay time.Duration
+	var startupReadinessURL string
+	var startupReadinessTimeout time.Duration
 
 	flag.IntVar(&loggerVerbosity, "v", logging.DEFAULT, "number for the log level verbosity")
 
 	flag.IntVar(&metricsPort, "metrics-port", 9090, "The metrics port")
+	flag.IntVar(&healthPort, "health-port", 8081, "The port of the liveness (/healthz) and readiness (/readyz) probes. Zero disables them")
 	flag.BoolVar(&metricsEndpointAuth, "metrics-endpoint-auth", true, "Enables authentication and authorization of the metrics endpoint")
 
 	flag.IntVar(&concurrency, "concurrency", 8, "number of concurrent workers")
+	flag.StringVar(&bodyURLOrigins, "body-url-allowed-origins", "", "Comma separated list of 'scheme://host[:port]' origins request bodies sent by reference may be fetched from. Body URLs are refused if empty")
+	flag.Int64Var(&maxBodyURLBytes, "body-url-max-bytes", 32<<20, "Size of the largest request body fetched by reference. Zero means unlimited")
+	flag.StringVar(&endpointFieldPath, "endpoint-field-path", "", "Dot separated JSON path of the request field holding the inference gateway to dispatch it to, e.g. 'metadata.gateway'")
+	flag.StringVar(&endpointOrigins, "endpoint-allowed-origins", "", "Comma separated list of 'scheme://host[:port]' origins requests may be dispatched to through their endpoint-field-path field")
+	flag.StringVar(&objectiveFieldPath, "objective-field-path", "", "Dot separated JSON path of the request field holding its inference objective, e.g. 'payload.objective'")
+	flag.Int64Var(&retryJitterSeed, "retry-jitter-seed", 0, "Seed of the retry backoff jitter, for reproducible backoffs. Zero uses a random seed")
+	flag.BoolVar(&drainMode, "drain-mode", false, "Dead-letter every request without dispatching it, to clear a poisoned backlog")
+	flag.Float64Var(&tenantRateLimit, "tenant-rate-limit", 0, "Maximum requests per second dispatched for each tenant not listed in tenant-rate-limits. Zero means unlimited")
+	flag.StringVar(&tenantRateLimits, "tenant-rate-limits", "", "Comma separated list of 'tenant=requests-per-second' pairs overriding tenant-rate-limit")
+	flag.IntVar(&tenantRateBurst, "tenant-rate-burst", 10, "Number of requests a tenant may dispatch at once before being held to its rate")
+	flag.StringVar(&responseRequiredFields, "response-required-fields", "", "Comma separated list of dot separated JSON paths a successful response must hold, e.g. 'choices,usage'. Responses missing any of them are retried like server-side errors")
+	flag.BoolVar(&failEmptyResponses, "fail-empty-responses", false, "Retry the successful responses with an empty body like server-side errors, instead of publishing empty results")
+	flag.BoolVar(&retryOnlyIdempotent, "retry-only-idempotent", false, "Fail, instead of retrying, requests not marked idempotent that may have been executed by the model server")
+	flag.StringVar(&modelRewrites, "model-rewrites", "", "Comma separated list of 'name=model-id' pairs. Requests for a model name are dispatched with the model id, and responses report the name back")
+	flag.StringVar(&responseAdapters, "response-adapters", "", "Comma separated list of 'inference-gateway=format' pairs. Responses of the gateway in the native format are converted to the OpenAI schema. Supported formats: tgi, triton")
+	flag.IntVar(&maxResultBytes, "max-result-bytes", 0, "Largest result published, once marshaled, e.g. the message size limit of the broker. Zero means unlimited")
+	flag.StringVar(&oversizedResultPolicy, "oversized-result-policy", "dead-letter", "What to do with responses larger than max-result-bytes. Supported policies: dead-letter, store")
+	flag.StringVar(&resultStoreDir, "result-store-dir", "", "Directory the store oversized result policy writes the responses to")
+	flag.StringVar(&auditFile, "audit-file", "", "File to append an audit record of every dispatch to, as JSON lines")
+	flag.StringVar(&auditWebhookURL, "audit-webhook-url", "", "URL to post an audit record of every dispatch to, as JSON")
+	flag.StringVar(&auditFailurePolicy, "audit-failure-policy", "fail-open", "What to do with a request that can't be audited. Supported policies: fail-open (publish its result anyway), fail-closed (fail it)")
+	flag.StringVar(&auditEndpointHeader, "audit-endpoint-header", "x-gateway-destination-endpoint", "Response header of the inference gateway telling the endpoint a request was routed to, recorded in its audit record")
+	flag.StringVar(&resultServedBy, "result-served-by", "", "Comma separated list of 'field=response-header' pairs stamped on the results as served_by, e.g. 'endpoint=x-gateway-destination-endpoint'")
+	flag.BoolVar(&otelLogs, "otel-logs", false, "Export the outcome of every dispatched request as an OpenTelemetry log record over OTLP/HTTP. The exporter is configured with the standard OTEL_EXPORTER_OTLP_* environment variables")
+	flag.Float64Var(&otelLogsSampleRate, "otel-logs-sample-rate", 1, "Fraction of the request outcomes to export as OpenTelemetry logs, between 0 and 1")
+	flag.StringVar(&mirrorDir, "mirror-dir", "", "Directory to mirror successful requests and their responses to, as JSON lines. Empty disables mirroring")
+	flag.Float64Var(&mirrorSampleRate, "mirror-sample-rate", 1, "Fraction of the successful requests to mirror, between 0 and 1")
+	flag.Int64Var(&mirrorMaxFileSize, "mirror-max-file-size", 100*1024*1024, "Size in bytes after which the mirror file is rotated. Zero disables size-based rotation")
+	flag.DurationVar(&mirrorMaxFileAge, "mirror-max-file-age", time.Hour, "Age after which the mirror file is rotated. Zero disables time-based rotation")
+	flag.DurationVar(&requestTotalBudget, "request-total-budget", 0, "Maximum time spent on a request across all its attempts, counted from its first dequeue. Zero means bounded only by the request's deadline")
+	flag.IntVar(&compressionMinBytes, "compression-min-bytes", 0, "Gzip the request bodies of at least this many bytes. Zero disables request compression")
+	flag.DurationVar(&slowRequestThreshold, "slow-request-threshold", 0, "Log the details (endpoint, sizes, phase durations) of the dispatches lasting longer than this. Zero disables slow request logging")
+	flag.BoolVar(&latencyBreakdown, "dispatch-latency-breakdown", false, "Record the duration of each phase (DNS, connect, TLS, time to first byte) of every dispatch")
+	flag.StringVar(&httpProxy, "http-proxy", "", "URL of the HTTP proxy to send inference requests through. When empty, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are honored")
+	flag.Int64Var(&maxResponseHeaderBytes, "max-response-header-bytes", 1<<20, "Largest response headers accepted from the inference gateways. Responses with larger headers are failed")
+	flag.DurationVar(&responseCacheTTL, "response-cache-ttl", 0, "How long responses of deterministic requests (temperature 0) are cached. Zero disables caching")
+	flag.StringVar(&responseCacheImpl, "response-cache-impl", "in-memory", "The response cache implementation to use. Supported implementations: in-memory, redis")
+	flag.IntVar(&maxInFlightRetries, "max-in-flight-retries", 0, "Maximum number of requests waiting to be retried across all workers. Failed requests over it are dead-lettered. Zero means unlimited")
+	flag.DurationVar(&requestTimeout, "request-timeout", 120*time.Second, "Maximum time a dispatch to the inference gateway can take before being retried. Zero means bounded only by the request's deadline and budget")
+	flag.DurationVar(&retryBackoffBase, "retry-backoff-base", 2*time.Second, "Base of the exponential backoff of the retries: the n-th retry waits twice as long as the one before, starting at twice the base")
+	flag.DurationVar(&retryBackoffMax, "retry-backoff-max", 0, "Longest backoff of a retry. Zero means bounded only by the request's deadline")
+	flag.IntVar(&maxRetries, "max-retries", 0, "Maximum number of times a request is retried before being dead-lettered. Zero means unlimited")
+	flag.IntVar(&maxInFlight, "max-in-flight", 0, "Maximum number of requests processed at once across all workers. Zero means bounded only by concurrency")
+	flag.StringVar(&metricLabelModels, "metric-label-models", "", "Comma separated list of the models the SLO and token metrics are always labeled with, whatever metric-label-max-values")
+	flag.StringVar(&metricLabelTenants, "metric-label-tenants", "", "Comma separated list of the tenants the SLO and token metrics are always labeled with, whatever metric-label-max-values")
+	flag.IntVar(&metricLabelMaxValues, "metric-label-max-values", 100, "Number of models, and of tenants, besides the listed ones, the SLO and token metrics are labeled with. Past it, they are labeled 'other'")
+	flag.StringVar(&modelConcurrencyLimits, "model-concurrency-limits", "", "Comma separated list of 'model=max-concurrent-requests' pairs bounding the dispatches of a model at once across all workers")
+	flag.BoolVar(&orderedDispatch, "ordered-dispatch", false, "Dispatch requests sharing an ordering key in arrival order, one at a time")
+	flag.IntVar(&channelAffinityWorkers, "channel-affinity-workers", 0, "Number of workers bound to each request channel, bypassing the request merge policy and concurrency. Zero means all the workers drain the merged channels")
+	flag.DurationVar(&coalesceWindow, "coalesce-window", 0, "Window in which identical requests share a single dispatch. Zero disables coalescing")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 0, "How long the workers can take to finish their in-flight requests on shutdown. Zero abandons them right away")
 
-	flag.StringVar(&requestMergePolicy, "request-merge-policy", "random-robin", "The request merge policy to use. Supported policies: random-robin")
-	flag.StringVar(&messageQueueImpl, "message-queue-impl", "redis-pubsub", "The message queue implementation to use. Supported implementations: redis-pubsub")
+	flag.StringVar(&requestMergePolicy, "request-merge-policy", "random-robin", "The request merge policy to use. Supported policies: random-robin, weighted, priority")
+	flag.StringVar(&requestMergeWeights, "request-merge-weights", "", "Comma separated list of 'inference-objective=weight' pairs weighting the request channels of the weighted request merge policy")
+	flag.IntVar(&priorityAgingThreshold, "priority-aging-threshold", 0, "Number of requests the priority request merge policy dispatches by priority while the oldest waiting request is passed over, before dispatching that one anyway. Zero means never")
+	flag.IntVar(&priorityBufferSize, "priority-buffer-size", 100, "Number of requests the priority request merge policy holds to pick the one of highest priority from")
+	flag.StringVar(&messageQueueImpl, "message-queue-impl", "redis-pubsub", "The message queue implementation to use, or a comma separated primary and secondary implementations to fall back between. Supported implementations: redis-pubsub, gcp-pubsub, nats-core, nats-jetstream, kafka, sqs")
+	flag.StringVar(&resultBackpressurePolicy, "result-backpressure-policy", async.BlockPolicy, "What to do with new results while the message queue can't keep up. Supported policies: block, drop-oldest, spill")
+	flag.IntVar(&resultBackpressureBufferSize, "result-backpressure-buffer-size", 1000, "Number of results buffered by the drop-oldest and spill result backpressure policies")
+	flag.IntVar(&resultSpillSize, "result-spill-size", 10000, "Number of results the spill result backpressure policy writes to each of its files before blocking")
+	flag.StringVar(&resultSpillDir, "result-spill-dir", "", "Directory the spill result backpressure policy writes the results over its buffer to")
+	flag.DurationVar(&fallbackCheckInterval, "fallback-check-interval", 5*time.Second, "How often the health of the primary and secondary message queues is checked to pick the one requests are consumed from")
+
+	flag.DurationVar(&startupDelay, "startup-delay", 0, "How long to wait after startup before consuming requests from the message queue")
+	flag.StringVar(&startupReadinessURL, "startup-readiness-url", "", "URL polled until it answers with a 2xx status before consuming requests from the message queue, e.g. the readiness endpoint of the service mesh proxy")
+	flag.DurationVar(&startupReadinessTimeout, "startup-readiness-timeout", 5*time.Minute, "How long to wait for startup-readiness-url before exiting. Zero waits forever")
 
 	opts := zap.Options{
 		Development: true,
@@ -91,29 +229,422 @@ func main() {
 	switch requestMergePolicy {
 	case "random-robin":
 		policy = async.NewRandomRobinPolicy()
+	case "weighted":
+		weights, err := async.ParseChannelWeights(requestMergeWeights)
+		if err != nil {
+			setupLog.Error(err, "Failed to parse request merge weights")
+			os.Exit(1)
+		}
+		policy = async.NewWeightedPolicy(weights)
+	case "priority":
+		policy = async.NewPriorityPolicy(priorityAgingThreshold, priorityBufferSize)
 	default:
 		setupLog.Error(nil, "Unknown request merge policy", "request-merge-policy", requestMergePolicy)
 		os.Exit(1)
 	}
 
 	var impl api.Flow
-	switch messageQueueImpl {
-	case "redis-pubsub":
-		impl = redis.NewRedisMQFlow()
-	case "gcp-pubsub":
-		impl = pubsub.NewGCPPubSubMQFlow()
+	implNames := strings.Split(messageQueueImpl, ",")
+	if len(implNames) > 2 {
+		setupLog.Error(nil, "At most a primary and a secondary message queue implementation are supported", "message-queue-impl", messageQueueImpl)
+		os.Exit(1)
+	}
+	var flows []api.Flow
+	for _, name := range implNames {
+		flow, err := newFlow(strings.TrimSpace(name))
+		if errors.Is(err, errUnknownFlow) {
+			setupLog.Error(nil, "Unknown message queue implementation", "message-queue-impl", name)
+			os.Exit(1)
+		}
+		if err != nil {
+			// With a fallback, the processor keeps consuming from the message queue that could be reached.
+			setupLog.Error(err, "Failed to create message queue implementation", "message-queue-impl", name)
+			continue
+		}
+		flows = append(flows, flow)
+	}
+	switch len(flows) {
+	case 0:
+		os.Exit(1)
+	case 1:
+		impl = flows[0]
+	default:
+		impl = async.NewFallbackFlow(flows[0], flows[1], fallbackCheckInterval)
+	}
+
+	healthHandler := async.NewHealthHandler(impl)
+	if healthPort > 0 {
+		healthServer := &http.Server{Addr: fmt.Sprintf(":%d", healthPort), Handler: healthHandler}
+		go func() {
+			if err := healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				setupLog.Error(err, "Health server failed", "health-port", healthPort)
+			}
+		}()
+		defer healthServer.Close() // nolint:errcheck
+	}
+
+	dispatchClient, err := newDispatchClient(httpProxy, maxResponseHeaderBytes)
+	if err != nil {
+		setupLog.Error(err, "Failed to create the dispatch HTTP client")
+		os.Exit(1)
+	}
+
+	workerOptions := api.WorkerOptions{
+		LatencyBreakdown:     latencyBreakdown,
+		SlowRequestThreshold: slowRequestThreshold,
+		CompressionMinBytes:  compressionMinBytes,
+		TotalBudget:          requestTotalBudget,
+		RetryOnlyIdempotent:  retryOnlyIdempotent,
+		DrainMode:            drainMode,
+		RetryBackoffBase:     retryBackoffBase,
+		RetryBackoffMax:      retryBackoffMax,
+		MaxRetries:           maxRetries,
+		RequestTimeout:       requestTimeout,
+		MaxBodyURLBytes:      maxBodyURLBytes,
+	}
+	workerOptions.BodyURLOrigins, err = api.ParseOriginAllowlist(bodyURLOrigins)
+	if err != nil {
+		setupLog.Error(err, "Invalid body-url-allowed-origins")
+		os.Exit(1)
+	}
+	if endpointFieldPath != "" {
+		workerOptions.EndpointPath, err = api.ParseRequestFieldPath(endpointFieldPath)
+		if err != nil {
+			setupLog.Error(err, "Invalid endpoint-field-path")
+			os.Exit(1)
+		}
+		workerOptions.EndpointOrigins, err = api.ParseOriginAllowlist(endpointOrigins)
+		if err != nil {
+			setupLog.Error(err, "Invalid endpoint-allowed-origins")
+			os.Exit(1)
+		}
+		if len(workerOptions.EndpointOrigins) == 0 {
+			setupLog.Error(nil, "endpoint-field-path requires endpoint-allowed-origins")
+			os.Exit(1)
+		}
+	}
+	if objectiveFieldPath != "" {
+		workerOptions.ObjectivePath, err = api.ParseRequestFieldPath(objectiveFieldPath)
+		if err != nil {
+			setupLog.Error(err, "Invalid objective-field-path")
+			os.Exit(1)
+		}
+	}
+	if retryJitterSeed != 0 {
+		workerOptions.JitterSource = api.NewJitterSource(retryJitterSeed)
+	}
+	if drainMode {
+		setupLog.Info("Drain mode enabled: requests are dead-lettered without being dispatched")
+	}
+	if coalesceWindow > 0 {
+		workerOptions.Coalescer = api.NewCoalescer(coalesceWindow)
+	}
+	if maxInFlight > 0 {
+		// The workers take a slot before reading a request: a worker waiting on a partition or a channel of its own with
+		// no request would hold a slot the others need.
+		if orderedDispatch {
+			setupLog.Error(nil, "max-in-flight can't be used with ordered-dispatch")
+			os.Exit(1)
+		}
+		if channelAffinityWorkers > 0 {
+			setupLog.Error(nil, "max-in-flight can't be used with channel-affinity-workers")
+			os.Exit(1)
+		}
+		workerOptions.InFlight = make(chan struct{}, maxInFlight)
+	}
+	workerOptions.MetricLabels = api.NewMetricLabels(api.ParseLabelValues(metricLabelModels),
+		api.ParseLabelValues(metricLabelTenants), metricLabelMaxValues)
+	if modelConcurrencyLimits != "" {
+		limits, err := api.ParseModelConcurrencyLimits(modelConcurrencyLimits)
+		if err != nil {
+			setupLog.Error(err, "Failed to parse model concurrency limits")
+			os.Exit(1)
+		}
+		workerOptions.ModelConcurrency = api.NewModelConcurrencyLimiter(limits)
+	}
+	if maxInFlightRetries > 0 {
+		workerOptions.RetryTracker = api.NewRetryTracker(maxInFlightRetries)
+	}
+	if responseCacheTTL > 0 {
+		switch responseCacheImpl {
+		case "in-memory":
+			workerOptions.ResponseCache = api.NewInMemoryResponseCache(api.RealClock{})
+		case "redis":
+			workerOptions.ResponseCache = redis.NewRedisResponseCache()
+		default:
+			setupLog.Error(nil, "Unknown response cache implementation", "response-cache-impl", responseCacheImpl)
+			os.Exit(1)
+		}
+		workerOptions.ResponseCacheTTL = responseCacheTTL
+	}
+
+	if tenantRateLimit > 0 || tenantRateLimits != "" {
+		limits, err := api.ParseTenantRateLimits(tenantRateLimits)
+		if err != nil {
+			setupLog.Error(err, "Failed to parse tenant rate limits")
+			os.Exit(1)
+		}
+		workerOptions.TenantRateLimiter = api.NewTenantRateLimiter(tenantRateLimit, limits, tenantRateBurst)
+	}
+	workerOptions.FailEmptyResponses = failEmptyResponses
+	if responseRequiredFields != "" {
+		workerOptions.RequiredResponseFields, err = api.ParseRequiredFields(responseRequiredFields)
+		if err != nil {
+			setupLog.Error(err, "Invalid response-required-fields")
+			os.Exit(1)
+		}
+	}
+	if modelRewrites != "" {
+		rewrites, err := api.ParseModelRewrites(modelRewrites)
+		if err != nil {
+			setupLog.Error(err, "Failed to parse model rewrites")
+			os.Exit(1)
+		}
+		workerOptions.ModelRewrites = rewrites
+	}
+	if responseAdapters != "" {
+		adapters, err := api.ParseResponseAdapters(responseAdapters)
+		if err != nil {
+			setupLog.Error(err, "Failed to parse response adapters")
+			os.Exit(1)
+		}
+		workerOptions.ResponseAdapters = adapters
+	}
+	if mirrorDir != "" {
+		mirror, err := async.NewFileMirror(mirrorDir, mirrorSampleRate, mirrorMaxFileSize, mirrorMaxFileAge)
+		if err != nil {
+			setupLog.Error(err, "Failed to create the request mirror")
+			os.Exit(1)
+		}
+		defer mirror.Close() // nolint:errcheck
+		workerOptions.Mirror = mirror
+	}
+	workerOptions.MaxResultBytes = maxResultBytes
+	switch oversizedResultPolicy {
+	case "dead-letter":
+	case "store":
+		if resultStoreDir == "" {
+			setupLog.Error(nil, "The store oversized result policy needs a result-store-dir")
+			os.Exit(1)
+		}
+		workerOptions.ResultStore, err = async.NewFileResultStore(resultStoreDir)
+		if err != nil {
+			setupLog.Error(err, "Failed to create the result store")
+			os.Exit(1)
+		}
+	default:
+		setupLog.Error(nil, "Unknown oversized result policy", "oversized-result-policy", oversizedResultPolicy)
+		os.Exit(1)
+	}
+	switch {
+	case auditFile != "" && auditWebhookURL != "":
+		setupLog.Error(nil, "Only one of audit-file and audit-webhook-url can be set")
+		os.Exit(1)
+	case auditFile != "":
+		auditSink, err := async.NewFileAuditSink(auditFile)
+		if err != nil {
+			setupLog.Error(err, "Failed to create the audit sink")
+			os.Exit(1)
+		}
+		defer auditSink.Close() // nolint:errcheck
+		workerOptions.AuditSink = auditSink
+	case auditWebhookURL != "":
+		workerOptions.AuditSink = async.NewWebhookAuditSink(auditWebhookURL, &http.Client{Timeout: 10 * time.Second})
+	}
+	workerOptions.RoutedEndpointHeader = auditEndpointHeader
+	workerOptions.ServedByHeaders, err = api.ParseServedByHeaders(resultServedBy)
+	if err != nil {
+		setupLog.Error(err, "Invalid result-served-by")
+		os.Exit(1)
+	}
+	switch auditFailurePolicy {
+	case "fail-open":
+	case "fail-closed":
+		workerOptions.AuditFailClosed = true
 	default:
-		setupLog.Error(nil, "Unknown message queue implementation", "message-queue-impl", messageQueueImpl)
+		setupLog.Error(nil, "Unknown audit failure policy", "audit-failure-policy", auditFailurePolicy)
+		os.Exit(1)
+	}
+	if otelLogs {
+		exporter, err := otlploghttp.New(ctx)
+		if err != nil {
+			setupLog.Error(err, "Failed to create the OpenTelemetry logs exporter")
+			os.Exit(1)
+		}
+		outcomeLogger, err := otellogs.NewOutcomeLogger(exporter, otelLogsSampleRate)
+		if err != nil {
+			setupLog.Error(err, "Failed to create the OpenTelemetry outcome logger")
+			os.Exit(1)
+		}
+		defer func() {
+			// The main context is done by now, give the pending records some time to be exported.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			outcomeLogger.Shutdown(shutdownCtx) // nolint:errcheck
+		}()
+		workerOptions.OutcomeSink = outcomeLogger
+	}
+
+	// The message queue outlives the workers while they drain, for the results of their last requests to be published.
+	workerOptions.DrainTimeout = drainTimeout
+	flowCtx, stopFlow := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopFlow()
+
+	if resultBackpressurePolicy == async.DropOldestPolicy && impl.Characteristics().AcksOnResult {
+		// The request of a dropped result would be held by the message queue until its ack deadline.
+		setupLog.Error(nil, "The drop-oldest result backpressure policy can't be used with message queues acknowledging requests on result",
+			"message-queue-impl", messageQueueImpl)
+		os.Exit(1)
+	}
+	if resultBackpressurePolicy == async.SpillPolicy && resultSpillDir == "" {
+		setupLog.Error(nil, "The spill result backpressure policy needs a result-spill-dir")
+		os.Exit(1)
+	}
+	resultBuffer, err := async.ResultBackpressure(flowCtx, impl.ResultChannel(), resultBackpressurePolicy,
+		resultBackpressureBufferSize, filepath.Join(resultSpillDir, "results.jsonl"), resultSpillSize)
+	if err != nil {
+		setupLog.Error(err, "Invalid result backpressure")
 		os.Exit(1)
 	}
+	resultBuffers := []*async.ResultBuffer{resultBuffer}
+	if errorResultFlow, ok := impl.(api.ErrorResultFlow); ok && errorResultFlow.ErrorResultChannel() != nil {
+		errorBuffer, err := async.ResultBackpressure(flowCtx, errorResultFlow.ErrorResultChannel(),
+			resultBackpressurePolicy, resultBackpressureBufferSize, filepath.Join(resultSpillDir, "errors.jsonl"),
+			resultSpillSize)
+		if err != nil {
+			setupLog.Error(err, "Invalid result backpressure")
+			os.Exit(1)
+		}
+		workerOptions.ErrorResultChannel = errorBuffer.Channel
+		resultBuffers = append(resultBuffers, errorBuffer)
+	}
+	if deadLetterFlow, ok := impl.(api.DeadLetterFlow); ok && deadLetterFlow.DeadLetterChannel() != nil {
+		deadLetterBuffer, err := async.ResultBackpressure(flowCtx, deadLetterFlow.DeadLetterChannel(),
+			resultBackpressurePolicy, resultBackpressureBufferSize, filepath.Join(resultSpillDir, "dead-letters.jsonl"),
+			resultSpillSize)
+		if err != nil {
+			setupLog.Error(err, "Invalid result backpressure")
+			os.Exit(1)
+		}
+		workerOptions.DeadLetterChannel = deadLetterBuffer.Channel
+		resultBuffers = append(resultBuffers, deadLetterBuffer)
+	}
+
+	var workerChannels []chan api.EmbelishedRequestMessage
+	if channelAffinityWorkers > 0 {
+		if orderedDispatch {
+			setupLog.Error(nil, "ordered-dispatch can't be used with channel-affinity-workers")
+			os.Exit(1)
+		}
+		workerChannels = async.BindWorkersToChannels(impl.RequestChannels(), channelAffinityWorkers)
+		concurrency = len(workerChannels)
+	} else {
+		mergedChannel := policy.MergeRequestChannels(impl.RequestChannels())
+		workerChannels = make([]chan api.EmbelishedRequestMessage, concurrency)
+		if orderedDispatch {
+			workerChannels = async.PartitionByOrderingKey(mergedChannel, concurrency)
+		} else {
+			for w := range workerChannels {
+				workerChannels[w] = mergedChannel.Channel
+			}
+		}
+	}
+	workerPool := api.NewWorkerPool(func(index int, stop <-chan struct{}) {
+		opts := workerOptions
+		opts.Stop = stop
+		api.Worker(ctx, impl.Characteristics(), dispatchClient, workerChannels[index], impl.RetryChannel(), resultBuffer.Channel, opts)
+	})
+	workerPool.Start(concurrency)
 
-	requestChannel := policy.MergeRequestChannels(impl.RequestChannels()).Channel
-	for w := 1; w <= concurrency; w++ {
-		go api.Worker(ctx, impl.Characteristics(), httpClient, requestChannel, impl.RetryChannel(), impl.ResultChannel())
+	if startupDelay > 0 {
+		setupLog.Info("Delaying consumption", "startup-delay", startupDelay)
+		select {
+		case <-time.After(startupDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+	if startupReadinessURL != "" {
+		readinessCtx, cancel := ctx, func() {}
+		if startupReadinessTimeout > 0 {
+			readinessCtx, cancel = context.WithTimeout(ctx, startupReadinessTimeout)
+		}
+		err := async.WaitForReadiness(readinessCtx, httpClient, startupReadinessURL, time.Second)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			setupLog.Error(err, "Startup readiness check failed", "startup-readiness-url", startupReadinessURL)
+			os.Exit(1)
+		}
 	}
 
-	impl.Start(ctx)
+	// Requests and retries are not consumed anymore once ctx is done, results are published until flowCtx is.
+	impl.Start(api.WithConsumeContext(flowCtx, ctx))
+	healthHandler.SetReady(true)
 	<-ctx.Done()
+	healthHandler.SetReady(false)
+	if drainTimeout > 0 {
+		setupLog.Info("Draining workers", "drain-timeout", drainTimeout)
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := workerPool.Wait(drainCtx); err != nil {
+			setupLog.Info("Workers not drained in time")
+		} else if err := async.WaitForResults(drainCtx, 10*time.Millisecond, impl, resultBuffers...); err != nil {
+			setupLog.Info("Results not published in time")
+		}
+	}
+	stopFlow()
+}
+
+var errUnknownFlow = errors.New("unknown message queue implementation")
+
+// newFlow returns the message queue implementation with the given name, or errUnknownFlow if there is none.
+func newFlow(name string) (api.Flow, error) {
+	switch name {
+	case "redis-pubsub":
+		return redis.NewRedisMQFlow(), nil
+	case "gcp-pubsub":
+		return pubsub.NewGCPPubSubMQFlow()
+	case "nats-core":
+		return nats.NewNATSCoreMQFlow()
+	case "nats-jetstream":
+		return nats.NewJetStreamMQFlow()
+	case "kafka":
+		return kafka.NewKafkaMQFlow(), nil
+	case "sqs":
+		return sqs.NewSQSMQFlow()
+	default:
+		return nil, errUnknownFlow
+	}
+}
+
+// newDispatchClient returns the client the workers use to send requests to the inference gateways.
+func newDispatchClient(httpProxy string, maxResponseHeaderBytes int64) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxResponseHeaderBytes = maxResponseHeaderBytes
+	if httpProxy != "" {
+		proxyURL, err := url.Parse(httpProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http-proxy %q: %w", httpProxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{
+		Transport: transport,
+		// Only the redirects keeping the request as is (307 and 308) are followed. The others would turn it into a GET,
+		// their response is handed to the worker as an unexpected status instead.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.Method != via[0].Method {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}, nil
 }
 
 func printAllFlags(setupLog logr.Logger) {
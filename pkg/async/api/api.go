@@ -7,7 +7,8 @@ type Flow interface {
 	// Characteristic of the impl
 	Characteristics() Characteristics
 
-	// starts processing requests.
+	// starts processing requests. Requests and retries are consumed until ConsumeContext(ctx) is done, results are
+	// published until ctx is.
 	Start(ctx context.Context)
 
 	// returns the channels for requests. Implementation is responsible for publishing on these channels.
@@ -19,8 +20,39 @@ type Flow interface {
 	ResultChannel() chan ResultMessage
 }
 
+// ErrorResultFlow is implemented by flows that publish error results separately from successful ones.
+type ErrorResultFlow interface {
+	// returns the channel for error results, or nil if errors should go to the ResultChannel. Implementation is
+	// responsible for consuming messages on this channel.
+	ErrorResultChannel() chan ResultMessage
+}
+
+// DeadLetterFlow is implemented by flows that publish the requests that exhausted their retries separately, for them
+// to be inspected or replayed.
+type DeadLetterFlow interface {
+	// returns the channel for the results of the requests that exhausted their retries, or nil if they should go with
+	// the error results. Implementation is responsible for consuming messages on this channel.
+	DeadLetterChannel() chan ResultMessage
+}
+
+// HealthCheckFlow is implemented by flows able to tell whether their message queue is reachable.
+type HealthCheckFlow interface {
+	// returns an error if the message queue can't be reached.
+	Healthy(ctx context.Context) error
+}
+
+// PendingResultsFlow is implemented by flows that take results from their channels before publishing them, e.g. to
+// batch them, so that a drain can wait for those results to be published as well.
+type PendingResultsFlow interface {
+	// returns the number of results taken from the result channels and not published yet.
+	PendingResults() int
+}
+
 type Characteristics struct {
 	HasExternalBackoff bool
+	// AcksOnResult is set when a request is acknowledged to the message queue only once its result is published, so
+	// that a result that is never published leaves its request unacknowledged.
+	AcksOnResult bool
 }
 
 type RequestMergePolicy interface {
@@ -35,6 +67,15 @@ type RequestMessage struct {
 	DeadlineUnixSec string            `json:"deadline"`              // TODO: check about using int64, change name to timeout
 	Payload         map[string]any    `json:"payload"`
 	Metadata        map[string]string `json:"metadata,omitempty"`
+	OrderingKey     string            `json:"ordering_key,omitempty"`     // Requests sharing a key are dispatched in arrival order (see ordered-dispatch)
+	FirstDequeueMs  int64             `json:"first_dequeue_ms,omitempty"` // Unix milliseconds of the first attempt. Set by the worker
+	Idempotent      bool              `json:"idempotent,omitempty"`       // The request can be executed more than once (see retry-only-idempotent)
+	Body            []byte            `json:"body,omitempty"`             // Raw request body, sent instead of the payload (e.g. images or audio)
+	BodyURL         string            `json:"body_url,omitempty"`         // URL to fetch the raw request body from, sent instead of the payload
+	ContentType     string            `json:"content_type,omitempty"`     // Content-Type of the body. Defaults to application/json
+	SLOMs           int64             `json:"slo_ms,omitempty"`           // Milliseconds from the first dequeue within which the result is expected
+	Priority        int               `json:"priority,omitempty"`         // Higher priorities are dispatched first (see the priority request merge policy)
+	RetriedAtMs     int64             `json:"retried_at_ms,omitempty"`    // Unix milliseconds of the last retry. Set by the worker
 }
 
 type RequestChannel struct {
@@ -62,7 +103,10 @@ type RetryMessage struct {
 
 // optional field of httpstatus, golang error?
 type ResultMessage struct {
-	Id       string            `json:"id"`
-	Payload  string            `json:"payload"`
-	Metadata map[string]string `json:"-"`
+	Id             string            `json:"id"`
+	Payload        string            `json:"payload"`
+	IdempotencyKey string            `json:"idempotency_key"`       // Unique per result, shared by every delivery of the same result
+	PayloadRef     string            `json:"payload_ref,omitempty"` // Where the payload was stored instead, when too large to publish (see max-result-bytes)
+	ServedBy       map[string]string `json:"served_by,omitempty"`   // What served the request, as told by the response headers (see result-served-by)
+	Metadata       map[string]string `json:"-"`
 }
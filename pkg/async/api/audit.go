@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// defaultRoutedEndpointHeader is the response header telling which endpoint the inference gateway routed a request to.
+const defaultRoutedEndpointHeader = "x-gateway-destination-endpoint"
+
+// AuditRecord records that a request was dispatched, when, and where: Endpoint is the inference gateway it was sent
+// to, RoutedEndpoint the endpoint the gateway routed it to, when the response tells.
+type AuditRecord struct {
+	Time           time.Time `json:"time"`
+	RequestId      string    `json:"request_id"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Model          string    `json:"model,omitempty"`
+	Endpoint       string    `json:"endpoint"`
+	RoutedEndpoint string    `json:"routed_endpoint,omitempty"`
+	RetryCount     int       `json:"retry_count"`
+}
+
+// AuditSink receives an AuditRecord after every dispatch, e.g. to keep a compliance audit trail separate from the logs
+// and metrics. Audit is called by the workers, which wait for it before handling the response.
+type AuditSink interface {
+	Audit(ctx context.Context, record AuditRecord) error
+}
+
+func newAuditRecord(msg EmbelishedRequestMessage, dispatchedAt time.Time, routedEndpoint string) AuditRecord {
+	model, _ := msg.Payload["model"].(string)
+	return AuditRecord{
+		Time:           dispatchedAt,
+		RequestId:      msg.Id,
+		Tenant:         msg.RequestMessage.Metadata[TenantMetadataKey],
+		Model:          model,
+		Endpoint:       msg.InferenceGateway,
+		RoutedEndpoint: routedEndpoint,
+		RetryCount:     msg.RetryCount,
+	}
+}
@@ -0,0 +1,16 @@
+package api
+
+import "time"
+
+// Clock tells the time to the time-based logic of the workers: deadlines, the total budget, the retry backoff and the
+// dispatch latency. Tests inject a fake one to assert on that logic deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the wall clock, used when no Clock is set.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Coalescer collapses identical inference requests into a single dispatch. Requests are identical when they target the
+// same gateway with the same headers and payload. A dispatch is shared with every identical request that arrives while
+// it is in flight, and with those arriving up to 'window' after it started.
+type Coalescer struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done    chan struct{}
+	outcome dispatchOutcome
+}
+
+func NewCoalescer(window time.Duration) *Coalescer {
+	return &Coalescer{
+		window: window,
+		calls:  make(map[string]*coalescedCall),
+	}
+}
+
+// do runs fn for the first request with the given key and hands its outcome to all the requests sharing that key.
+// Returns true in 'shared' if the outcome was produced by another request. The window is measured with clock.
+func (c *Coalescer) do(ctx context.Context, clock Clock, key string, fn func() dispatchOutcome) (outcome dispatchOutcome, shared bool, err error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.outcome, true, nil
+		case <-ctx.Done():
+			return dispatchOutcome{}, true, ctx.Err()
+		}
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	windowEnd := clock.Now().Add(c.window)
+	call.outcome = fn()
+	close(call.done)
+
+	// Keep the outcome around until the window is over, so late arrivals can still share it.
+	forget := func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+	}
+	if remaining := windowEnd.Sub(clock.Now()); remaining > 0 {
+		time.AfterFunc(remaining, forget)
+	} else {
+		forget()
+	}
+	return call.outcome, false, nil
+}
+
+// requestKey hashes everything that makes the inference request unique.
+func requestKey(msg EmbelishedRequestMessage, payloadBytes []byte) string {
+	headerNames := make([]string, 0, len(msg.HttpHeaders))
+	for k := range msg.HttpHeaders {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+
+	h := sha256.New()
+	h.Write([]byte(msg.InferenceGateway))
+	h.Write([]byte{0})
+	h.Write([]byte(msg.ContentType))
+	h.Write([]byte{0})
+	for _, k := range headerNames {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(msg.HttpHeaders[k]))
+		h.Write([]byte{0})
+	}
+	h.Write(payloadBytes)
+	return hex.EncodeToString(h.Sum(nil))
+}
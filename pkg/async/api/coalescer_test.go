@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescer_sharesDispatch(t *testing.T) {
+	coalescer := NewCoalescer(time.Second)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() dispatchOutcome {
+		calls.Add(1)
+		<-release
+		return dispatchOutcome{statusCode: 200, body: []byte("ok")}
+	}
+
+	var wg sync.WaitGroup
+	var sharedCount atomic.Int32
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcome, shared, err := coalescer.do(context.Background(), RealClock{}, "key", fn)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if string(outcome.body) != "ok" {
+				t.Errorf("Expected shared body to be 'ok', got %s", outcome.body)
+			}
+			if shared {
+				sharedCount.Add(1)
+			}
+		}()
+	}
+	// Give all the goroutines a chance to join the in-flight call.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected a single dispatch, got %d", calls.Load())
+	}
+	if sharedCount.Load() != 4 {
+		t.Errorf("Expected 4 requests to share the dispatch, got %d", sharedCount.Load())
+	}
+}
+
+func TestCoalescer_windowExpires(t *testing.T) {
+	coalescer := NewCoalescer(10 * time.Millisecond)
+	var calls atomic.Int32
+	fn := func() dispatchOutcome {
+		calls.Add(1)
+		return dispatchOutcome{statusCode: 200}
+	}
+
+	coalescer.do(context.Background(), RealClock{}, "key", fn) // nolint:errcheck
+	if _, shared, _ := coalescer.do(context.Background(), RealClock{}, "key", fn); !shared {
+		t.Errorf("Expected request within the window to share the dispatch")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, shared, _ := coalescer.do(context.Background(), RealClock{}, "key", fn); shared {
+		t.Errorf("Expected request after the window to dispatch on its own")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected 2 dispatches, got %d", calls.Load())
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import "context"
+
+type consumeContextKey struct{}
+
+// WithConsumeContext returns a copy of ctx, meant for Flow.Start, carrying consumeCtx. The flow stops consuming
+// requests and retries once consumeCtx is done, and keeps publishing results until ctx is, so that the results of the
+// requests being drained still reach the message queue.
+func WithConsumeContext(ctx, consumeCtx context.Context) context.Context {
+	return context.WithValue(ctx, consumeContextKey{}, consumeCtx)
+}
+
+// ConsumeContext returns the context ending the consumption of a flow started with ctx: the one given to
+// WithConsumeContext, or ctx itself.
+func ConsumeContext(ctx context.Context) context.Context {
+	if consumeCtx, ok := ctx.Value(consumeContextKey{}).(context.Context); ok {
+		return consumeCtx
+	}
+	return ctx
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+)
+
+// dispatchTimings records when each phase of a dispatch started and ended. Phases that did not happen (e.g. DNS and
+// connect when a pooled connection was reused) are left as zero times.
+type dispatchTimings struct {
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+	end          time.Time
+}
+
+func newDispatchTimings() *dispatchTimings {
+	return &dispatchTimings{start: time.Now()}
+}
+
+func (t *dispatchTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { t.connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+// phases returns the duration of each phase that happened, keyed by phase name.
+func (t *dispatchTimings) phases() map[string]time.Duration {
+	phases := map[string]time.Duration{}
+	addPhase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			phases[name] = to.Sub(from)
+		}
+	}
+	addPhase("dns", t.dnsStart, t.dnsDone)
+	addPhase("connect", t.connectStart, t.connectDone)
+	addPhase("tls", t.tlsStart, t.tlsDone)
+	addPhase("ttfb", t.start, t.firstByte)
+	addPhase("total", t.start, t.end)
+	return phases
+}
+
+func (t *dispatchTimings) observe() {
+	for phase, duration := range t.phases() {
+		metrics.DispatchPhaseDuration.WithLabelValues(phase).Observe(duration.Seconds())
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldPath locates a field of the request message by the JSON names leading to it, e.g. 'payload.routing.endpoint'
+// or 'metadata.gateway'.
+type FieldPath []string
+
+// ParseFieldPath parses a dot separated path. A leading '$.' is accepted and ignored.
+func ParseFieldPath(s string) (FieldPath, error) {
+	s = strings.TrimPrefix(s, "$.")
+	path := FieldPath(strings.Split(s, "."))
+	for _, name := range path {
+		if name == "" {
+			return nil, fmt.Errorf("invalid field path %q", s)
+		}
+	}
+	return path, nil
+}
+
+// ParseRequestFieldPath parses a dot separated path to a field of the payload or the metadata of the requests, e.g.
+// 'payload.routing.endpoint' or 'metadata.gateway'.
+func ParseRequestFieldPath(s string) (FieldPath, error) {
+	path, err := ParseFieldPath(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) < 2 || (path[0] != "payload" && path[0] != "metadata") || (path[0] == "metadata" && len(path) > 2) {
+		return nil, fmt.Errorf("invalid request field path %q, expected 'payload.<field>...' or 'metadata.<key>'", s)
+	}
+	return path, nil
+}
+
+// lookup returns the value of the field of the payload or the metadata, if the message has it and it is a non-empty
+// string.
+func (p FieldPath) lookup(msg RequestMessage) (string, bool) {
+	if len(p) < 2 {
+		return "", false
+	}
+	var value any
+	switch p[0] {
+	case "payload":
+		value, _ = p[1:].find(msg.Payload)
+	case "metadata":
+		if len(p) == 2 {
+			value = msg.Metadata[p[1]]
+		}
+	}
+	s, ok := value.(string)
+	return s, ok && s != ""
+}
+
+// find returns the value of the field in the decoded JSON document, if it has it and it isn't null.
+func (p FieldPath) find(document any) (any, bool) {
+	value := document
+	for _, name := range p {
+		switch object := value.(type) {
+		case map[string]any:
+			value = object[name]
+		case map[string]string:
+			value = object[name]
+		default:
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+func (p FieldPath) String() string {
+	return strings.Join(p, ".")
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"flag"
+)
+
+// Flags shared by the Flow implementations.
+var (
+	// BrokerKeepaliveInterval is how often the flows ping their broker connections, so that idle connections are kept
+	// open and dead ones are detected before the next operation. Zero disables the pings.
+	BrokerKeepaliveInterval = flag.Duration("broker-keepalive-interval", 0, "How often to ping the message queue connections to keep them alive while idle. Zero disables keepalive pings")
+	// ResultPublishBatchSize and ResultPublishBatchWindow bound the batches in which the flows publish results: a batch
+	// is flushed once it holds ResultPublishBatchSize results or ResultPublishBatchWindow after its first result.
+	ResultPublishBatchSize   = flag.Int("result-publish-batch-size", 0, "Maximum number of results published to the message queue at once. Zero keeps the implementation's default")
+	ResultPublishBatchWindow = flag.Duration("result-publish-batch-window", 0, "Maximum time a result waits for its batch to fill up before being published. Zero keeps the implementation's default")
+	// ResultWorkers and ResultBufferSize decouple the workers from the publishing of the results: the flows buffer up to
+	// ResultBufferSize results, published by ResultWorkers goroutines, so the workers only wait for the publisher once
+	// the buffer is full.
+	ResultWorkers    = flag.Int("result-workers", 1, "Number of goroutines publishing results to the message queue")
+	ResultBufferSize = flag.Int("result-buffer-size", 0, "Number of results waiting to be published before the workers block on publishing")
+	// DeadLetterWorkers and DeadLetterBufferSize are the same for the error results, when the flows publish them to
+	// their own queue, so that dead-lettering during a failure storm doesn't hold up the publishing of the results.
+	DeadLetterWorkers    = flag.Int("dead-letter-workers", 0, "Number of goroutines publishing error results to the error queue. Zero means result-workers")
+	DeadLetterBufferSize = flag.Int("dead-letter-buffer-size", -1, "Number of error results waiting to be published to the error queue before the workers block on dead-lettering. Negative means result-buffer-size")
+)
+
+// ResultWorkerCount returns the number of result publishing goroutines to start, at least one.
+func ResultWorkerCount() int {
+	return max(*ResultWorkers, 1)
+}
+
+// NewResultChannel returns a result channel buffering ResultBufferSize results.
+func NewResultChannel() chan ResultMessage {
+	return make(chan ResultMessage, max(*ResultBufferSize, 0))
+}
+
+// DeadLetterWorkerCount returns the number of error result publishing goroutines to start, at least one.
+func DeadLetterWorkerCount() int {
+	if *DeadLetterWorkers <= 0 {
+		return ResultWorkerCount()
+	}
+	return *DeadLetterWorkers
+}
+
+// NewErrorResultChannel returns an error result channel buffering DeadLetterBufferSize error results.
+func NewErrorResultChannel() chan ResultMessage {
+	if *DeadLetterBufferSize < 0 {
+		return NewResultChannel()
+	}
+	return make(chan ResultMessage, *DeadLetterBufferSize)
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// lockedSource makes a rand.Source safe to share between workers.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+// NewJitterSource returns a seeded source for WorkerOptions.JitterSource, safe for concurrent use. Workers sharing it
+// with the same seed draw the same sequence of jitters, in the order they retry.
+func NewJitterSource(seed int64) rand.Source {
+	return &lockedSource{src: rand.NewSource(seed)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"strings"
+	"sync"
+)
+
+// OtherLabelValue is the value of the model and tenant labels of the requests whose model or tenant is past the
+// cardinality cap of the MetricLabels.
+const OtherLabelValue = "other"
+
+// MetricLabels bounds the models and tenants the metrics are labeled with. The model and tenant of a request come from
+// its content: the listed values are always label values, the first others seen too, up to a cap, and the rest are
+// counted as OtherLabelValue to bound the number of series. The zero MetricLabels counts every model and tenant as
+// OtherLabelValue.
+type MetricLabels struct {
+	models  *labelValues
+	tenants *labelValues
+}
+
+// NewMetricLabels returns the MetricLabels passing the listed models and tenants through, and up to maxValues other
+// models and maxValues other tenants, in the order they are seen.
+func NewMetricLabels(models, tenants map[string]bool, maxValues int) MetricLabels {
+	return MetricLabels{
+		models:  &labelValues{listed: models, maxValues: maxValues, seen: map[string]bool{}},
+		tenants: &labelValues{listed: tenants, maxValues: maxValues, seen: map[string]bool{}},
+	}
+}
+
+// ParseLabelValues parses a comma separated list of label values.
+func ParseLabelValues(s string) map[string]bool {
+	values := map[string]bool{}
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values[value] = true
+		}
+	}
+	return values
+}
+
+// model returns the model label of the request, empty if it has no model.
+func (l MetricLabels) model(msg RequestMessage) string {
+	model, _ := msg.Payload["model"].(string)
+	return l.models.bucket(model)
+}
+
+// tenant returns the tenant label of the request, empty if it has no tenant.
+func (l MetricLabels) tenant(msg RequestMessage) string {
+	return l.tenants.bucket(msg.Metadata[TenantMetadataKey])
+}
+
+// labelValues tracks the values a label took, to cap their number.
+type labelValues struct {
+	listed    map[string]bool
+	maxValues int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (v *labelValues) bucket(value string) string {
+	if value == "" {
+		return value
+	}
+	if v == nil {
+		return OtherLabelValue
+	}
+	if v.listed[value] {
+		return value
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.seen[value] && len(v.seen) >= v.maxValues {
+		return OtherLabelValue
+	}
+	v.seen[value] = true
+	return value
+}
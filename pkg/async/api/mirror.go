@@ -0,0 +1,7 @@
+package api
+
+// Mirror receives a copy of the requests that were dispatched successfully, along with their response, e.g. to build
+// evaluation datasets offline. Record is called by the workers and should not block them for long.
+type Mirror interface {
+	Record(request RequestMessage, response []byte)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ModelConcurrencyLimiter bounds the number of requests dispatched at once for each model, across all the workers
+// sharing it, with a semaphore per model. Unlike the in-flight limit, it protects expensive models however many model
+// servers serve them. Models without a limit are not bounded.
+type ModelConcurrencyLimiter struct {
+	slots map[string]chan struct{}
+}
+
+// NewModelConcurrencyLimiter creates a limiter allowing 'limits[model]' concurrent dispatches for each model. A limit of
+// zero or less means unlimited.
+func NewModelConcurrencyLimiter(limits map[string]int) *ModelConcurrencyLimiter {
+	l := &ModelConcurrencyLimiter{slots: make(map[string]chan struct{}, len(limits))}
+	for model, limit := range limits {
+		if limit > 0 {
+			l.slots[model] = make(chan struct{}, limit)
+		}
+	}
+	return l
+}
+
+// acquire blocks until a dispatch of the model is allowed, and returns the function to call once it is over. Returns
+// an error if the context is done first.
+func (l *ModelConcurrencyLimiter) acquire(ctx context.Context, model string) (func(), error) {
+	slots, ok := l.slots[model]
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ParseModelConcurrencyLimits parses a comma separated list of 'model=max-concurrent-requests' pairs.
+func ParseModelConcurrencyLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		model, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("invalid model concurrency limit %q, expected 'model=max-concurrent-requests'", pair)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid model concurrency limit %q: %w", pair, err)
+		}
+		limits[strings.TrimSpace(model)] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestModelConcurrencyLimiter(t *testing.T) {
+	limits, err := ParseModelConcurrencyLimits("big=1, small=0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limiter := NewModelConcurrencyLimiter(limits)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	release, err := limiter.acquire(ctx, "big")
+	if err != nil {
+		t.Fatalf("Expected the first dispatch to go through, got %v", err)
+	}
+	if _, err := limiter.acquire(ctx, "big"); err == nil {
+		t.Errorf("Expected the second dispatch of a model limited to 1 to wait until the context is done")
+	}
+	release()
+	if _, err := limiter.acquire(context.Background(), "big"); err != nil {
+		t.Errorf("Expected a released slot to be available, got %v", err)
+	}
+
+	// Other models are not affected.
+	for range 10 {
+		if _, err := limiter.acquire(ctx, "small"); err != nil {
+			t.Fatalf("Expected an unlimited model not to wait, got %v", err)
+		}
+		if _, err := limiter.acquire(ctx, "other"); err != nil {
+			t.Fatalf("Expected a model without a limit not to wait, got %v", err)
+		}
+	}
+
+	if _, err := ParseModelConcurrencyLimits("big"); err == nil {
+		t.Errorf("Expected an error for a limit without a value")
+	}
+	if _, err := ParseModelConcurrencyLimits("big=many"); err == nil {
+		t.Errorf("Expected an error for a limit that is not a number")
+	}
+}
+
+func TestModelConcurrencyAcrossWorkers(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 4)
+	retryChannel := make(chan RetryMessage, 4)
+	resultChannel := make(chan ResultMessage, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := WorkerOptions{ModelConcurrency: NewModelConcurrencyLimiter(map[string]int{"big": 1})}
+	for range 4 {
+		go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, opts)
+	}
+	for i := range 4 {
+		requestChannel <- EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              fmt.Sprintf("%d", i),
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "big", "prompt": "hi"},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+	}
+	for range 4 {
+		select {
+		case <-resultChannel:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a result for every request")
+		}
+	}
+	if maxInFlight.Load() != 1 {
+		t.Errorf("Expected at most 1 dispatch of the model at once, got %d", maxInFlight.Load())
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// ModelRewrites maps the model names requests are sent with (e.g. friendly aliases) to the model ids the model servers
+// expect. Responses are mapped back, so clients only ever see the name they used.
+type ModelRewrites map[string]string
+
+// ParseModelRewrites parses a comma separated list of 'name=model-id' pairs.
+func ParseModelRewrites(s string) (ModelRewrites, error) {
+	rewrites := ModelRewrites{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, modelID, ok := strings.Cut(pair, "=")
+		name, modelID = strings.TrimSpace(name), strings.TrimSpace(modelID)
+		if !ok || name == "" || modelID == "" {
+			return nil, fmt.Errorf("invalid model rewrite %q, expected 'name=model-id'", pair)
+		}
+		rewrites[name] = modelID
+	}
+	return rewrites, nil
+}
+
+// rewriteRequest returns the message with the model of its payload rewritten. The payload is copied, so the original
+// message (which may be retried) keeps the name it was sent with.
+func (r ModelRewrites) rewriteRequest(msg RequestMessage) RequestMessage {
+	name, _ := msg.Payload["model"].(string)
+	modelID, ok := r[name]
+	if !ok {
+		return msg
+	}
+	msg.Payload = maps.Clone(msg.Payload)
+	msg.Payload["model"] = modelID
+	return msg
+}
+
+// restoreResponse puts back the model name of the request in the response body. Bodies that are not JSON objects, or
+// don't report a model, are returned unchanged.
+func (r ModelRewrites) restoreResponse(msg RequestMessage, body []byte) []byte {
+	name, _ := msg.Payload["model"].(string)
+	if _, ok := r[name]; !ok {
+		return body
+	}
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	if _, ok := response["model"]; !ok {
+		return body
+	}
+	response["model"], _ = json.Marshal(name)
+	restored, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+	return restored
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// OriginAllowlist is the set of origins, 'scheme://host[:port]', the processor may send requests to on behalf of the
+// messages, e.g. to fetch their body or to dispatch them. An empty allowlist allows none.
+type OriginAllowlist map[string]bool
+
+// ParseOriginAllowlist parses a comma separated list of 'scheme://host[:port]' origins.
+func ParseOriginAllowlist(s string) (OriginAllowlist, error) {
+	allowlist := OriginAllowlist{}
+	for _, origin := range strings.Split(s, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid origin %q, expected 'scheme://host[:port]'", origin)
+		}
+		allowlist[originOf(u)] = true
+	}
+	return allowlist, nil
+}
+
+// allows returns true if the URL is absolute and its origin is in the allowlist.
+func (a OriginAllowlist) allows(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return a[originOf(u)]
+}
+
+func originOf(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
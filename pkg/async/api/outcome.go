@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// OutcomeResult is what became of a dispatched request.
+type OutcomeResult string
+
+const (
+	OutcomeSuccess OutcomeResult = "success"
+	OutcomeRetried OutcomeResult = "retried"
+	OutcomeFailed  OutcomeResult = "failed"
+)
+
+// Outcome describes the dispatch of a request to the inference gateway.
+type Outcome struct {
+	Request  RequestMessage
+	Endpoint string
+	// Latency is the duration of the dispatch, including the wait for a shared dispatch.
+	Latency time.Duration
+	// StatusCode is the HTTP status of the response, zero if there was none.
+	StatusCode int
+	Result     OutcomeResult
+}
+
+// OutcomeSink receives the outcome of every dispatched request, e.g. to export them to an observability backend.
+// RecordOutcome is called by the workers and should not block them for long.
+type OutcomeSink interface {
+	RecordOutcome(ctx context.Context, outcome Outcome)
+}
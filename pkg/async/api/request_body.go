@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// fetchBody downloads the body of a request sent by reference, of up to maxBytes bytes unless maxBytes is zero. Returns
+// true in 'retryable' if the failure may be transient.
+func fetchBody(ctx context.Context, httpClient *http.Client, url string, maxBytes int64) (body []byte, retryable bool, err error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid body URL: %w", err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, isRetryableStatus(response.StatusCode), fmt.Errorf("fetching the body returned status %d", response.StatusCode)
+	}
+	reader := io.Reader(response.Body)
+	if maxBytes > 0 {
+		reader = io.LimitReader(response.Body, maxBytes+1)
+	}
+	body, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, true, err
+	}
+	if maxBytes > 0 && int64(len(body)) > maxBytes {
+		return nil, false, fmt.Errorf("the body is larger than %d bytes", maxBytes)
+	}
+	return body, false, nil
+}
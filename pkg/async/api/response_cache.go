@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ResponseCache stores inference responses of deterministic requests, so identical requests can be answered without
+// dispatching them again.
+type ResponseCache interface {
+	// Get returns the cached payload for the key, if there is one.
+	Get(ctx context.Context, key string) (string, bool)
+	// Set stores the payload under the key for the ttl duration.
+	Set(ctx context.Context, key string, payload string, ttl time.Duration)
+}
+
+// IsDeterministic is the default cacheability predicate: only requests that explicitly ask for greedy sampling
+// (temperature 0) produce a response worth reusing.
+func IsDeterministic(msg RequestMessage) bool {
+	temperature, ok := msg.Payload["temperature"]
+	if !ok {
+		return false
+	}
+	switch t := temperature.(type) {
+	case float64:
+		return t == 0
+	case int:
+		return t == 0
+	default:
+		return false
+	}
+}
+
+type inMemoryEntry struct {
+	payload   string
+	expiresAt time.Time
+}
+
+// InMemoryResponseCache is a ResponseCache local to the process.
+type InMemoryResponseCache struct {
+	clock Clock
+
+	mu        sync.Mutex
+	entries   map[string]inMemoryEntry
+	lastSweep time.Time
+}
+
+// NewInMemoryResponseCache returns an empty cache whose entries expire according to clock, RealClock if nil.
+func NewInMemoryResponseCache(clock Clock) *InMemoryResponseCache {
+	if clock == nil {
+		clock = RealClock{}
+	}
+	return &InMemoryResponseCache{
+		clock:     clock,
+		entries:   make(map[string]inMemoryEntry),
+		lastSweep: clock.Now(),
+	}
+}
+
+func (c *InMemoryResponseCache) Get(_ context.Context, key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if c.clock.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.payload, true
+}
+
+func (c *InMemoryResponseCache) Set(_ context.Context, key string, payload string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	c.entries[key] = inMemoryEntry{payload: payload, expiresAt: now.Add(ttl)}
+
+	// Entries that are never read again would stay forever, so every ttl we drop all the expired ones.
+	if now.Sub(c.lastSweep) > ttl {
+		for k, e := range c.entries {
+			if now.After(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+}
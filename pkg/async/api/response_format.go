@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// responseFormat parses the response of a model server answering in its native format.
+type responseFormat func(body []byte) (nativeResponse, error)
+
+// responseFormats are the native formats responses can be converted from.
+var responseFormats = map[string]responseFormat{
+	"tgi":    parseTGIResponse,
+	"triton": parseTritonResponse,
+}
+
+// nativeResponse is what the OpenAI-compatible response is made of.
+type nativeResponse struct {
+	text             string
+	finishReason     string
+	promptTokens     int
+	completionTokens int
+}
+
+// ResponseAdapters maps inference gateways to the native format of the responses of their model servers. Their
+// responses are converted to the OpenAI completions schema, or chat completions schema for requests with messages,
+// so consumers get the same schema whatever engine served them.
+type ResponseAdapters map[string]responseFormat
+
+// ParseResponseAdapters parses a comma separated list of 'inference-gateway=format' pairs.
+func ParseResponseAdapters(s string) (ResponseAdapters, error) {
+	adapters := ResponseAdapters{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		// The gateway is a URL, which may hold '=' in its query.
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid response adapter %q, expected 'inference-gateway=format'", pair)
+		}
+		gateway, name := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		format, ok := responseFormats[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid response adapter %q, unknown format %q", pair, name)
+		}
+		adapters[gateway] = format
+	}
+	return adapters, nil
+}
+
+// adapt converts the response of the request to the OpenAI schema, if its inference gateway has an adapter.
+func (a ResponseAdapters) adapt(msg EmbelishedRequestMessage, body []byte, now time.Time) ([]byte, error) {
+	format, ok := a[msg.InferenceGateway]
+	if !ok {
+		return body, nil
+	}
+	native, err := format(body)
+	if err != nil {
+		return body, err
+	}
+	adapted, err := toOpenAIResponse(msg.RequestMessage, native, now)
+	if err != nil {
+		return body, err
+	}
+	return adapted, nil
+}
+
+type openAIResponse struct {
+	Id      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   openAIUsage    `json:"usage"`
+}
+
+type openAIChoice struct {
+	Index        int            `json:"index"`
+	Text         *string        `json:"text,omitempty"`
+	Message      *openAIMessage `json:"message,omitempty"`
+	FinishReason string         `json:"finish_reason"`
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func toOpenAIResponse(msg RequestMessage, native nativeResponse, now time.Time) ([]byte, error) {
+	model, _ := msg.Payload["model"].(string)
+	response := openAIResponse{
+		Created: now.Unix(),
+		Model:   model,
+		Usage: openAIUsage{
+			PromptTokens:     native.promptTokens,
+			CompletionTokens: native.completionTokens,
+			TotalTokens:      native.promptTokens + native.completionTokens,
+		},
+	}
+	choice := openAIChoice{FinishReason: native.finishReason}
+	if _, chat := msg.Payload["messages"]; chat {
+		response.Id = "chatcmpl-" + msg.Id
+		response.Object = "chat.completion"
+		choice.Message = &openAIMessage{Role: "assistant", Content: native.text}
+	} else {
+		response.Id = "cmpl-" + msg.Id
+		response.Object = "text_completion"
+		choice.Text = &native.text
+	}
+	response.Choices = []openAIChoice{choice}
+	return json.Marshal(response)
+}
+
+// parseTGIResponse parses the response of the generate endpoint of Text Generation Inference.
+func parseTGIResponse(body []byte) (nativeResponse, error) {
+	type tgiResponse struct {
+		GeneratedText *string `json:"generated_text"`
+		Details       *struct {
+			FinishReason    string `json:"finish_reason"`
+			GeneratedTokens int    `json:"generated_tokens"`
+			Prefill         []any  `json:"prefill"`
+		} `json:"details"`
+	}
+	var response tgiResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		// Some versions answer with a list of a single generation.
+		var responses []tgiResponse
+		if err := json.Unmarshal(body, &responses); err != nil || len(responses) != 1 {
+			return nativeResponse{}, fmt.Errorf("not a TGI response")
+		}
+		response = responses[0]
+	}
+	if response.GeneratedText == nil {
+		return nativeResponse{}, fmt.Errorf("TGI response is missing generated_text")
+	}
+	native := nativeResponse{text: *response.GeneratedText, finishReason: "stop"}
+	if response.Details != nil {
+		if response.Details.FinishReason == "length" {
+			native.finishReason = "length"
+		}
+		native.promptTokens = len(response.Details.Prefill)
+		native.completionTokens = response.Details.GeneratedTokens
+	}
+	return native, nil
+}
+
+// parseTritonResponse parses the response of the generate endpoint of Triton Inference Server.
+func parseTritonResponse(body []byte) (nativeResponse, error) {
+	var response struct {
+		TextOutput *string `json:"text_output"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nativeResponse{}, fmt.Errorf("not a Triton response")
+	}
+	if response.TextOutput == nil {
+		return nativeResponse{}, fmt.Errorf("triton response is missing text_output")
+	}
+	return nativeResponse{text: *response.TextOutput, finishReason: "stop"}, nil
+}
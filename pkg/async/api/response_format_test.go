@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseAdapters(t *testing.T) {
+	adapters, err := ParseResponseAdapters("http://tgi/generate=tgi, http://triton/generate?x=1=triton")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	completion := EmbelishedRequestMessage{
+		RequestMessage:   RequestMessage{Id: "1", Payload: map[string]any{"model": "m", "prompt": "hi"}},
+		InferenceGateway: "http://tgi/generate",
+	}
+	chat := EmbelishedRequestMessage{
+		RequestMessage:   RequestMessage{Id: "2", Payload: map[string]any{"model": "m", "messages": []any{}}},
+		InferenceGateway: "http://triton/generate?x=1",
+	}
+
+	tests := []struct {
+		name     string
+		msg      EmbelishedRequestMessage
+		body     string
+		expected string
+	}{
+		{
+			name: "tgi completion",
+			msg:  completion,
+			body: `{"generated_text":"hello","details":{"finish_reason":"length","generated_tokens":3,"prefill":[{},{}]}}`,
+			expected: `{"id":"cmpl-1","object":"text_completion","created":1000,"model":"m",` +
+				`"choices":[{"index":0,"text":"hello","finish_reason":"length"}],` +
+				`"usage":{"prompt_tokens":2,"completion_tokens":3,"total_tokens":5}}`,
+		},
+		{
+			name: "tgi list",
+			msg:  completion,
+			body: `[{"generated_text":"hello"}]`,
+			expected: `{"id":"cmpl-1","object":"text_completion","created":1000,"model":"m",` +
+				`"choices":[{"index":0,"text":"hello","finish_reason":"stop"}],` +
+				`"usage":{"prompt_tokens":0,"completion_tokens":0,"total_tokens":0}}`,
+		},
+		{
+			name: "triton chat",
+			msg:  chat,
+			body: `{"model_name":"ensemble","text_output":"hello"}`,
+			expected: `{"id":"chatcmpl-2","object":"chat.completion","created":1000,"model":"m",` +
+				`"choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],` +
+				`"usage":{"prompt_tokens":0,"completion_tokens":0,"total_tokens":0}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapted, err := adapters.adapt(tt.msg, []byte(tt.body), now)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(adapted) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, adapted)
+			}
+		})
+	}
+
+	// Responses in another format are left alone.
+	body := []byte(`{"error":"overloaded"}`)
+	if adapted, err := adapters.adapt(completion, body, now); err == nil || string(adapted) != string(body) {
+		t.Errorf("Expected an error and the response unchanged, got %v and %s", err, adapted)
+	}
+	completion.InferenceGateway = "http://vllm/v1/completions"
+	if adapted, err := adapters.adapt(completion, body, now); err != nil || string(adapted) != string(body) {
+		t.Errorf("Expected the response of a gateway without adapter unchanged, got %v and %s", err, adapted)
+	}
+
+	if _, err := ParseResponseAdapters("http://tgi/generate=unknown"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+	if _, err := ParseResponseAdapters("tgi"); err == nil {
+		t.Errorf("Expected an error for an adapter without a gateway")
+	}
+}
+
+func TestResponseAdaptersInWorker(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader(`{"generated_text":"hello"}`)),
+		}, nil
+	})
+	resultChannel := make(chan ResultMessage, 1)
+	adapters, _ := ParseResponseAdapters("http://tgi/generate=tgi")
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+			Payload:         map[string]any{"model": "m", "prompt": "hi"},
+		},
+		InferenceGateway: "http://tgi/generate",
+		HttpHeaders:      map[string]string{},
+	}
+	processRequest(context.Background(), httpclient, msg, nil, resultChannel, WorkerOptions{ResponseAdapters: adapters})
+
+	var response map[string]any
+	if err := json.Unmarshal([]byte((<-resultChannel).Payload), &response); err != nil {
+		t.Fatalf("Expected a JSON result, got %v", err)
+	}
+	if response["object"] != "text_completion" {
+		t.Errorf("Expected an OpenAI completion, got %v", response)
+	}
+}
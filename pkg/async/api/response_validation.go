@@ -0,0 +1,35 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseRequiredFields parses a comma separated list of field paths.
+func ParseRequiredFields(s string) ([]FieldPath, error) {
+	var fields []FieldPath
+	for _, field := range strings.Split(s, ",") {
+		path, err := ParseFieldPath(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, path)
+	}
+	return fields, nil
+}
+
+// validateResponse checks that the body of a successful response is a JSON object holding all the required fields.
+// Some model servers answer 200 with the error in the body instead of the expected response.
+func validateResponse(body []byte, required []FieldPath) error {
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	for _, field := range required {
+		if _, ok := field.find(document); !ok {
+			return fmt.Errorf("response is missing %s", field)
+		}
+	}
+	return nil
+}
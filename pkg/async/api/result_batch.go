@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// PendingResults counts the results a flow took from its result channels and hasn't published yet, for
+// PendingResultsFlow.
+type PendingResults struct {
+	count atomic.Int64
+}
+
+// Add adds delta results, negative once they are published or given up on.
+func (p *PendingResults) Add(delta int) {
+	p.count.Add(int64(delta))
+}
+
+func (p *PendingResults) Count() int {
+	return int(p.count.Load())
+}
+
+// CollectResultBatch completes the batch started by 'first' with the results arriving on the channel, until it holds
+// 'size' results or 'window' has passed. Returns early, with what it has, if the context is done. The results of the
+// batch, 'first' included, are added to pending: the caller removes them once the batch is published.
+func CollectResultBatch(ctx context.Context, first ResultMessage, resultChannel chan ResultMessage, size int,
+	window time.Duration, pending *PendingResults) []ResultMessage {
+	pending.Add(1)
+	batch := []ResultMessage{first}
+	if size <= 1 {
+		return batch
+	}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(batch) < size {
+		select {
+		case msg := <-resultChannel:
+			pending.Add(1)
+			batch = append(batch, msg)
+		case <-timer.C:
+			return batch
+		case <-ctx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+// MarshalResult returns the JSON a result is published as, or an error result with its id if it can't be marshaled.
+func MarshalResult(msg ResultMessage) []byte {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return []byte(fmt.Sprintf(`{"id" : "%s", "error": "%s"}`, msg.Id, "Failed to marshal result to string"))
+	}
+	return bytes
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCollectResultBatch(t *testing.T) {
+	resultChannel := make(chan ResultMessage, 10)
+	for _, id := range []string{"b", "c", "d"} {
+		resultChannel <- ResultMessage{Id: id}
+	}
+
+	// The batch is flushed once full, the next result waits for the next batch.
+	var pending PendingResults
+	batch := CollectResultBatch(context.Background(), ResultMessage{Id: "a"}, resultChannel, 3, time.Hour, &pending)
+	if len(batch) != 3 || batch[0].Id != "a" || batch[2].Id != "c" {
+		t.Fatalf("Expected the batch a, b, c, got %+v", batch)
+	}
+	if pending.Count() != 3 {
+		t.Errorf("Expected the results of the batch to be pending, got %d", pending.Count())
+	}
+	pending.Add(-len(batch))
+
+	// Or once the window is over, with the results that arrived by then.
+	start := time.Now()
+	batch = CollectResultBatch(context.Background(), <-resultChannel, resultChannel, 3, 20*time.Millisecond, &pending)
+	if len(batch) != 1 || batch[0].Id != "d" {
+		t.Fatalf("Expected the batch d, got %+v", batch)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected the batch to wait for its window, flushed after %v", elapsed)
+	}
+
+	// A batch of one isn't waited for.
+	if batch := CollectResultBatch(context.Background(), ResultMessage{Id: "e"}, resultChannel, 1, time.Hour, &pending); len(batch) != 1 {
+		t.Errorf("Expected a batch of one result, got %+v", batch)
+	}
+}
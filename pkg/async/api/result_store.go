@@ -0,0 +1,8 @@
+package api
+
+// ResultStore keeps the responses too large to be published as results. The result published instead references the
+// stored response (see ResultMessage.PayloadRef).
+type ResultStore interface {
+	// Store stores the response to the request with the given id and returns its reference.
+	Store(id string, payload []byte) (string, error)
+}
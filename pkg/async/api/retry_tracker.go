@@ -0,0 +1,56 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryTracker bounds the number of requests in the retry pipeline across all the workers. A request enters the
+// pipeline when it is sent for retry and leaves it when it is dequeued again, or once its deadline is over, since a
+// request past its deadline is only failed when it comes back.
+type RetryTracker struct {
+	max int
+
+	mu       sync.Mutex
+	inFlight map[string]time.Time
+}
+
+func NewRetryTracker(max int) *RetryTracker {
+	return &RetryTracker{
+		max:      max,
+		inFlight: make(map[string]time.Time),
+	}
+}
+
+// tryAdd puts the request in the pipeline, returns false if the pipeline is full. Requests past their deadline at 'now'
+// make room for it.
+func (t *RetryTracker) tryAdd(id string, deadline, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.inFlight[id]; !ok && len(t.inFlight) >= t.max {
+		for inFlightId, inFlightDeadline := range t.inFlight {
+			if inFlightDeadline.Before(now) {
+				delete(t.inFlight, inFlightId)
+			}
+		}
+		if len(t.inFlight) >= t.max {
+			return false
+		}
+	}
+	t.inFlight[id] = deadline
+	return true
+}
+
+// remove takes the request out of the pipeline, if it was in.
+func (t *RetryTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inFlight, id)
+}
+
+// Len returns the number of requests in the pipeline.
+func (t *RetryTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inFlight)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ServedByHeaders maps the fields of the ServedBy of the results to the response headers of the inference gateway they
+// are read from, e.g. "endpoint" to "x-gateway-destination-endpoint", so that consumers know what served each request.
+type ServedByHeaders map[string]string
+
+// ParseServedByHeaders parses a comma separated list of 'field=header' pairs.
+func ParseServedByHeaders(s string) (ServedByHeaders, error) {
+	headers := ServedByHeaders{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		field, header, ok := strings.Cut(pair, "=")
+		field, header = strings.TrimSpace(field), strings.TrimSpace(header)
+		if !ok || field == "" || header == "" {
+			return nil, fmt.Errorf("invalid served-by field %q, expected 'field=header'", pair)
+		}
+		headers[field] = header
+	}
+	return headers, nil
+}
+
+// servedBy reads the fields from the response headers. A header missing from the response leaves its field out.
+func (h ServedByHeaders) servedBy(header http.Header) map[string]string {
+	var servedBy map[string]string
+	for field, name := range h {
+		if value := header.Get(name); value != "" {
+			if servedBy == nil {
+				servedBy = map[string]string{}
+			}
+			servedBy[field] = value
+		}
+	}
+	return servedBy
+}
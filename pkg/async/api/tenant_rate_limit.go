@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// TenantRateLimiter bounds the rate at which the requests of each tenant (see TenantMetadataKey) are dispatched, with
+// a token bucket per tenant. Requests without a tenant share a bucket.
+type TenantRateLimiter struct {
+	defaultLimit rate.Limit
+	limits       map[string]rate.Limit
+	burst        int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewTenantRateLimiter creates a limiter allowing 'defaultLimit' requests per second to the tenants not in 'limits'.
+// A limit of zero or less means unlimited.
+func NewTenantRateLimiter(defaultLimit float64, limits map[string]float64, burst int) *TenantRateLimiter {
+	l := &TenantRateLimiter{
+		defaultLimit: toLimit(defaultLimit),
+		limits:       make(map[string]rate.Limit, len(limits)),
+		burst:        max(burst, 1),
+		limiters:     make(map[string]*rate.Limiter),
+	}
+	for tenant, limit := range limits {
+		l.limits[tenant] = toLimit(limit)
+	}
+	return l
+}
+
+func toLimit(requestsPerSecond float64) rate.Limit {
+	if requestsPerSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(requestsPerSecond)
+}
+
+// Reserve takes a token of the tenant at now. Returns zero if the request can be dispatched right away, or how long
+// until the tenant is allowed to dispatch it, in which case no token is taken.
+func (l *TenantRateLimiter) Reserve(tenant string, now time.Time) time.Duration {
+	reservation := l.limiter(tenant).ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+func (l *TenantRateLimiter) limiter(tenant string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[tenant]
+	if !ok {
+		limit, ok := l.limits[tenant]
+		if !ok {
+			limit = l.defaultLimit
+		}
+		limiter = rate.NewLimiter(limit, l.burst)
+		l.limiters[tenant] = limiter
+	}
+	return limiter
+}
+
+// ParseTenantRateLimits parses a comma separated list of 'tenant=requests-per-second' pairs.
+func ParseTenantRateLimits(s string) (map[string]float64, error) {
+	limits := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		tenant, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tenant rate limit %q, expected 'tenant=requests-per-second'", pair)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tenant rate limit %q: %w", pair, err)
+		}
+		limits[strings.TrimSpace(tenant)] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTenantRateLimiter(t *testing.T) {
+	limits, err := ParseTenantRateLimits("slow=1, fast=0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limiter := NewTenantRateLimiter(100, limits, 1)
+	now := time.Unix(1000, 0)
+
+	// The burst is spent by the first request, the second one has to wait for a token.
+	if delay := limiter.Reserve("slow", now); delay != 0 {
+		t.Fatalf("Expected the first request to go through, got a delay of %v", delay)
+	}
+	if delay := limiter.Reserve("slow", now); delay != time.Second {
+		t.Errorf("Expected the second request of a tenant limited to 1/s to wait 1s, got %v", delay)
+	}
+	// A delayed request doesn't take a token: it gets its turn once the delay is over.
+	if delay := limiter.Reserve("slow", now.Add(time.Second)); delay != 0 {
+		t.Errorf("Expected the request to go through once the delay is over, got %v", delay)
+	}
+
+	// Other tenants are not affected.
+	for range 10 {
+		if delay := limiter.Reserve("fast", now); delay != 0 {
+			t.Fatalf("Expected an unlimited tenant not to wait, got %v", delay)
+		}
+	}
+	limiter.Reserve("default", now)
+	if delay := limiter.Reserve("default", now); delay != 10*time.Millisecond {
+		t.Errorf("Expected the default limit to delay the requests by 10ms, got %v", delay)
+	}
+
+	if _, err := ParseTenantRateLimits("slow"); err == nil {
+		t.Errorf("Expected an error for a limit without a rate")
+	}
+}
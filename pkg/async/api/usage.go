@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+)
+
+// TenantMetadataKey is the request metadata entry identifying the tenant a request is attributed to.
+const TenantMetadataKey = "tenant"
+
+// usageResponse is the part of an OpenAI-compatible response reporting the consumed tokens.
+type usageResponse struct {
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// recordTokenUsage attributes the tokens reported by the model server to the request's tenant and model, as labeled by
+// labels. Responses without a usage section are ignored.
+func recordTokenUsage(msg RequestMessage, responseBody []byte, labels MetricLabels) {
+	var response usageResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil || response.Usage == nil {
+		return
+	}
+	tenant, model := labels.tenant(msg), labels.model(msg)
+	metrics.Tokens.WithLabelValues(tenant, model, "prompt").Add(float64(response.Usage.PromptTokens))
+	metrics.Tokens.WithLabelValues(tenant, model, "completion").Add(float64(response.Usage.CompletionTokens))
+}
+
+// recordSLO counts the requests whose result comes later than their SLO, measured from the first dequeue, by model and
+// tenant as labeled by labels.
+func recordSLO(msg RequestMessage, now time.Time, labels MetricLabels) {
+	if msg.SLOMs <= 0 || msg.FirstDequeueMs == 0 {
+		return
+	}
+	if now.Sub(time.UnixMilli(msg.FirstDequeueMs)) > time.Duration(msg.SLOMs)*time.Millisecond {
+		metrics.SLOBreaches.WithLabelValues(labels.model(msg), labels.tenant(msg)).Inc()
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(counter prometheus.Counter) float64 {
+	var m dto.Metric
+	counter.Write(&m) // nolint:errcheck
+	return m.GetCounter().GetValue()
+}
+
+func gaugeValue(gauge prometheus.Gauge) float64 {
+	var m dto.Metric
+	gauge.Write(&m) // nolint:errcheck
+	return m.GetGauge().GetValue()
+}
+
+func histogramSamples(histogram prometheus.Histogram) (uint64, float64) {
+	var m dto.Metric
+	histogram.Write(&m) // nolint:errcheck
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestRecordSLO(t *testing.T) {
+	breaches := metrics.SLOBreaches.WithLabelValues("food-review", "team-a")
+	before := counterValue(breaches)
+	otherBreaches := metrics.SLOBreaches.WithLabelValues("food-review", OtherLabelValue)
+	otherBefore := counterValue(otherBreaches)
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	opts := WorkerOptions{Clock: clock, MetricLabels: NewMetricLabels(
+		ParseLabelValues("food-review"), ParseLabelValues("team-a, team-b"), 0,
+	)}
+	msg := RequestMessage{
+		Id:       "123",
+		Payload:  map[string]any{"model": "food-review"},
+		Metadata: map[string]string{TenantMetadataKey: "team-a"},
+		SLOMs:    1000,
+	}
+	msg.FirstDequeueMs = clock.Now().UnixMilli()
+	clock.Advance(500 * time.Millisecond)
+	opts.result(msg, "{}")
+	if got := counterValue(breaches) - before; got != 0 {
+		t.Errorf("Expected no breach for a result within the SLO, got %v", got)
+	}
+
+	clock.Advance(time.Second)
+	opts.errorResult(msg, "failed")
+	if got := counterValue(breaches) - before; got != 1 {
+		t.Errorf("Expected a breach for a result after the SLO, got %v", got)
+	}
+
+	// The tenant comes from the request, without room for other values it is only a label value if it is listed.
+	msg.Metadata = map[string]string{TenantMetadataKey: "team-c"}
+	opts.result(msg, "{}")
+	if got := counterValue(otherBreaches) - otherBefore; got != 1 {
+		t.Errorf("Expected the breach of an unlisted tenant to be labeled %s, got %v", OtherLabelValue, got)
+	}
+}
+
+func TestRecordTokenUsage(t *testing.T) {
+	labels := NewMetricLabels(ParseLabelValues("food-review"), ParseLabelValues("team-a"), 0)
+	prompt := metrics.Tokens.WithLabelValues("team-a", "food-review", "prompt")
+	completion := metrics.Tokens.WithLabelValues("team-a", OtherLabelValue, "completion")
+	promptBefore, completionBefore := counterValue(prompt), counterValue(completion)
+
+	response := []byte(`{"usage": {"prompt_tokens": 12, "completion_tokens": 30}}`)
+	recordTokenUsage(RequestMessage{
+		Payload:  map[string]any{"model": "food-review"},
+		Metadata: map[string]string{TenantMetadataKey: "team-a"},
+	}, response, labels)
+	recordTokenUsage(RequestMessage{
+		Payload:  map[string]any{"model": "any-model-the-client-likes"},
+		Metadata: map[string]string{TenantMetadataKey: "team-a"},
+	}, response, labels)
+	if got := counterValue(prompt) - promptBefore; got != 12 {
+		t.Errorf("Expected 12 prompt tokens for the listed model, got %v", got)
+	}
+	if got := counterValue(completion) - completionBefore; got != 30 {
+		t.Errorf("Expected 30 completion tokens for the unlisted model, labeled %s, got %v", OtherLabelValue, got)
+	}
+}
+
+func TestMetricLabels_passValuesUpToCap(t *testing.T) {
+	labels := NewMetricLabels(ParseLabelValues("listed"), map[string]bool{}, 2)
+	model := func(model string) string {
+		return labels.model(RequestMessage{Payload: map[string]any{"model": model}})
+	}
+	for _, m := range []string{"a", "b", "a", "listed"} {
+		if got := model(m); got != m {
+			t.Errorf("Expected model %s to be a label value below the cap, got %s", m, got)
+		}
+	}
+	if got := model("c"); got != OtherLabelValue {
+		t.Errorf("Expected a model past the cap to be labeled %s, got %s", OtherLabelValue, got)
+	}
+	if got := model("b"); got != "b" {
+		t.Errorf("Expected a model seen below the cap to stay a label value, got %s", got)
+	}
+	if got := (MetricLabels{}).model(RequestMessage{Payload: map[string]any{"model": "a"}}); got != OtherLabelValue {
+		t.Errorf("Expected the zero MetricLabels to label every model %s, got %s", OtherLabelValue, got)
+	}
+}
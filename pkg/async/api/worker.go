@@ -2,13 +2,19 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math"
 	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"time"
 
@@ -17,139 +23,861 @@ import (
 	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
 )
 
-var baseDelaySeconds = 2
+// defaultRetryBackoffBase is the delay of the first retry when WorkerOptions.RetryBackoffBase is not set.
+const defaultRetryBackoffBase = 2 * time.Second
+
+// WorkerOptions holds the optional behaviours of a Worker. The zero value keeps all of them disabled.
+type WorkerOptions struct {
+	// Coalescer, when set, shares a single dispatch between identical requests.
+	Coalescer *Coalescer
+	// InFlight, when set, is a semaphore shared by all the workers. Its capacity bounds the number of requests being
+	// processed at once, regardless of the number of workers.
+	InFlight chan struct{}
+	// ResponseCache, when set, answers cacheable requests with a previous response of an identical request.
+	ResponseCache    ResponseCache
+	ResponseCacheTTL time.Duration
+	// Cacheable decides which requests may be answered from the ResponseCache. Defaults to IsDeterministic.
+	Cacheable func(RequestMessage) bool
+	// ErrorResultChannel, when set, receives the error results instead of the result channel.
+	ErrorResultChannel chan ResultMessage
+	// DeadLetterChannel, when set, receives the results of the requests that exhausted their retries instead of the
+	// error result channel.
+	DeadLetterChannel chan ResultMessage
+	// TotalBudget, when set, bounds the time spent on a request across all its attempts, starting from its first
+	// dequeue. The remaining budget is the deadline of each dispatch, and once it is exhausted the request is failed
+	// instead of being dispatched again.
+	TotalBudget time.Duration
+	// Stop, when closed, makes the worker return once it is done with the request it is processing. Unlike cancelling
+	// the context, it doesn't abort the in-flight dispatch.
+	Stop <-chan struct{}
+	// LatencyBreakdown enables tracing the phases (DNS, connect, TLS, time to first byte) of every dispatch.
+	LatencyBreakdown bool
+	// Mirror, when set, gets a copy of every successful request and its response.
+	Mirror Mirror
+	// ModelRewrites maps the model of the requests to the model id dispatched to the inference gateway.
+	ModelRewrites ModelRewrites
+	// RetryOnlyIdempotent fails, instead of retrying, the requests not marked idempotent whose dispatch may have been
+	// executed by the model server (server-side errors and responses that couldn't be read). Shedded requests are
+	// always retried.
+	RetryOnlyIdempotent bool
+	// TenantRateLimiter, when set, delays the dispatch of the requests of tenants exceeding their rate. The worker holds
+	// the request until the tenant's turn, without counting it as a retry.
+	TenantRateLimiter *TenantRateLimiter
+	// DrainMode dead-letters every request without dispatching it, to clear a poisoned backlog.
+	DrainMode bool
+	// JitterSource is the source of the retry backoff jitter, e.g. seeded for reproducible backoffs (see
+	// NewJitterSource). It must be safe for concurrent use if shared by workers. Defaults to the global random source.
+	JitterSource rand.Source
+	// BodyURLOrigins are the origins the bodies sent by reference may be fetched from. Requests with a body URL
+	// elsewhere are failed.
+	BodyURLOrigins OriginAllowlist
+	// MaxBodyURLBytes, when set, is the size of the largest body sent by reference. Larger ones are failed.
+	MaxBodyURLBytes int64
+	// EndpointPath, when set, locates the field of the requests holding the inference gateway to dispatch them to. Requests
+	// without it are dispatched to the gateway of their request channel.
+	EndpointPath FieldPath
+	// EndpointOrigins are the origins the requests may be dispatched to through their EndpointPath field. Requests
+	// whose field is elsewhere are failed.
+	EndpointOrigins OriginAllowlist
+	// ObjectivePath, when set, locates the field of the requests holding their inference objective. Requests without it
+	// keep the objective of their request channel.
+	ObjectivePath FieldPath
+	// OutcomeSink, when set, gets the outcome of every dispatched request.
+	OutcomeSink OutcomeSink
+	// SlowRequestThreshold, when set, logs the details of the dispatches lasting longer than it: endpoint, sizes and the
+	// duration of each phase of the dispatch.
+	SlowRequestThreshold time.Duration
+	// CompressionMinBytes, when set, gzips the request bodies of at least this many bytes. Smaller bodies are sent as is,
+	// as compressing them costs more than it saves.
+	CompressionMinBytes int
+	// AuditSink, when set, is given a record of every request once it is dispatched, with the endpoint it was routed to
+	// from the RoutedEndpointHeader of the response (x-gateway-destination-endpoint by default). When AuditFailClosed
+	// is set, a request that can't be audited is failed instead of having its response published.
+	AuditSink            AuditSink
+	AuditFailClosed      bool
+	RoutedEndpointHeader string
+	// ServedByHeaders, when set, stamps the results of the responses with the values of these response headers, e.g.
+	// the endpoint the inference gateway routed the request to.
+	ServedByHeaders ServedByHeaders
+	// MaxResultBytes, when set, is the largest result published, once marshaled, e.g. the message size limit of the
+	// broker. Responses making larger results are put in the ResultStore and referenced by the result, or dead-lettered if there is none.
+	MaxResultBytes int
+	ResultStore    ResultStore
+	// RequiredResponseFields, when set, are the fields a successful response must hold. A response missing any of them
+	// is handled like a server-side error.
+	RequiredResponseFields []FieldPath
+	// RetryTracker, when set, bounds the number of requests in the retry pipeline. Once it is full, failed requests are
+	// dead-lettered instead of being retried.
+	RetryTracker *RetryTracker
+	// FailEmptyResponses handles the successful responses with an empty body like server-side errors, instead of
+	// publishing empty results.
+	FailEmptyResponses bool
+	// ResponseAdapters, when set, converts the responses of the inference gateways answering in a native format to the
+	// OpenAI schema.
+	ResponseAdapters ResponseAdapters
+	// ModelConcurrency, when set, bounds the number of requests dispatched at once for each model. The worker waits with
+	// the request for a slot of its model.
+	ModelConcurrency *ModelConcurrencyLimiter
+	// Clock tells the time to the deadlines, the total budget, the retry backoff, the dispatch latency, the SLO, the audit
+	// records and the coalescing window. Defaults to RealClock.
+	Clock Clock
+	// MetricLabels bounds the models and tenants the SLO and token metrics are labeled with, the others being counted as
+	// OtherLabelValue.
+	MetricLabels MetricLabels
+	// RetryBackoffBase and RetryBackoffMax shape the exponential backoff of the retries: the n-th retry waits
+	// RetryBackoffBase * 2^n, give or take a quarter of RetryBackoffBase of jitter, up to RetryBackoffMax and the deadline
+	// of the request. RetryBackoffBase defaults to 2s, RetryBackoffMax to no cap but the deadline.
+	RetryBackoffBase time.Duration
+	RetryBackoffMax  time.Duration
+	// MaxRetries, when set, is how many times a request is retried. A request failing once more is dead-lettered.
+	MaxRetries int
+	// RequestTimeout, when set, bounds each dispatch to the inference gateway. A dispatch timing out is retried.
+	RequestTimeout time.Duration
+	// DrainTimeout, when set, lets the worker finish the request it is processing once the context is cancelled, for up
+	// to this long, before abandoning it to the message queue. Results must still be consumed meanwhile.
+	DrainTimeout time.Duration
+}
+
+func (o WorkerOptions) errorChannel(resultChannel chan ResultMessage) chan ResultMessage {
+	if o.ErrorResultChannel == nil {
+		return resultChannel
+	}
+	return o.ErrorResultChannel
+}
+
+func (o WorkerOptions) deadLetterChannel(resultChannel chan ResultMessage) chan ResultMessage {
+	if o.DeadLetterChannel == nil {
+		return resultChannel
+	}
+	return o.DeadLetterChannel
+}
+
+func (o WorkerOptions) cacheable(msg RequestMessage) bool {
+	if o.Cacheable == nil {
+		return IsDeterministic(msg)
+	}
+	return o.Cacheable(msg)
+}
+
+func (o WorkerOptions) jitter() float64 {
+	if o.JitterSource == nil {
+		return rand.Float64() - 0.5
+	}
+	return rand.New(o.JitterSource).Float64() - 0.5
+}
+
+// retryBackoff returns how many seconds to wait before the given retry of a request.
+func (o WorkerOptions) retryBackoff(retryCount int, secondsToDeadline int64) float64 {
+	base := o.RetryBackoffBase
+	if base <= 0 {
+		base = defaultRetryBackoffBase
+	}
+	return expBackoffDuration(retryCount, float64(secondsToDeadline), base.Seconds(), o.RetryBackoffMax.Seconds(), o.jitter())
+}
+
+func (o WorkerOptions) routedEndpointHeader() string {
+	if o.RoutedEndpointHeader == "" {
+		return defaultRoutedEndpointHeader
+	}
+	return o.RoutedEndpointHeader
+}
+
+func (o WorkerOptions) clock() Clock {
+	if o.Clock == nil {
+		return RealClock{}
+	}
+	return o.Clock
+}
+
+func (o WorkerOptions) now() time.Time {
+	return o.clock().Now()
+}
+
+// result creates the result of the request. Every result of the workers is created through the methods below, which is
+// where the request's SLO is checked.
+func (o WorkerOptions) result(msg RequestMessage, payload string) ResultMessage {
+	recordSLO(msg, o.now(), o.MetricLabels)
+	return NewResultMessage(msg, payload)
+}
+
+func (o WorkerOptions) errorResult(msg RequestMessage, errMsg string) ResultMessage {
+	recordSLO(msg, o.now(), o.MetricLabels)
+	return CreateErrorResultMessage(msg, errMsg)
+}
+
+func (o WorkerOptions) deadLetterResult(msg RequestMessage, attempts int, lastError string) ResultMessage {
+	recordSLO(msg, o.now(), o.MetricLabels)
+	return CreateDeadLetterResultMessage(msg, attempts, lastError)
+}
+
+func (o WorkerOptions) deadlineExceededResult(msg RequestMessage) ResultMessage {
+	recordSLO(msg, o.now(), o.MetricLabels)
+	return CreateDeadlineExceededResultMessage(msg)
+}
+
+// drainContext returns a context cancelled only once the drain timeout has passed since ctx was cancelled.
+func (o WorkerOptions) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.DrainTimeout <= 0 {
+		return ctx, func() {}
+	}
+	drainCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		timer := time.NewTimer(o.DrainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-drainCtx.Done():
+		}
+	})
+	return drainCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func (o WorkerOptions) releaseInFlight() {
+	if o.InFlight != nil {
+		<-o.InFlight
+	}
+}
+
+// dispatchOutcome is what came back from sending a request to the inference gateway.
+type dispatchOutcome struct {
+	statusCode int
+	body       []byte
+	// failure is set when the request could not be sent at all.
+	failure string
+	// readErr is set when the response body could not be read.
+	readErr error
+	// invalid is set when the response doesn't have the expected shape.
+	invalid error
+	// cancelled is set when the dispatch was cut short by its context, e.g. on shutdown or once the budget is over.
+	cancelled bool
+	// timedOut is set when the dispatch was cut short by the request timeout. The request may have been executed.
+	timedOut bool
+	// timings is set when the latency breakdown is enabled.
+	timings *dispatchTimings
+	// routedEndpoint is the endpoint the inference gateway routed the request to, if its response tells.
+	routedEndpoint string
+	// servedBy is what the response headers tell of what served the request, for its result.
+	servedBy map[string]string
+}
+
+func (o dispatchOutcome) succeeded() bool {
+	return o.failure == "" && !o.timedOut && o.readErr == nil && o.invalid == nil && o.statusCode >= 200 && o.statusCode < 300
+}
 
 func Worker(ctx context.Context, characteristics Characteristics, httpClient *http.Client, requestChannel chan EmbelishedRequestMessage,
-	retryChannel chan RetryMessage, resultChannel chan ResultMessage) {
+	retryChannel chan RetryMessage, resultChannel chan ResultMessage, opts WorkerOptions) {
 
 	logger := log.FromContext(ctx)
+	metrics.IdleWorkers.Inc()
+	defer metrics.IdleWorkers.Dec()
 	for {
+		if ctx.Err() != nil {
+			// Not taking new requests once told to finish, even if some are waiting.
+			logger.V(logutil.DEFAULT).Info("Worker finishing.")
+			return
+		}
+		// Taking an in-flight slot before dequeuing, so that when all slots are taken nobody reads from the request
+		// channel and the backpressure reaches the message queue.
+		if opts.InFlight != nil {
+			select {
+			case <-ctx.Done():
+				logger.V(logutil.DEFAULT).Info("Worker finishing.")
+				return
+			case <-opts.Stop:
+				logger.V(logutil.VERBOSE).Info("Worker stopped.")
+				return
+			case opts.InFlight <- struct{}{}:
+			}
+		}
 		select {
 		case <-ctx.Done():
+			opts.releaseInFlight()
 			logger.V(logutil.DEFAULT).Info("Worker finishing.")
 			return
-		case msg := <-requestChannel:
-			if msg.RetryCount == 0 {
-				// Only count first attempt as a new request.
-				metrics.AsyncReqs.Inc()
+		case <-opts.Stop:
+			opts.releaseInFlight()
+			logger.V(logutil.VERBOSE).Info("Worker stopped.")
+			return
+		case msg, ok := <-requestChannel:
+			if !ok {
+				// The requests are partitioned or bound to channels that closed, nothing comes anymore.
+				opts.releaseInFlight()
+				logger.V(logutil.DEFAULT).Info("Request channel closed, worker finishing.")
+				return
 			}
-			payloadBytes := validateAndMarshall(resultChannel, msg.RequestMessage)
-			if payloadBytes == nil {
-				continue
+			workOn(ctx, httpClient, msg, retryChannel, resultChannel, opts)
+		}
+	}
+}
+
+// workOn processes a request, giving the in-flight slot and the worker gauges back even if processing panics.
+func workOn(ctx context.Context, httpClient *http.Client, msg EmbelishedRequestMessage,
+	retryChannel chan RetryMessage, resultChannel chan ResultMessage, opts WorkerOptions) {
+	metrics.IdleWorkers.Dec()
+	metrics.ActiveWorkers.Inc()
+	defer func() {
+		metrics.ActiveWorkers.Dec()
+		metrics.IdleWorkers.Inc()
+		opts.releaseInFlight()
+	}()
+	processRequest(ctx, httpClient, msg, retryChannel, resultChannel, opts)
+}
+
+func processRequest(ctx context.Context, httpClient *http.Client, msg EmbelishedRequestMessage,
+	retryChannel chan RetryMessage, resultChannel chan ResultMessage, opts WorkerOptions) {
+	// The request in hand is finished even if the worker is told to finish meanwhile, as long as the drain allows.
+	ctx, cancel := opts.drainContext(ctx)
+	defer cancel()
+	if msg.RetryCount == 0 {
+		// Only count first attempt as a new request.
+		metrics.AsyncReqs.Inc()
+	}
+	if msg.RetriedAtMs > 0 {
+		metrics.RetryQueueDuration.Observe(opts.now().Sub(time.UnixMilli(msg.RetriedAtMs)).Seconds())
+	}
+	if opts.RetryTracker != nil {
+		// Requests redelivered by the message queue don't always carry their retry count, so any dequeue ends a retry.
+		opts.RetryTracker.remove(msg.Id)
+	}
+	errorChannel := opts.errorChannel(resultChannel)
+	if opts.DrainMode {
+		metrics.DrainedReqs.Inc()
+		errorChannel <- opts.errorResult(msg.RequestMessage, "drained without dispatch")
+		return
+	}
+	if msg.FirstDequeueMs == 0 {
+		msg.FirstDequeueMs = opts.now().UnixMilli()
+	}
+	dispatchCtx := ctx
+	if opts.TotalBudget > 0 {
+		remaining := opts.TotalBudget - opts.now().Sub(time.UnixMilli(msg.FirstDequeueMs))
+		if remaining <= 0 {
+			metrics.BudgetExhaustedReqs.Inc()
+			errorChannel <- opts.errorResult(msg.RequestMessage, "request budget exhausted")
+			return
+		}
+		var cancel context.CancelFunc
+		dispatchCtx, cancel = context.WithTimeout(ctx, remaining)
+		defer cancel()
+	}
+	if endpoint, ok := opts.EndpointPath.lookup(msg.RequestMessage); ok {
+		if !opts.EndpointOrigins.allows(endpoint) {
+			metrics.FailedReqs.Inc()
+			errorChannel <- opts.errorResult(msg.RequestMessage, "endpoint not allowed")
+			return
+		}
+		msg.InferenceGateway = endpoint
+	}
+	if objective, ok := opts.ObjectivePath.lookup(msg.RequestMessage); ok {
+		msg.HttpHeaders = maps.Clone(msg.HttpHeaders)
+		if msg.HttpHeaders == nil {
+			msg.HttpHeaders = map[string]string{}
+		}
+		msg.HttpHeaders["x-gateway-inference-objective"] = objective
+	}
+	payloadBytes := validateAndMarshall(errorChannel, opts.ModelRewrites.rewriteRequest(msg.RequestMessage), opts)
+	if payloadBytes == nil {
+		return
+	}
+	if msg.BodyURL != "" {
+		if !opts.BodyURLOrigins.allows(msg.BodyURL) {
+			metrics.FailedReqs.Inc()
+			errorChannel <- opts.errorResult(msg.RequestMessage, "body URL not allowed")
+			return
+		}
+		body, retryable, err := fetchBody(dispatchCtx, httpClient, msg.BodyURL, opts.MaxBodyURLBytes)
+		if err != nil {
+			if retryable {
+				retryMessage(msg, retryReasonBodyFetch, fmt.Sprintf("Failed to fetch request body: %s", err.Error()), retryChannel, errorChannel, opts)
+			} else {
+				metrics.FailedReqs.Inc()
+				errorChannel <- opts.errorResult(msg.RequestMessage, fmt.Sprintf("Failed to fetch request body: %s", err.Error()))
 			}
+			return
+		}
+		payloadBytes = body
+	}
+
+	var cacheKey string
+	if opts.ResponseCache != nil && opts.cacheable(msg.RequestMessage) {
+		cacheKey = requestKey(msg, payloadBytes)
+		if payload, ok := opts.ResponseCache.Get(ctx, cacheKey); ok {
+			metrics.ResponseCacheHits.Inc()
+			deliverResult(msg.RequestMessage, opts.ModelRewrites.restoreResponse(msg.RequestMessage, []byte(payload)), nil,
+				resultChannel, opts)
+			return
+		}
+	}
+
+	if opts.TenantRateLimiter != nil && !waitForTenant(ctx, msg.RequestMessage, errorChannel, opts) {
+		return
+	}
 
-			// Using a function object for easy boundries for 'return' and 'defer'!
-			sendInferenceRequest := func() {
-				logger.V(logutil.DEBUG).Info("Sending inference request.")
-				request, err := http.NewRequestWithContext(ctx, "POST", msg.InferenceGateway, bytes.NewBuffer(payloadBytes))
-				if err != nil {
-					metrics.FailedReqs.Inc()
-					resultChannel <- CreateErrorResultMessage(msg.RequestMessage, fmt.Sprintf("Failed to create request to inference: %s", err.Error()))
-					return
-				}
-				for k, v := range msg.HttpHeaders {
-					request.Header.Set(k, v)
-				}
-
-				result, err := httpClient.Do(request)
-				if err != nil {
-					metrics.FailedReqs.Inc()
-					resultChannel <- CreateErrorResultMessage(msg.RequestMessage, fmt.Sprintf("Failed to send request to inference: %s", err.Error()))
-					return
-				}
-				defer result.Body.Close()
-				// Retrying on too many requests or any server-side error.
-				if result.StatusCode == 429 || result.StatusCode >= 500 && result.StatusCode < 600 {
-					if result.StatusCode == 429 {
-						metrics.SheddedRequests.Inc()
-					}
-					retryMessage(msg, retryChannel, resultChannel)
-				} else {
-					payloadBytes, err := io.ReadAll(result.Body)
-					if err != nil {
-						// Retrying on IO-read error as well.
-						retryMessage(msg, retryChannel, resultChannel)
-					} else {
-						metrics.SuccessfulReqs.Inc()
-						resultChannel <- ResultMessage{
-							Id:       msg.Id,
-							Payload:  string(payloadBytes),
-							Metadata: msg.Metadata,
-						}
-					}
-				}
+	sendInferenceRequest := func() dispatchOutcome {
+		if opts.ModelConcurrency != nil {
+			model, _ := msg.Payload["model"].(string)
+			release, err := opts.ModelConcurrency.acquire(dispatchCtx, model)
+			if err != nil {
+				return dispatchOutcome{cancelled: true}
 			}
-			sendInferenceRequest()
+			defer release()
 		}
+		if opts.RequestTimeout <= 0 {
+			return dispatch(dispatchCtx, httpClient, msg, payloadBytes, opts)
+		}
+		// Only the call to the inference gateway is bounded, not the wait for a slot of the model.
+		requestCtx, cancel := context.WithTimeout(dispatchCtx, opts.RequestTimeout)
+		defer cancel()
+		outcome := dispatch(requestCtx, httpClient, msg, payloadBytes, opts)
+		if outcome.cancelled && dispatchCtx.Err() == nil && errors.Is(requestCtx.Err(), context.DeadlineExceeded) {
+			metrics.RequestTimeouts.Inc()
+			// Not cut short by the worker: handled like any other failed dispatch.
+			outcome.cancelled = false
+			outcome.timedOut = true
+		}
+		return outcome
+	}
+	var outcome dispatchOutcome
+	var shared bool
+	dispatchStart := opts.now()
+	if opts.Coalescer == nil {
+		outcome = sendInferenceRequest()
+	} else {
+		var err error
+		outcome, shared, err = opts.Coalescer.do(ctx, opts.clock(), requestKey(msg, payloadBytes), sendInferenceRequest)
+		if err != nil {
+			// Context is done while waiting for the shared dispatch. The worker is finishing anyway.
+			metrics.AbandonedReqs.Inc()
+			return
+		}
+		if shared {
+			metrics.CoalescedReqs.Inc()
+		}
+	}
+	if outcome.cancelled {
+		metrics.CancelledDispatches.Inc()
+		switch {
+		case ctx.Err() != nil:
+			// The worker is finishing, the request is left to the message queue.
+			metrics.AbandonedReqs.Inc()
+			log.FromContext(ctx).V(logutil.VERBOSE).Info("Dispatch cancelled on shutdown", "id", msg.Id)
+		case dispatchCtx.Err() != nil:
+			metrics.BudgetExhaustedReqs.Inc()
+			errorChannel <- opts.errorResult(msg.RequestMessage, "request budget exhausted")
+		default:
+			// The shared dispatch of another request was cancelled, not this one.
+			retryMessage(msg, retryReasonCoalesced, "shared dispatch cancelled", retryChannel, errorChannel, opts)
+		}
+		return
+	}
+	if opts.AuditSink != nil {
+		record := newAuditRecord(msg, dispatchStart, outcome.routedEndpoint)
+		if err := opts.AuditSink.Audit(ctx, record); err != nil {
+			metrics.AuditFailures.Inc()
+			log.FromContext(ctx).V(logutil.DEFAULT).Error(err, "Failed to audit request", "id", msg.Id)
+			if opts.AuditFailClosed {
+				metrics.FailedReqs.Inc()
+				errorChannel <- opts.errorResult(msg.RequestMessage, "request could not be audited")
+				return
+			}
+		}
+	}
+	if outcome.timedOut {
+		log.FromContext(ctx).V(logutil.VERBOSE).Info("Dispatch timed out", "id", msg.Id, "timeout", opts.RequestTimeout)
+	}
+	if outcome.succeeded() && opts.FailEmptyResponses && len(bytes.TrimSpace(outcome.body)) == 0 {
+		outcome.invalid = errors.New("empty response")
+		metrics.EmptyResponses.Inc()
+		log.FromContext(ctx).V(logutil.VERBOSE).Info("Empty response", "id", msg.Id)
+	}
+	if outcome.succeeded() && len(opts.ResponseAdapters) > 0 {
+		adapted, err := opts.ResponseAdapters.adapt(msg, outcome.body, opts.now())
+		if err != nil {
+			// Published as is, the consumers are in a better position to make sense of it.
+			log.FromContext(ctx).V(logutil.VERBOSE).Info("Failed to adapt response", "id", msg.Id, "reason", err.Error())
+		}
+		outcome.body = adapted
+	}
+	if outcome.succeeded() && len(opts.RequiredResponseFields) > 0 {
+		if outcome.invalid = validateResponse(outcome.body, opts.RequiredResponseFields); outcome.invalid != nil {
+			metrics.InvalidResponses.Inc()
+			log.FromContext(ctx).V(logutil.VERBOSE).Info("Invalid response", "id", msg.Id, "reason", outcome.invalid.Error())
+		}
+	}
+	if outcome.succeeded() {
+		if cacheKey != "" {
+			opts.ResponseCache.Set(ctx, cacheKey, string(outcome.body), opts.ResponseCacheTTL)
+		}
+		if !shared {
+			// A shared dispatch consumed the tokens only once.
+			recordTokenUsage(msg.RequestMessage, outcome.body, opts.MetricLabels)
+		}
+		outcome.body = opts.ModelRewrites.restoreResponse(msg.RequestMessage, outcome.body)
+		if opts.Mirror != nil {
+			opts.Mirror.Record(msg.RequestMessage, outcome.body)
+		}
+	}
+	latency := opts.now().Sub(dispatchStart)
+	if opts.SlowRequestThreshold > 0 && latency >= opts.SlowRequestThreshold {
+		logSlowRequest(ctx, msg, outcome, latency, len(payloadBytes))
+	}
+	result := handleOutcome(msg, outcome, retryChannel, resultChannel, opts)
+	if opts.OutcomeSink != nil {
+		opts.OutcomeSink.RecordOutcome(ctx, Outcome{
+			Request:    msg.RequestMessage,
+			Endpoint:   msg.InferenceGateway,
+			Latency:    latency,
+			StatusCode: outcome.statusCode,
+			Result:     result,
+		})
+	}
+}
+
+// logSlowRequest logs everything known about a dispatch that took too long.
+func logSlowRequest(ctx context.Context, msg EmbelishedRequestMessage, outcome dispatchOutcome, latency time.Duration,
+	requestBytes int) {
+	phases := map[string]string{}
+	if outcome.timings != nil {
+		for phase, duration := range outcome.timings.phases() {
+			phases[phase] = duration.String()
+		}
+	}
+	log.FromContext(ctx).V(logutil.DEFAULT).Info("Slow request", "id", msg.Id, "endpoint", msg.InferenceGateway,
+		"latency", latency.String(), "status", outcome.statusCode, "retry-count", msg.RetryCount,
+		"request-bytes", requestBytes, "response-bytes", len(outcome.body), "phases", phases)
+}
+
+func dispatch(ctx context.Context, httpClient *http.Client, msg EmbelishedRequestMessage, payloadBytes []byte, opts WorkerOptions) dispatchOutcome {
+	logger := log.FromContext(ctx)
+	logger.V(logutil.DEBUG).Info("Sending inference request.")
+	var timings *dispatchTimings
+	if opts.LatencyBreakdown || opts.SlowRequestThreshold > 0 {
+		timings = newDispatchTimings()
+		ctx = httptrace.WithClientTrace(ctx, timings.clientTrace())
+	}
+	compressed := opts.CompressionMinBytes > 0 && len(payloadBytes) >= opts.CompressionMinBytes
+	if compressed {
+		payloadBytes = gzipBody(payloadBytes)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", msg.InferenceGateway, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return dispatchOutcome{failure: fmt.Sprintf("Failed to create request to inference: %s", err.Error())}
+	}
+	for k, v := range msg.HttpHeaders {
+		request.Header.Set(k, v)
+	}
+	if msg.ContentType != "" {
+		request.Header.Set("Content-Type", msg.ContentType)
+	}
+	if compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	result, err := httpClient.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return dispatchOutcome{cancelled: true}
+		}
+		return dispatchOutcome{failure: fmt.Sprintf("Failed to send request to inference: %s", err.Error())}
+	}
+	defer result.Body.Close()
+	outcome := dispatchOutcome{statusCode: result.StatusCode, timings: timings,
+		routedEndpoint: result.Header.Get(opts.routedEndpointHeader()),
+		servedBy:       opts.ServedByHeaders.servedBy(result.Header)}
+	if !isRetryableStatus(result.StatusCode) {
+		outcome.body, outcome.readErr = io.ReadAll(result.Body)
+		outcome.cancelled = outcome.readErr != nil && ctx.Err() != nil
+	}
+	if timings != nil {
+		timings.end = time.Now()
+		if opts.LatencyBreakdown {
+			timings.observe()
+		}
+	}
+	return outcome
+}
+
+func gzipBody(body []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(body) // nolint:errcheck
+	writer.Close()     // nolint:errcheck
+	return buf.Bytes()
+}
+
+// Reasons of the retries, as labelled in the metrics.
+const (
+	retryReasonShedded         = "shedded"
+	retryReasonServerError     = "server_error"
+	retryReasonReadError       = "read_error"
+	retryReasonInvalidResponse = "invalid_response"
+	retryReasonBodyFetch       = "body_fetch"
+	retryReasonTimeout         = "timeout"
+	retryReasonCoalesced       = "coalesced_dispatch_cancelled"
+)
+
+// The error of the requests that failed in a way that can't be retried without RequestMessage.Idempotent.
+const notIdempotentError = "request is not idempotent and can't be retried"
+
+// Retrying on too many requests or any server-side error.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == 429 || statusCode >= 500 && statusCode < 600
+}
+
+// What the worker does with the request, by status of the inference gateway's response:
+//   - 2xx: the response is the result.
+//   - 429: the request was shedded, it is retried.
+//   - 5xx: server-side error, the request is retried.
+//   - other 4xx: the request is at fault, the response is the result, as it usually tells why.
+//   - anything else (informational statuses and redirects the client didn't handle, non-standard statuses): the
+//     response can't be made sense of, the request is dead-lettered.
+func isUnexpectedStatus(statusCode int) bool {
+	return statusCode < 200 || statusCode >= 300 && statusCode < 400 || statusCode >= 600
+}
+
+func handleOutcome(msg EmbelishedRequestMessage, outcome dispatchOutcome, retryChannel chan RetryMessage,
+	resultChannel chan ResultMessage, opts WorkerOptions) OutcomeResult {
+	errorChannel := opts.errorChannel(resultChannel)
+	switch {
+	case outcome.failure != "":
+		metrics.FailedReqs.Inc()
+		errorChannel <- opts.errorResult(msg.RequestMessage, outcome.failure)
+		return OutcomeFailed
+	case outcome.timedOut && opts.RetryOnlyIdempotent && !msg.Idempotent:
+		metrics.FailedReqs.Inc()
+		errorChannel <- opts.errorResult(msg.RequestMessage, notIdempotentError)
+		return OutcomeFailed
+	case outcome.timedOut:
+		return retryOutcome(retryMessage(msg, retryReasonTimeout, fmt.Sprintf("request timed out after %s", opts.RequestTimeout),
+			retryChannel, errorChannel, opts))
+	case isUnexpectedStatus(outcome.statusCode):
+		metrics.FailedReqs.Inc()
+		errorChannel <- opts.errorResult(msg.RequestMessage, fmt.Sprintf("unexpected status %d", outcome.statusCode))
+		return OutcomeFailed
+	case outcome.statusCode == 429:
+		// Shedded requests were not executed, so they are safe to retry even if not idempotent.
+		metrics.SheddedRequests.Inc()
+		return retryOutcome(retryMessage(msg, retryReasonShedded, "status 429", retryChannel, errorChannel, opts))
+	case opts.RetryOnlyIdempotent && !msg.Idempotent &&
+		(isRetryableStatus(outcome.statusCode) || outcome.readErr != nil || outcome.invalid != nil):
+		// The request may have been executed, retrying could execute it twice.
+		metrics.FailedReqs.Inc()
+		errorChannel <- opts.errorResult(msg.RequestMessage, notIdempotentError)
+		return OutcomeFailed
+	case isRetryableStatus(outcome.statusCode):
+		return retryOutcome(retryMessage(msg, retryReasonServerError, fmt.Sprintf("status %d", outcome.statusCode), retryChannel,
+			errorChannel, opts))
+	case outcome.readErr != nil:
+		// Retrying on IO-read error as well.
+		return retryOutcome(retryMessage(msg, retryReasonReadError, fmt.Sprintf("Failed to read response: %s", outcome.readErr.Error()),
+			retryChannel, errorChannel, opts))
+	case outcome.invalid != nil:
+		// A soft failure of the model server, retrying like a server-side error.
+		return retryOutcome(retryMessage(msg, retryReasonInvalidResponse, outcome.invalid.Error(), retryChannel, errorChannel, opts))
+	default:
+		return deliverResult(msg.RequestMessage, outcome.body, outcome.servedBy, resultChannel, opts)
 	}
 }
 
+func retryOutcome(retried bool) OutcomeResult {
+	if retried {
+		return OutcomeRetried
+	}
+	return OutcomeFailed
+}
+
 // parsing and validating payload. On failure puts an error msg on the result-channel and returns nil
-func validateAndMarshall(resultChannel chan ResultMessage, msg RequestMessage) []byte {
+func validateAndMarshall(resultChannel chan ResultMessage, msg RequestMessage, opts WorkerOptions) []byte {
 	deadline, err := strconv.ParseInt(msg.DeadlineUnixSec, 10, 64)
 	if err != nil {
 		metrics.FailedReqs.Inc()
-		resultChannel <- CreateErrorResultMessage(msg, "Failed to parse deadline, should be in Unix seconds.")
+		resultChannel <- opts.errorResult(msg, "Failed to parse deadline, should be in Unix seconds.")
 		return nil
 	}
 
-	if deadline < time.Now().Unix() {
+	if deadline < opts.now().Unix() {
 		metrics.ExceededDeadlineReqs.Inc()
-		resultChannel <- CreateDeadlineExceededResultMessage(msg)
+		resultChannel <- opts.deadlineExceededResult(msg)
 		return nil
 	}
 
+	if msg.Body != nil {
+		return msg.Body
+	}
 	payloadBytes, err := json.Marshal(msg.Payload)
 	if err != nil {
 		metrics.FailedReqs.Inc()
-		resultChannel <- CreateErrorResultMessage(msg, fmt.Sprintf("Failed to marshal message's payload: %s", err.Error()))
+		resultChannel <- opts.errorResult(msg, fmt.Sprintf("Failed to marshal message's payload: %s", err.Error()))
 		return nil
 	}
 	return payloadBytes
 }
 
-// If it is not after deadline, just publish again.
-func retryMessage(msg EmbelishedRequestMessage, retryChannel chan RetryMessage, resultChannel chan ResultMessage) {
+// If it is not after deadline, just publish again. Returns false if the request was failed instead. reason labels the
+// retry in the metrics, lastError tells why the attempt failed, for the dead letter of a request that exhausted its
+// retries.
+func retryMessage(msg EmbelishedRequestMessage, reason string, lastError string, retryChannel chan RetryMessage,
+	resultChannel chan ResultMessage, opts WorkerOptions) bool {
 	deadline, err := strconv.ParseInt(msg.DeadlineUnixSec, 10, 64)
 	if err != nil { // Can't really happen because this was already parsed in the past. But we don't care to have this branch.
-		resultChannel <- CreateErrorResultMessage(msg.RequestMessage, "Failed to parse deadline. Should be in Unix time")
-		return
+		resultChannel <- opts.errorResult(msg.RequestMessage, "Failed to parse deadline. Should be in Unix time")
+		return false
 	}
-	secondsToDeadline := deadline - time.Now().Unix()
+	now := opts.now()
+	secondsToDeadline := deadline - now.Unix()
 	if secondsToDeadline < 0 {
 		metrics.ExceededDeadlineReqs.Inc()
-		resultChannel <- CreateDeadlineExceededResultMessage(msg.RequestMessage)
+		resultChannel <- opts.deadlineExceededResult(msg.RequestMessage)
+		return false
+	} else if opts.MaxRetries > 0 && msg.RetryCount >= opts.MaxRetries {
+		// Checked before taking a slot of the retry tracker, which would be held until the deadline otherwise.
+		metrics.RetriesExhaustedReqs.Inc()
+		opts.deadLetterChannel(resultChannel) <- opts.deadLetterResult(msg.RequestMessage, msg.RetryCount+1, lastError)
+		return false
+	} else if opts.RetryTracker != nil && !opts.RetryTracker.tryAdd(msg.Id, time.Unix(deadline, 0), now) {
+		metrics.RetryLimitedReqs.Inc()
+		resultChannel <- opts.errorResult(msg.RequestMessage, "too many requests in the retry pipeline")
+		return false
 	} else {
 		msg.RetryCount++
-		finalDuration := expBackoffDuration(msg.RetryCount, int(secondsToDeadline))
-		metrics.Retries.Inc()
+		finalDuration := opts.retryBackoff(msg.RetryCount, secondsToDeadline)
+		msg.RetriedAtMs = now.UnixMilli()
+		metrics.Retries.WithLabelValues(reason).Inc()
 		retryChannel <- RetryMessage{
 			EmbelishedRequestMessage: msg,
 			BackoffDurationSeconds:   finalDuration,
 		}
+		return true
+	}
+}
 
+// waitForTenant holds the request until its tenant is allowed to dispatch it. It is not a failed attempt: the retry
+// count is left as is, and the request doesn't go back to the message queue. Returns false if the request isn't to be
+// dispatched: waiting would outlast its budget, or the worker is finishing.
+func waitForTenant(ctx context.Context, msg RequestMessage, errorChannel chan ResultMessage, opts WorkerOptions) bool {
+	tenant := msg.Metadata[TenantMetadataKey]
+	for {
+		delay := opts.TenantRateLimiter.Reserve(tenant, opts.now())
+		if delay <= 0 {
+			return true
+		}
+		if opts.TotalBudget > 0 && opts.now().Add(delay).Sub(time.UnixMilli(msg.FirstDequeueMs)) >= opts.TotalBudget {
+			// Waiting for the tenant's turn would outlast the budget.
+			metrics.BudgetExhaustedReqs.Inc()
+			errorChannel <- opts.errorResult(msg, "request budget exhausted")
+			return false
+		}
+		metrics.ThrottledReqs.Inc()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			// Other requests of the tenant may have taken its turn meanwhile: reserving again.
+		case <-ctx.Done():
+			timer.Stop()
+			// The worker is finishing, the request is left to the message queue.
+			metrics.AbandonedReqs.Inc()
+			return false
+		}
 	}
+}
 
+// deliverResult publishes the response of a successful request, unless it is too large for the broker.
+func deliverResult(msg RequestMessage, body []byte, servedBy map[string]string, resultChannel chan ResultMessage,
+	opts WorkerOptions) OutcomeResult {
+	result := opts.result(msg, string(body))
+	result.ServedBy = servedBy
+	size := 0
+	if opts.MaxResultBytes > 0 {
+		// Measured as published, the payload being escaped in the marshaled result.
+		size = resultBytes(result)
+	}
+	if size <= opts.MaxResultBytes {
+		metrics.SuccessfulReqs.Inc()
+		resultChannel <- result
+		return OutcomeSuccess
+	}
+	metrics.OversizedResults.Inc()
+	if opts.ResultStore != nil {
+		ref, err := opts.ResultStore.Store(msg.Id, body)
+		if err == nil {
+			metrics.SuccessfulReqs.Inc()
+			result.Payload = ""
+			result.PayloadRef = ref
+			resultChannel <- result
+			return OutcomeSuccess
+		}
+		log.Log.WithName("worker").V(logutil.DEFAULT).Error(err, "Failed to store oversized result", "id", msg.Id)
+	}
+	metrics.FailedReqs.Inc()
+	// The SLO was checked with the result this one replaces.
+	opts.errorChannel(resultChannel) <- CreateErrorResultMessage(msg,
+		fmt.Sprintf("result of %d bytes exceeds the maximum of %d bytes", size, opts.MaxResultBytes))
+	return OutcomeFailed
 }
-func CreateErrorResultMessage(msg RequestMessage, errMsg string) ResultMessage {
+
+// resultBytes returns the size of the result once marshaled by the flows.
+func resultBytes(result ResultMessage) int {
+	marshaled, err := json.Marshal(result)
+	if err != nil {
+		return math.MaxInt
+	}
+	return len(marshaled)
+}
+
+// NewResultMessage creates the result of the request, with a fresh idempotency key.
+func NewResultMessage(msg RequestMessage, payload string) ResultMessage {
+	key := make([]byte, 16)
+	_, _ = cryptorand.Read(key)
 	return ResultMessage{
-		Id:       msg.Id,
-		Payload:  `{"error": "` + errMsg + `"}`,
-		Metadata: msg.Metadata,
+		Id:             msg.Id,
+		Payload:        payload,
+		IdempotencyKey: hex.EncodeToString(key),
+		Metadata:       msg.Metadata,
 	}
 }
 
+func CreateErrorResultMessage(msg RequestMessage, errMsg string) ResultMessage {
+	return NewResultMessage(msg, `{"error": "`+errMsg+`"}`)
+}
+
+// deadLetter is the payload of the result of a request that exhausted its retries.
+type deadLetter struct {
+	Error     string `json:"error"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// CreateDeadLetterResultMessage returns the result of a request that failed all its attempts, lastError telling why
+// the last one did.
+func CreateDeadLetterResultMessage(msg RequestMessage, attempts int, lastError string) ResultMessage {
+	payload, _ := json.Marshal(deadLetter{
+		Error:     fmt.Sprintf("retries exhausted after %d attempts", attempts),
+		Attempts:  attempts,
+		LastError: lastError,
+	})
+	return NewResultMessage(msg, string(payload))
+}
+
 func CreateDeadlineExceededResultMessage(msg RequestMessage) ResultMessage {
 	return CreateErrorResultMessage(msg, "deadline exceeded")
 }
 
-func expBackoffDuration(retryCount int, secondsToDeadline int) float64 {
-	backoffDurationSeconds := math.Min(
-		float64(baseDelaySeconds)*(math.Pow(2, float64(retryCount))),
-		float64(secondsToDeadline))
+// expBackoffDuration returns base * 2^retryCount seconds, capped by maxSeconds (when above 0) and the deadline, plus
+// jitter * base / 2, jitter being a random value in [-0.5, 0.5). The jitter never takes it over maxSeconds.
+func expBackoffDuration(retryCount int, secondsToDeadline float64, base float64, maxSeconds float64, jitter float64) float64 {
+	backoffDurationSeconds := math.Min(base*math.Pow(2, float64(retryCount)), secondsToDeadline)
+	if maxSeconds > 0 {
+		backoffDurationSeconds = math.Min(backoffDurationSeconds, maxSeconds)
+	}
 
-	jitter := rand.Float64() - 0.5
-	finalDuration := backoffDurationSeconds + jitter
+	finalDuration := backoffDurationSeconds + jitter*base/2
+	if maxSeconds > 0 {
+		finalDuration = math.Min(finalDuration, maxSeconds)
+	}
 	if finalDuration < 0 {
 		finalDuration = 0
 	}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// Delay before restarting a worker that panicked, so a persistent failure doesn't turn into a busy loop.
+var workerRestartDelay = time.Second
+
+// WorkerPool supervises a set of workers. Workers are restarted one at a time: each one is told to stop, finishes its
+// in-flight request and only then is replaced, so the pipeline keeps running while the pool is being restarted.
+type WorkerPool struct {
+	run func(index int, stop <-chan struct{})
+
+	mu      sync.Mutex
+	workers []*supervisedWorker
+}
+
+type supervisedWorker struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWorkerPool returns a pool whose workers execute run. The index identifies the worker slot and is kept by its
+// replacements. run must return once stop is closed, without dropping the request it is processing.
+func NewWorkerPool(run func(index int, stop <-chan struct{})) *WorkerPool {
+	return &WorkerPool{run: run}
+}
+
+// Start adds n workers to the pool.
+func (p *WorkerPool) Start(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for range n {
+		p.workers = append(p.workers, p.startWorker(len(p.workers)))
+	}
+}
+
+// Size returns the number of workers in the pool.
+func (p *WorkerPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// Restart replaces the workers one at a time, waiting for each to drain before starting its replacement. If ctx ends
+// while a worker drains, the worker is replaced right away and the rest of the workers are left running.
+func (p *WorkerPool) Restart(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	logger := log.FromContext(ctx)
+	for i, w := range p.workers {
+		close(w.stop)
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			p.workers[i] = p.startWorker(i)
+			return ctx.Err()
+		}
+		p.workers[i] = p.startWorker(i)
+		logger.V(logutil.VERBOSE).Info("Worker restarted", "worker", i)
+	}
+	return nil
+}
+
+// Wait waits for the workers to return, e.g. to finish their in-flight requests once their context is cancelled.
+func (p *WorkerPool) Wait(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.workers {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (p *WorkerPool) startWorker(index int) *supervisedWorker {
+	w := &supervisedWorker{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for !p.runWorker(index, w.stop) {
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(workerRestartDelay):
+			}
+		}
+	}()
+	return w
+}
+
+// runWorker runs a worker until it returns. Returns false if the worker panicked and should be restarted.
+func (p *WorkerPool) runWorker(index int, stop <-chan struct{}) (finished bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Log.WithName("worker-pool").Error(fmt.Errorf("%v", r), "Worker panicked, restarting it", "worker", index)
+			finished = false
+		}
+	}()
+	p.run(index, stop)
+	return true
+}
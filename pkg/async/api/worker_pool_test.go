@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_restartDrainsWorkers(t *testing.T) {
+	var mu sync.Mutex
+	running := map[int]int{}
+	maxRunning := 0
+	starts := 0
+	pool := NewWorkerPool(func(index int, stop <-chan struct{}) {
+		mu.Lock()
+		starts++
+		running[index]++
+		if running[index] > maxRunning {
+			maxRunning = running[index]
+		}
+		mu.Unlock()
+
+		<-stop
+		// Finishing an in-flight request.
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[index]--
+		mu.Unlock()
+	})
+	pool.Start(3)
+	if pool.Size() != 3 {
+		t.Fatalf("Expected 3 workers, got %d", pool.Size())
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := pool.Restart(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if starts != 6 {
+		t.Errorf("Expected every worker to be started twice, got %d starts", starts)
+	}
+	if maxRunning != 1 {
+		t.Errorf("Expected a replacement to start only after its worker drained, got %d concurrent workers in a slot", maxRunning)
+	}
+}
+
+func TestWorkerPool_restartTimeoutReplacesWorker(t *testing.T) {
+	var starts atomic.Int32
+	pool := NewWorkerPool(func(index int, stop <-chan struct{}) {
+		starts.Add(1)
+		<-stop
+		// Longer to drain than the restart allows.
+		time.Sleep(100 * time.Millisecond)
+	})
+	pool.Start(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.Restart(ctx); err == nil {
+		t.Fatalf("Expected the restart to time out")
+	}
+	deadline := time.Now().Add(time.Second)
+	for starts.Load() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the stopped worker to be replaced, got %d starts", starts.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pool.Size() != 2 {
+		t.Errorf("Expected 2 workers, got %d", pool.Size())
+	}
+}
+
+func TestWorkerPool_restartsPanickedWorker(t *testing.T) {
+	defer func(delay time.Duration) { workerRestartDelay = delay }(workerRestartDelay)
+	workerRestartDelay = time.Millisecond
+	restarted := make(chan struct{})
+	attempts := 0
+	pool := NewWorkerPool(func(index int, stop <-chan struct{}) {
+		attempts++
+		if attempts == 1 {
+			panic("transient failure")
+		}
+		close(restarted)
+		<-stop
+	})
+	pool.Start(1)
+
+	select {
+	case <-restarted:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the worker to be restarted after a panic")
+	}
+}
+
+func TestWorkerPool_wait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var finished atomic.Int32
+	pool := NewWorkerPool(func(index int, stop <-chan struct{}) {
+		<-ctx.Done()
+		// Finishing an in-flight request.
+		time.Sleep(10 * time.Millisecond)
+		finished.Add(1)
+	})
+	pool.Start(2)
+	cancel()
+
+	if err := pool.Wait(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if finished.Load() != 2 {
+		t.Errorf("Expected both workers to be finished, got %d", finished.Load())
+	}
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	stuck := NewWorkerPool(func(index int, stop <-chan struct{}) { <-stop })
+	stuck.Start(1)
+	if err := stuck.Wait(timeoutCtx); err == nil {
+		t.Errorf("Expected waiting for a stuck worker to time out")
+	}
+}
@@ -1,12 +1,22 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 func TestRetryMessage_deadlinePassed(t *testing.T) {
@@ -22,7 +32,7 @@ func TestRetryMessage_deadlinePassed(t *testing.T) {
 		HttpHeaders:      map[string]string{},
 		InferenceGateway: "",
 	}
-	retryMessage(msg, retryChannel, resultChannel)
+	retryMessage(msg, "", "", retryChannel, resultChannel, WorkerOptions{})
 	if len(retryChannel) > 0 {
 		t.Errorf("Message that its deadline passed should not be retried. Got a message in the retry channel")
 		return
@@ -54,7 +64,7 @@ func TestRetryMessage_retry(t *testing.T) {
 		HttpHeaders:      map[string]string{},
 		InferenceGateway: "",
 	}
-	retryMessage(msg, retryChannel, resultChannel)
+	retryMessage(msg, "", "", retryChannel, resultChannel, WorkerOptions{})
 	if len(resultChannel) > 0 {
 		t.Errorf("Should not have any messages in the result channel")
 		return
@@ -99,7 +109,7 @@ func TestSheddedRequest(t *testing.T) {
 	resultChannel := make(chan ResultMessage, 1)
 	ctx := context.Background()
 
-	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel)
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{})
 	deadline := time.Now().Add(time.Second * 100).Unix()
 
 	requestChannel <- EmbelishedRequestMessage{
@@ -139,7 +149,7 @@ func TestSuccessfulRequest(t *testing.T) {
 	resultChannel := make(chan ResultMessage, 1)
 	ctx := context.Background()
 
-	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel)
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{})
 
 	deadline := time.Now().Add(time.Second * 100).Unix()
 
@@ -165,3 +175,1346 @@ func TestSuccessfulRequest(t *testing.T) {
 	}
 
 }
+
+func TestMaxInFlight(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       nil,
+			Header:     make(http.Header),
+		}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	inFlight := make(chan struct{}, 1)
+	// Another worker holds the only in-flight slot.
+	inFlight <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{InFlight: inFlight})
+
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+			Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(requestChannel) != 1 {
+		t.Fatalf("Expected the request to stay in the request channel while no in-flight slot is available")
+	}
+
+	<-inFlight
+	select {
+	case <-resultChannel:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected a result once an in-flight slot was released")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	dispatches := 0
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		dispatches++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"text": "hello"}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := WorkerOptions{ResponseCache: NewInMemoryResponseCache(nil), ResponseCacheTTL: time.Minute}
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, opts)
+
+	for _, id := range []string{"first", "second"} {
+		requestChannel <- EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              id,
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": "hi", "temperature": 0},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+		r := <-resultChannel
+		if r.Id != id || r.Payload != `{"text": "hello"}` {
+			t.Errorf("Unexpected result %+v", r)
+		}
+	}
+	if dispatches != 1 {
+		t.Errorf("Expected the second request to be answered from the cache, got %d dispatches", dispatches)
+	}
+}
+
+func TestInMemoryResponseCache_expiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	cache := NewInMemoryResponseCache(clock)
+	cache.Set(context.Background(), "key", "payload", time.Minute)
+
+	clock.Advance(59 * time.Second)
+	if payload, ok := cache.Get(context.Background(), "key"); !ok || payload != "payload" {
+		t.Errorf("Expected the payload to be cached until its ttl is over, got %q", payload)
+	}
+	clock.Advance(2 * time.Second)
+	if _, ok := cache.Get(context.Background(), "key"); ok {
+		t.Errorf("Expected the payload to expire once its ttl is over")
+	}
+}
+
+func TestErrorResultChannel(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("connection refused")
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	errorChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{ErrorResultChannel: errorChannel})
+
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+			Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+
+	select {
+	case r := <-errorChannel:
+		if r.Id != "123" {
+			t.Errorf("Expected error result id to be 123, got %s", r.Id)
+		}
+	case <-resultChannel:
+		t.Errorf("Should not get an error on the result channel")
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected an error result")
+	}
+}
+
+func TestTotalBudgetExhausted(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Request with an exhausted budget should not be dispatched")
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{TotalBudget: time.Minute})
+
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			RetryCount:      3,
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+			Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+			FirstDequeueMs:  time.Now().Add(-2 * time.Minute).UnixMilli(),
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+
+	select {
+	case r := <-resultChannel:
+		var resultMap map[string]any
+		json.Unmarshal([]byte(r.Payload), &resultMap) // nolint:errcheck
+		if resultMap["error"] != "request budget exhausted" {
+			t.Errorf("Expected error to be: 'request budget exhausted', got: %s", resultMap["error"])
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected an error result")
+	}
+}
+
+func TestNewResultMessage_idempotencyKey(t *testing.T) {
+	msg := RequestMessage{Id: "123"}
+	first := NewResultMessage(msg, "{}")
+	second := NewResultMessage(msg, "{}")
+	if first.IdempotencyKey == "" {
+		t.Errorf("Expected the result to carry an idempotency key")
+	}
+	if first.IdempotencyKey == second.IdempotencyKey {
+		t.Errorf("Expected distinct results to carry distinct idempotency keys, got %s twice", first.IdempotencyKey)
+	}
+
+	var published map[string]any
+	bytes, _ := json.Marshal(first)
+	json.Unmarshal(bytes, &published) // nolint:errcheck
+	if published["idempotency_key"] != first.IdempotencyKey {
+		t.Errorf("Expected the idempotency key to be published, got %v", published)
+	}
+}
+
+func TestModelRewrites(t *testing.T) {
+	rewrites, err := ParseModelRewrites("chat-large=meta-llama/Llama-3.1-70B-Instruct, chat-small=meta-llama/Llama-3.1-8B-Instruct")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var dispatchedModel any
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		var payload map[string]any
+		json.NewDecoder(req.Body).Decode(&payload) // nolint:errcheck
+		dispatchedModel = payload["model"]
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"model": "meta-llama/Llama-3.1-70B-Instruct", "text": "hello"}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{ModelRewrites: rewrites})
+
+	payload := map[string]any{"model": "chat-large", "prompt": "hi"}
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+			Payload:         payload,
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+	result := <-resultChannel
+	if dispatchedModel != "meta-llama/Llama-3.1-70B-Instruct" {
+		t.Errorf("Expected the model id to be dispatched, got %v", dispatchedModel)
+	}
+	if payload["model"] != "chat-large" {
+		t.Errorf("Expected the request payload to be left untouched, got %v", payload["model"])
+	}
+	var response map[string]any
+	json.Unmarshal([]byte(result.Payload), &response) // nolint:errcheck
+	if response["model"] != "chat-large" || response["text"] != "hello" {
+		t.Errorf("Expected the model name to be restored in the response, got %s", result.Payload)
+	}
+
+	if _, err := ParseModelRewrites("chat-large"); err == nil {
+		t.Errorf("Expected an error for a rewrite without a model id")
+	}
+}
+
+func TestRetryOnlyIdempotent(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, WorkerOptions{RetryOnlyIdempotent: true})
+
+	for _, idempotent := range []bool{false, true} {
+		requestChannel <- EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              fmt.Sprintf("idempotent-%t", idempotent),
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+				Idempotent:      idempotent,
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+		select {
+		case r := <-retryChannel:
+			if !idempotent {
+				t.Errorf("Expected non-idempotent request %s not to be retried", r.Id)
+			}
+		case r := <-resultChannel:
+			if idempotent {
+				t.Errorf("Expected idempotent request to be retried, got result %s", r.Payload)
+			} else if !strings.Contains(r.Payload, "not idempotent") {
+				t.Errorf("Unexpected error result %s", r.Payload)
+			}
+		}
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	audio := []byte{0x52, 0x49, 0x46, 0x46, 0x00, 0xff}
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" {
+			// the body sent by reference
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(audio)), Header: make(http.Header)}, nil
+		}
+		body, _ := io.ReadAll(req.Body)
+		if !bytes.Equal(body, audio) || req.Header.Get("Content-Type") != "audio/wav" {
+			return &http.Response{StatusCode: http.StatusBadRequest, Body: io.NopCloser(strings.NewReader("unexpected body")), Header: make(http.Header)}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"text": "hello"}`)), Header: make(http.Header)}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	origins, err := ParseOriginAllowlist("http://storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel,
+		WorkerOptions{BodyURLOrigins: origins, MaxBodyURLBytes: int64(len(audio))})
+
+	for _, msg := range []RequestMessage{
+		{Id: "inline", Body: audio, ContentType: "audio/wav"},
+		{Id: "reference", BodyURL: "http://storage/audio.wav", ContentType: "audio/wav"},
+	} {
+		msg.DeadlineUnixSec = fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix())
+		requestChannel <- EmbelishedRequestMessage{
+			RequestMessage:   msg,
+			InferenceGateway: "http://localhost:30080/v1/audio/transcriptions",
+			HttpHeaders:      map[string]string{"Content-Type": "application/json"},
+		}
+		r := <-resultChannel
+		if r.Payload != `{"text": "hello"}` {
+			t.Errorf("Expected the %s body to be dispatched as is, got %s", msg.Id, r.Payload)
+		}
+	}
+}
+
+func TestBinaryBody_refused(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "GET" {
+			t.Errorf("Expected the request not to be dispatched")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("too large")), Header: make(http.Header)}, nil
+	})
+	origins, err := ParseOriginAllowlist("http://storage, https://cache:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := WorkerOptions{BodyURLOrigins: origins, MaxBodyURLBytes: 3}
+	for url, expected := range map[string]string{
+		"http://internal/secrets": "body URL not allowed",
+		"file:///etc/passwd":      "body URL not allowed",
+		"https://storage/a.wav":   "body URL not allowed",
+		"http://storage/a.wav":    "larger than 3 bytes",
+	} {
+		resultChannel := make(chan ResultMessage, 1)
+		msg := EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              "123",
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				BodyURL:         url,
+			},
+			InferenceGateway: "http://localhost:30080/v1/audio/transcriptions",
+		}
+		processRequest(context.Background(), httpclient, msg, make(chan RetryMessage, 1), resultChannel, opts)
+		if r := <-resultChannel; !strings.Contains(r.Payload, expected) {
+			t.Errorf("Expected %s to fail with %q, got %s", url, expected, r.Payload)
+		}
+	}
+	if _, err := ParseOriginAllowlist("storage"); err == nil {
+		t.Errorf("Expected an error for an origin without a scheme")
+	}
+}
+
+func TestDrainMode(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Expected no dispatch in drain mode")
+		return nil, fmt.Errorf("unexpected dispatch")
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	errorChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := WorkerOptions{DrainMode: true, ErrorResultChannel: errorChannel}
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, opts)
+
+	// Even a malformed request is drained.
+	requestChannel <- EmbelishedRequestMessage{RequestMessage: RequestMessage{Id: "123", DeadlineUnixSec: "not a deadline"}}
+	select {
+	case r := <-errorChannel:
+		if r.Id != "123" || !strings.Contains(r.Payload, "drained") {
+			t.Errorf("Unexpected error result %+v", r)
+		}
+	case r := <-resultChannel:
+		t.Errorf("Expected the drained request on the error channel, got %+v", r)
+	}
+}
+
+func TestRetryMessage_seededJitter(t *testing.T) {
+	backoffs := func() []float64 {
+		opts := WorkerOptions{JitterSource: NewJitterSource(42)}
+		retryChannel := make(chan RetryMessage, 3)
+		var durations []float64
+		for range 3 {
+			msg := EmbelishedRequestMessage{
+				RequestMessage: RequestMessage{
+					Id:              "123",
+					DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+				},
+			}
+			retryMessage(msg, "", "", retryChannel, make(chan ResultMessage, 1), opts)
+			durations = append(durations, (<-retryChannel).BackoffDurationSeconds)
+		}
+		return durations
+	}
+	first, second := backoffs(), backoffs()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Expected the same seed to give the same backoffs, got %v and %v", first, second)
+			break
+		}
+	}
+	if first[0] == first[1] {
+		t.Errorf("Expected the jitter to vary between retries, got %v", first)
+	}
+}
+
+func TestRetryMessage_backoff(t *testing.T) {
+	opts := WorkerOptions{
+		RetryBackoffBase: time.Second,
+		RetryBackoffMax:  10 * time.Second,
+		JitterSource:     NewJitterSource(42),
+	}
+	retryChannel := make(chan RetryMessage, 1)
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{Id: "123", DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())},
+	}
+	var durations []float64
+	for range 6 {
+		retryMessage(msg, "", "", retryChannel, make(chan ResultMessage, 1), opts)
+		retried := <-retryChannel
+		durations = append(durations, retried.BackoffDurationSeconds)
+		msg = retried.EmbelishedRequestMessage
+	}
+	for i, d := range durations {
+		if d > 10 {
+			t.Errorf("Expected the backoff to be capped at 10s, got %v", durations)
+			break
+		}
+		if i > 0 && i < 3 && d <= durations[i-1] {
+			t.Errorf("Expected the backoff to grow with the attempts, got %v", durations)
+			break
+		}
+	}
+	if durations[len(durations)-1] < 9.75 {
+		t.Errorf("Expected the backoff to reach the cap, got %v", durations)
+	}
+}
+
+func TestRetryMessage_maxRetries(t *testing.T) {
+	deadLetterChannel := make(chan ResultMessage, 1)
+	opts := WorkerOptions{MaxRetries: 2, DeadLetterChannel: deadLetterChannel}
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{Id: "123", DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())},
+	}
+	exhausted := counterValue(metrics.RetriesExhaustedReqs)
+	for range 2 {
+		if !retryMessage(msg, "", "status 503", retryChannel, resultChannel, opts) {
+			t.Fatalf("Expected the request to be retried")
+		}
+		msg = (<-retryChannel).EmbelishedRequestMessage
+	}
+	if retryMessage(msg, "", "status 502", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the request to be dead-lettered after 2 retries")
+	}
+	if len(resultChannel) != 0 {
+		t.Errorf("Expected the dead letter not to be published as a result")
+	}
+	var letter map[string]any
+	if err := json.Unmarshal([]byte((<-deadLetterChannel).Payload), &letter); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if letter["error"] != "retries exhausted after 3 attempts" || letter["attempts"] != 3.0 || letter["last_error"] != "status 502" {
+		t.Errorf("Expected the attempts and the last error in the dead letter, got %v", letter)
+	}
+	if got := counterValue(metrics.RetriesExhaustedReqs) - exhausted; got != 1 {
+		t.Errorf("Expected 1 request with exhausted retries, got %v", got)
+	}
+}
+
+func TestRetryMessage_maxRetriesReleasesRetryTracker(t *testing.T) {
+	tracker := NewRetryTracker(1)
+	opts := WorkerOptions{MaxRetries: 1, RetryTracker: tracker}
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{Id: "123", RetryCount: 1, DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())},
+	}
+	if retryMessage(msg, "", "status 503", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the request to be dead-lettered")
+	}
+	if tracker.Len() != 0 {
+		t.Errorf("Expected a request with exhausted retries not to hold a slot of the retry tracker")
+	}
+}
+
+func TestRetryMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	opts := WorkerOptions{Clock: clock, DrainMode: true}
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	msg := EmbelishedRequestMessage{RequestMessage: RequestMessage{Id: "123", DeadlineUnixSec: "2000"}}
+
+	shedded := metrics.Retries.WithLabelValues(retryReasonShedded)
+	retriesBefore := counterValue(shedded)
+	if !retryMessage(msg, retryReasonShedded, "status 429", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the request to be retried")
+	}
+	if got := counterValue(shedded) - retriesBefore; got != 1 {
+		t.Errorf("Expected 1 retry of a shedded request, got %v", got)
+	}
+
+	// Dequeued again 10s later.
+	retried := <-retryChannel
+	clock.Advance(10 * time.Second)
+	countBefore, sumBefore := histogramSamples(metrics.RetryQueueDuration)
+	processRequest(context.Background(), nil, retried.EmbelishedRequestMessage, retryChannel, resultChannel, opts)
+	<-resultChannel
+	count, sum := histogramSamples(metrics.RetryQueueDuration)
+	count, sum = count-countBefore, sum-sumBefore
+	if count != 1 || sum != 10 {
+		t.Errorf("Expected 10s in the retry queue, got %d observations summing to %v", count, sum)
+	}
+}
+
+func TestEndpointAndObjectivePaths(t *testing.T) {
+	endpointPath, err := ParseRequestFieldPath("$.metadata.gateway")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	objectivePath, _ := ParseRequestFieldPath("payload.routing.objective")
+	var dispatchedTo, objective string
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		dispatchedTo = req.URL.String()
+		objective = req.Header.Get("x-gateway-inference-objective")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	origins, _ := ParseOriginAllowlist("http://other-gateway")
+	opts := WorkerOptions{EndpointPath: endpointPath, EndpointOrigins: origins, ObjectivePath: objectivePath}
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel, opts)
+
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+			Payload:         map[string]any{"model": "food-review", "routing": map[string]any{"objective": "batch"}},
+			Metadata:        map[string]string{"gateway": "http://other-gateway/v1/completions"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{"x-gateway-inference-objective": "default"},
+	}
+	<-resultChannel
+	if dispatchedTo != "http://other-gateway/v1/completions" {
+		t.Errorf("Expected the request to be dispatched to the gateway in its metadata, got %s", dispatchedTo)
+	}
+	if objective != "batch" {
+		t.Errorf("Expected the objective of the payload, got %s", objective)
+	}
+}
+
+func TestEndpointPath_refused(t *testing.T) {
+	endpointPath, _ := ParseRequestFieldPath("payload.endpoint")
+	origins, _ := ParseOriginAllowlist("http://other-gateway")
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Expected no dispatch, got one to %s", req.URL)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+	})
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	opts := WorkerOptions{EndpointPath: endpointPath, EndpointOrigins: origins}
+
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+			Payload:         map[string]any{"model": "food-review", "endpoint": "http://169.254.169.254/latest/meta-data"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+	}
+	processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel, opts)
+	if r := <-resultChannel; r.Payload != `{"error": "endpoint not allowed"}` {
+		t.Errorf("Expected the request to be failed, got %+v", r)
+	}
+}
+
+func TestParseRequestFieldPath(t *testing.T) {
+	for _, s := range []string{"payload.endpoint", "$.payload.routing.endpoint", "metadata.gateway"} {
+		if _, err := ParseRequestFieldPath(s); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", s, err)
+		}
+	}
+	for _, s := range []string{"payload", "id", "body_url", "metadata.gateway.url", "payload..endpoint"} {
+		if _, err := ParseRequestFieldPath(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+type channelSink chan Outcome
+
+func (s channelSink) RecordOutcome(_ context.Context, outcome Outcome) {
+	s <- outcome
+}
+
+func TestOutcomeSink(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("")), Header: make(http.Header)}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage, 1)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	sink := make(channelSink, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Worker(ctx, Characteristics{HasExternalBackoff: false}, httpclient, requestChannel, retryChannel, resultChannel,
+		WorkerOptions{OutcomeSink: sink})
+
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix()),
+			Payload:         map[string]any{"model": "food-review"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+	<-retryChannel
+	outcome := <-sink
+	if outcome.Request.Id != "123" || outcome.Endpoint != "http://localhost:30080/v1/completions" {
+		t.Errorf("Unexpected outcome %+v", outcome)
+	}
+	if outcome.StatusCode != http.StatusServiceUnavailable || outcome.Result != OutcomeRetried {
+		t.Errorf("Expected a retried 503 outcome, got %+v", outcome)
+	}
+}
+
+func TestRetryTracker(t *testing.T) {
+	opts := WorkerOptions{RetryTracker: NewRetryTracker(1)}
+	retryChannel := make(chan RetryMessage, 2)
+	resultChannel := make(chan ResultMessage, 2)
+	newMsg := func(id string) EmbelishedRequestMessage {
+		return EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{Id: id, DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Second*100).Unix())},
+		}
+	}
+
+	if !retryMessage(newMsg("1"), "", "", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the first failure to be retried")
+	}
+	if retryMessage(newMsg("2"), "", "", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the second failure to be dead-lettered while the first is in the retry pipeline")
+	}
+	result := <-resultChannel
+	if result.Id != "2" || !strings.Contains(result.Payload, "retry pipeline") {
+		t.Errorf("Unexpected error result %+v", result)
+	}
+
+	// The retried request coming back leaves room for another one.
+	retried := (<-retryChannel).EmbelishedRequestMessage
+	opts.DrainMode = true
+	processRequest(context.Background(), nil, retried, retryChannel, resultChannel, opts)
+	<-resultChannel
+	if opts.RetryTracker.Len() != 0 {
+		t.Errorf("Expected the retry pipeline to be empty, got %d", opts.RetryTracker.Len())
+	}
+	if !retryMessage(newMsg("2"), "", "", retryChannel, resultChannel, opts) {
+		t.Errorf("Expected a failure to be retried once the pipeline has room")
+	}
+}
+
+func TestCancelledDispatch(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	newMsg := func() EmbelishedRequestMessage {
+		return EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              "123",
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+	}
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+
+	// On shutdown, the request is neither failed nor retried.
+	before := counterValue(metrics.CancelledDispatches)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	processRequest(ctx, httpclient, newMsg(), retryChannel, resultChannel, WorkerOptions{})
+	if len(resultChannel) != 0 || len(retryChannel) != 0 {
+		t.Errorf("Expected no result nor retry for a dispatch cancelled on shutdown")
+	}
+	if got := counterValue(metrics.CancelledDispatches) - before; got != 1 {
+		t.Errorf("Expected 1 cancelled dispatch, got %v", got)
+	}
+
+	// Once the budget is over, the request is failed as such.
+	processRequest(context.Background(), httpclient, newMsg(), retryChannel, resultChannel,
+		WorkerOptions{TotalBudget: 50 * time.Millisecond})
+	select {
+	case r := <-resultChannel:
+		if !strings.Contains(r.Payload, "request budget exhausted") {
+			t.Errorf("Expected a budget exhausted error, got %s", r.Payload)
+		}
+	default:
+		t.Errorf("Expected an error result")
+	}
+}
+
+func TestRequiredResponseFields(t *testing.T) {
+	required, err := ParseRequiredFields("choices, usage.total_tokens")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	responses := map[string]string{
+		"valid":   `{"choices": [{"text": "hi"}], "usage": {"total_tokens": 3}}`,
+		"error":   `{"error": {"message": "model is loading"}}`,
+		"partial": `{"choices": [], "usage": {}}`,
+		"text":    `not json`,
+	}
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		var payload map[string]any
+		json.NewDecoder(req.Body).Decode(&payload) // nolint:errcheck
+		body := responses[payload["prompt"].(string)]
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	opts := WorkerOptions{RequiredResponseFields: required}
+
+	for prompt := range responses {
+		retryChannel := make(chan RetryMessage, 1)
+		resultChannel := make(chan ResultMessage, 1)
+		msg := EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              prompt,
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": prompt},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+		processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel, opts)
+		if prompt == "valid" {
+			if len(resultChannel) != 1 {
+				t.Errorf("Expected a result for the valid response")
+			}
+		} else if len(retryChannel) != 1 {
+			t.Errorf("Expected the %s response to be retried", prompt)
+		}
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "slow") {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+	})
+	var logged []string
+	logger := funcr.New(func(prefix, args string) { logged = append(logged, args) }, funcr.Options{Verbosity: 10})
+	ctx := log.IntoContext(context.Background(), logger)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		msg := EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              path,
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "food-review"},
+			},
+			InferenceGateway: "http://localhost:30080" + path,
+			HttpHeaders:      map[string]string{},
+		}
+		processRequest(ctx, httpclient, msg, make(chan RetryMessage, 1), make(chan ResultMessage, 1),
+			WorkerOptions{SlowRequestThreshold: 10 * time.Millisecond})
+	}
+
+	var slow []string
+	for _, line := range logged {
+		if strings.Contains(line, `"msg"="Slow request"`) {
+			slow = append(slow, line)
+		}
+	}
+	if len(slow) != 1 || !strings.Contains(slow[0], `"id"="/slow"`) || !strings.Contains(slow[0], `"total"`) {
+		t.Errorf("Expected only the slow request to be logged with its phases, got %v", slow)
+	}
+}
+
+func TestCompressionMinBytes(t *testing.T) {
+	encodings := map[string]string{}
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			var err error
+			if body, err = gzip.NewReader(req.Body); err != nil {
+				t.Errorf("Expected a gzipped body: %v", err)
+			}
+		}
+		var payload map[string]any
+		if err := json.NewDecoder(body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode the request body: %v", err)
+		}
+		encodings[payload["prompt"].(string)[:5]] = req.Header.Get("Content-Encoding")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+	})
+
+	for _, prompt := range []string{"small", "large" + strings.Repeat(" prompt", 100)} {
+		msg := EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              "123",
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": prompt},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+		processRequest(context.Background(), httpclient, msg, make(chan RetryMessage, 1), make(chan ResultMessage, 1),
+			WorkerOptions{CompressionMinBytes: 256})
+	}
+	if encodings["small"] != "" || encodings["large"] != "gzip" {
+		t.Errorf("Expected only the large body to be compressed, got %v", encodings)
+	}
+}
+
+type failingAuditSink struct{}
+
+func (failingAuditSink) Audit(context.Context, AuditRecord) error {
+	return fmt.Errorf("audit trail unavailable")
+}
+
+type channelAuditSink chan AuditRecord
+
+func (s channelAuditSink) Audit(_ context.Context, record AuditRecord) error {
+	s <- record
+	return nil
+}
+
+func TestAuditRecord(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		header.Set("x-gateway-destination-endpoint", "10.0.0.7:8000")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: header}, nil
+	})
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	sink := make(channelAuditSink, 1)
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: "9999999999",
+			Payload:         map[string]any{"model": "food-review"},
+			Metadata:        map[string]string{TenantMetadataKey: "team-a"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+	}
+	processRequest(context.Background(), httpclient, msg, make(chan RetryMessage, 1), make(chan ResultMessage, 1),
+		WorkerOptions{AuditSink: sink, Clock: clock})
+	want := AuditRecord{
+		Time:           time.Unix(1000, 0),
+		RequestId:      "123",
+		Tenant:         "team-a",
+		Model:          "food-review",
+		Endpoint:       "http://localhost:30080/v1/completions",
+		RoutedEndpoint: "10.0.0.7:8000",
+	}
+	if record := <-sink; record != want {
+		t.Errorf("Expected audit record %+v, got %+v", want, record)
+	}
+}
+
+func TestResultServedBy(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		header.Set("x-gateway-destination-endpoint", "10.0.0.7:8000")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: header}, nil
+	})
+	headers, err := ParseServedByHeaders("endpoint=x-gateway-destination-endpoint, pod=x-pod-name")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg := EmbelishedRequestMessage{
+		RequestMessage:   RequestMessage{Id: "123", DeadlineUnixSec: "9999999999", Payload: map[string]any{"model": "food-review"}},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+	}
+	resultChannel := make(chan ResultMessage, 1)
+	processRequest(context.Background(), httpclient, msg, make(chan RetryMessage, 1), resultChannel,
+		WorkerOptions{ServedByHeaders: headers})
+	// The pod isn't told by the response: only the endpoint is stamped.
+	if result := <-resultChannel; !maps.Equal(result.ServedBy, map[string]string{"endpoint": "10.0.0.7:8000"}) {
+		t.Errorf("Expected the result to be stamped with the routed endpoint, got %v", result.ServedBy)
+	}
+
+	if _, err := ParseServedByHeaders("endpoint"); err == nil {
+		t.Errorf("Expected an error for a field without header")
+	}
+}
+
+func TestAuditFailurePolicy(t *testing.T) {
+	dispatched := 0
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		dispatched++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+	})
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+			Payload:         map[string]any{"model": "food-review"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+
+	resultChannel := make(chan ResultMessage, 1)
+	processRequest(context.Background(), httpclient, msg, make(chan RetryMessage, 1), resultChannel,
+		WorkerOptions{AuditSink: failingAuditSink{}})
+	if r := <-resultChannel; dispatched != 1 || r.Payload != "{}" {
+		t.Errorf("Expected the result to be published when failing open, got %s", r.Payload)
+	}
+
+	resultChannel = make(chan ResultMessage, 1)
+	processRequest(context.Background(), httpclient, msg, make(chan RetryMessage, 1), resultChannel,
+		WorkerOptions{AuditSink: failingAuditSink{}, AuditFailClosed: true})
+	if r := <-resultChannel; dispatched != 2 || !strings.Contains(r.Payload, "could not be audited") {
+		t.Errorf("Expected an audit error result instead of the response when failing closed, got %s", r.Payload)
+	}
+}
+
+type memoryResultStore map[string][]byte
+
+func (s memoryResultStore) Store(id string, payload []byte) (string, error) {
+	s[id] = payload
+	return "memory://" + id, nil
+}
+
+func TestMaxResultBytes(t *testing.T) {
+	msg := RequestMessage{Id: "123"}
+	large := []byte(`{"choices": [{"text": "` + strings.Repeat("a", 100) + `"}]}`)
+
+	resultChannel := make(chan ResultMessage, 1)
+	if got := deliverResult(msg, []byte("{}"), nil, resultChannel, WorkerOptions{MaxResultBytes: 128}); got != OutcomeSuccess {
+		t.Errorf("Expected a small result to be published, got %s", got)
+	}
+	if r := <-resultChannel; r.Payload != "{}" {
+		t.Errorf("Unexpected result %+v", r)
+	}
+
+	errorChannel := make(chan ResultMessage, 1)
+	if got := deliverResult(msg, large, nil, resultChannel, WorkerOptions{MaxResultBytes: 128, ErrorResultChannel: errorChannel}); got != OutcomeFailed {
+		t.Errorf("Expected an oversized result to be dead-lettered, got %s", got)
+	}
+	if r := <-errorChannel; !strings.Contains(r.Payload, "exceeds the maximum of 128 bytes") {
+		t.Errorf("Expected an oversized error, got %s", r.Payload)
+	}
+
+	// Under the limit, but not once escaped in the marshaled result.
+	escaped := []byte(`{"text": "` + strings.Repeat("<", 30) + `"}`)
+	if got := deliverResult(msg, escaped, nil, resultChannel, WorkerOptions{MaxResultBytes: 128, ErrorResultChannel: errorChannel}); got != OutcomeFailed {
+		t.Errorf("Expected a result oversized once marshaled to be dead-lettered, got %s", got)
+	}
+	<-errorChannel
+
+	store := memoryResultStore{}
+	if got := deliverResult(msg, large, nil, resultChannel, WorkerOptions{MaxResultBytes: 128, ResultStore: store}); got != OutcomeSuccess {
+		t.Errorf("Expected an oversized result to be stored, got %s", got)
+	}
+	if r := <-resultChannel; r.Payload != "" || r.PayloadRef != "memory://123" || !bytes.Equal(store["123"], large) {
+		t.Errorf("Expected a result referencing the stored payload, got %+v", r)
+	}
+}
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	opts := WorkerOptions{Clock: clock, TotalBudget: time.Minute, RetryTracker: NewRetryTracker(1)}
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	msg := EmbelishedRequestMessage{
+		// Long past on the wall clock, but not on the fake one.
+		RequestMessage: RequestMessage{Id: "123", DeadlineUnixSec: "1100"},
+	}
+
+	if !retryMessage(msg, "", "", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the request to be retried before its deadline")
+	}
+	retried := <-retryChannel
+	if retried.BackoffDurationSeconds > 100 {
+		t.Errorf("Expected the backoff to be bounded by the time to the deadline, got %v", retried.BackoffDurationSeconds)
+	}
+
+	// Past the deadline of the request in the pipeline, it makes room for another one.
+	clock.Advance(200 * time.Second)
+	other := EmbelishedRequestMessage{RequestMessage: RequestMessage{Id: "456", DeadlineUnixSec: "1300"}}
+	if !retryMessage(other, "", "", retryChannel, resultChannel, opts) {
+		t.Fatalf("Expected the expired request to leave the retry pipeline")
+	}
+	<-retryChannel
+
+	other.FirstDequeueMs = clock.Now().UnixMilli()
+	clock.Advance(2 * time.Minute)
+	processRequest(context.Background(), nil, other, retryChannel, resultChannel, opts)
+	result := <-resultChannel
+	if !strings.Contains(result.Payload, "request budget exhausted") {
+		t.Errorf("Expected the budget to be exhausted on the fake clock, got %s", result.Payload)
+	}
+
+	msg.DeadlineUnixSec = "1200"
+	if retryMessage(msg, "", "", retryChannel, resultChannel, opts) {
+		t.Errorf("Expected the request to be failed past its deadline")
+	}
+	result = <-resultChannel
+	if !strings.Contains(result.Payload, "deadline exceeded") {
+		t.Errorf("Expected the deadline to be exceeded on the fake clock, got %s", result.Payload)
+	}
+}
+
+func TestStatusTaxonomy(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		retried    bool
+		expected   string
+	}{
+		{statusCode: http.StatusOK, expected: "response"},
+		{statusCode: http.StatusBadRequest, expected: "response"},
+		{statusCode: http.StatusTooManyRequests, retried: true},
+		{statusCode: http.StatusBadGateway, retried: true},
+		{statusCode: http.StatusProcessing, expected: "unexpected status 102"},
+		{statusCode: http.StatusFound, expected: "unexpected status 302"},
+		{statusCode: http.StatusNotModified, expected: "unexpected status 304"},
+		{statusCode: 600, expected: "unexpected status 600"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.statusCode), func(t *testing.T) {
+			httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: tt.statusCode, Body: io.NopCloser(strings.NewReader("response")), Header: make(http.Header)}, nil
+			})
+			retryChannel := make(chan RetryMessage, 1)
+			resultChannel := make(chan ResultMessage, 1)
+			msg := EmbelishedRequestMessage{
+				RequestMessage: RequestMessage{
+					Id:              "123",
+					DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+					Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+				},
+				InferenceGateway: "http://localhost:30080/v1/completions",
+				HttpHeaders:      map[string]string{},
+			}
+			processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel, WorkerOptions{})
+
+			if tt.retried {
+				if len(retryChannel) != 1 || len(resultChannel) != 0 {
+					t.Errorf("Expected the request to be retried")
+				}
+				return
+			}
+			if len(resultChannel) != 1 {
+				t.Fatalf("Expected a result")
+			}
+			if result := <-resultChannel; !strings.Contains(result.Payload, tt.expected) {
+				t.Errorf("Expected the result to hold %q, got %s", tt.expected, result.Payload)
+			}
+		})
+	}
+}
+
+func TestFailEmptyResponses(t *testing.T) {
+	responses := map[string]string{
+		"full":       `{"choices": [{"text": "hi"}]}`,
+		"empty":      ``,
+		"whitespace": " \n",
+	}
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		var payload map[string]any
+		json.NewDecoder(req.Body).Decode(&payload) // nolint:errcheck
+		body := responses[payload["prompt"].(string)]
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})
+	emptyBefore := counterValue(metrics.EmptyResponses)
+
+	for prompt := range responses {
+		retryChannel := make(chan RetryMessage, 1)
+		resultChannel := make(chan ResultMessage, 1)
+		msg := EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              prompt,
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": prompt},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+		processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel, WorkerOptions{FailEmptyResponses: true})
+		if prompt == "full" {
+			if len(resultChannel) != 1 {
+				t.Errorf("Expected a result for the full response")
+			}
+		} else if len(retryChannel) != 1 {
+			t.Errorf("Expected the %s response to be retried", prompt)
+		}
+	}
+	if got := counterValue(metrics.EmptyResponses) - emptyBefore; got != 2 {
+		t.Errorf("Expected 2 empty responses, got %v", got)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		drainTimeout time.Duration
+		finished     bool
+	}{
+		{drainTimeout: time.Second, finished: true},
+		{drainTimeout: 20 * time.Millisecond, finished: false},
+	} {
+		started := make(chan struct{})
+		httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+			close(started)
+			select {
+			case <-time.After(100 * time.Millisecond):
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"text": "hi"}`)), Header: make(http.Header)}, nil
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		})
+		abandonedBefore := counterValue(metrics.AbandonedReqs)
+		retryChannel := make(chan RetryMessage, 1)
+		resultChannel := make(chan ResultMessage, 1)
+		msg := EmbelishedRequestMessage{
+			RequestMessage: RequestMessage{
+				Id:              "123",
+				DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+				Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+			},
+			InferenceGateway: "http://localhost:30080/v1/completions",
+			HttpHeaders:      map[string]string{},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			processRequest(ctx, httpclient, msg, retryChannel, resultChannel, WorkerOptions{DrainTimeout: tc.drainTimeout})
+			close(done)
+		}()
+		<-started
+		// Shutting down while the request is in flight.
+		cancel()
+		<-done
+
+		abandoned := counterValue(metrics.AbandonedReqs) - abandonedBefore
+		if tc.finished && (len(resultChannel) != 1 || abandoned != 0) {
+			t.Errorf("Expected the request to be finished within a drain timeout of %s", tc.drainTimeout)
+		}
+		if !tc.finished && (len(resultChannel) != 0 || len(retryChannel) != 0 || abandoned != 1) {
+			t.Errorf("Expected the request to be abandoned after a drain timeout of %s", tc.drainTimeout)
+		}
+	}
+}
+
+func TestWorkerGauges(t *testing.T) {
+	waitFor := func(what string, condition func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	activeBefore, idleBefore := gaugeValue(metrics.ActiveWorkers), gaugeValue(metrics.IdleWorkers)
+	release := make(chan struct{})
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		<-release
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{}`)), Header: make(http.Header)}, nil
+	})
+	requestChannel := make(chan EmbelishedRequestMessage)
+	resultChannel := make(chan ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Worker(ctx, Characteristics{}, httpclient, requestChannel, make(chan RetryMessage, 1), resultChannel, WorkerOptions{})
+		close(done)
+	}()
+	waitFor("an idle worker", func() bool { return gaugeValue(metrics.IdleWorkers)-idleBefore == 1 })
+
+	requestChannel <- EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+			Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+	}
+	waitFor("an active worker", func() bool {
+		return gaugeValue(metrics.ActiveWorkers)-activeBefore == 1 && gaugeValue(metrics.IdleWorkers)-idleBefore == 0
+	})
+
+	close(release)
+	<-resultChannel
+	waitFor("the worker to be idle again", func() bool {
+		return gaugeValue(metrics.ActiveWorkers)-activeBefore == 0 && gaugeValue(metrics.IdleWorkers)-idleBefore == 1
+	})
+	cancel()
+	<-done
+	if got := gaugeValue(metrics.IdleWorkers) - idleBefore; got != 0 {
+		t.Errorf("Expected a finished worker not to count as idle, got %v", got)
+	}
+}
+
+func TestWorker_closedRequestChannel(t *testing.T) {
+	requestChannel := make(chan EmbelishedRequestMessage)
+	resultChannel := make(chan ResultMessage, 1)
+	done := make(chan struct{})
+	go func() {
+		Worker(context.Background(), Characteristics{}, nil, requestChannel, make(chan RetryMessage, 1), resultChannel,
+			WorkerOptions{InFlight: make(chan struct{}, 1)})
+		close(done)
+	}()
+	close(requestChannel)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the worker to finish once its request channel is closed")
+	}
+	if len(resultChannel) != 0 {
+		t.Errorf("Expected no result for a closed request channel, got %+v", <-resultChannel)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		// A hanging model server.
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	timeoutsBefore := counterValue(metrics.RequestTimeouts)
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 1)
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()),
+			Payload:         map[string]any{"model": "food-review", "prompt": "hi"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+	processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel,
+		WorkerOptions{RequestTimeout: 20 * time.Millisecond})
+
+	if len(retryChannel) != 1 || len(resultChannel) != 0 {
+		t.Fatalf("Expected the timed out request to be retried")
+	}
+	if retried := <-retryChannel; retried.RetryCount != 1 {
+		t.Errorf("Expected the retry count to be 1, got %d", retried.RetryCount)
+	}
+	if got := counterValue(metrics.RequestTimeouts) - timeoutsBefore; got != 1 {
+		t.Errorf("Expected 1 request timeout, got %v", got)
+	}
+
+	// The request may have been executed: not retried unless idempotent, and recorded like any other outcome.
+	sink := make(channelSink, 1)
+	processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel,
+		WorkerOptions{RequestTimeout: 20 * time.Millisecond, RetryOnlyIdempotent: true, OutcomeSink: sink})
+	if len(retryChannel) != 0 || len(resultChannel) != 1 {
+		t.Fatalf("Expected the timed out request not to be retried")
+	}
+	if result := <-resultChannel; !strings.Contains(result.Payload, "not idempotent") {
+		t.Errorf("Expected a not idempotent error, got %s", result.Payload)
+	}
+	if outcome := <-sink; outcome.Result != OutcomeFailed {
+		t.Errorf("Expected the timeout to be recorded as failed, got %v", outcome.Result)
+	}
+}
+
+func TestTenantRateLimit_throttledRequestIsHeld(t *testing.T) {
+	dispatched := 0
+	httpclient := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		dispatched++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{}`)), Header: make(http.Header)}, nil
+	})
+	// A request every 50ms for the tenant.
+	opts := WorkerOptions{TenantRateLimiter: NewTenantRateLimiter(20, nil, 1)}
+	retryChannel := make(chan RetryMessage, 1)
+	resultChannel := make(chan ResultMessage, 2)
+	msg := EmbelishedRequestMessage{
+		RequestMessage: RequestMessage{
+			Id:              "123",
+			DeadlineUnixSec: "9999999999",
+			Payload:         map[string]any{"model": "food-review"},
+			Metadata:        map[string]string{TenantMetadataKey: "team-a"},
+		},
+		InferenceGateway: "http://localhost:30080/v1/completions",
+		HttpHeaders:      map[string]string{},
+	}
+	start := time.Now()
+	processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel, opts)
+	processRequest(context.Background(), httpclient, msg, retryChannel, resultChannel, opts)
+
+	if dispatched != 2 || len(resultChannel) != 2 {
+		t.Fatalf("Expected both requests to be dispatched, got %d dispatches", dispatched)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected the throttled request to be held until the tenant's turn, dispatched after %v", elapsed)
+	}
+	if len(retryChannel) != 0 {
+		t.Errorf("Expected the throttled request not to be sent back to the retry queue, got %+v", <-retryChannel)
+	}
+
+	// Held when the worker is told to finish, it is left to the message queue.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	processRequest(ctx, httpclient, msg, retryChannel, resultChannel, opts)
+	if dispatched != 2 || len(resultChannel) != 2 || len(retryChannel) != 0 {
+		t.Errorf("Expected the held request to be abandoned on shutdown, got %d dispatches", dispatched)
+	}
+}
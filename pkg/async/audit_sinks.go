@@ -0,0 +1,76 @@
+package async
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+// FileAuditSink appends the audit records as JSON lines to a file.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+func (s *FileAuditSink) Audit(_ context.Context, record api.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(line)
+	return err
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// WebhookAuditSink posts every audit record as JSON to a URL. Any status other than 2xx is an audit failure.
+type WebhookAuditSink struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewWebhookAuditSink(url string, httpClient *http.Client) *WebhookAuditSink {
+	return &WebhookAuditSink{url: url, httpClient: httpClient}
+}
+
+func (s *WebhookAuditSink) Audit(ctx context.Context, record api.AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close() // nolint:errcheck
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook answered with status %d", response.StatusCode)
+	}
+	return nil
+}
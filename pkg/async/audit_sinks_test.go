@@ -0,0 +1,71 @@
+package async
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := sink.Audit(context.Background(), api.AuditRecord{RequestId: id, Tenant: "team-a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record api.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, record.RequestId)
+	}
+	if len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Errorf("Expected the records of requests 1 and 2, got %v", ids)
+	}
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	var received api.AuditRecord
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received) // nolint:errcheck
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookAuditSink(server.URL, server.Client())
+	if err := sink.Audit(context.Background(), api.AuditRecord{RequestId: "123", Endpoint: "http://gateway"}); err != nil {
+		t.Fatal(err)
+	}
+	if received.RequestId != "123" || received.Endpoint != "http://gateway" {
+		t.Errorf("Unexpected audit record %+v", received)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.Audit(context.Background(), api.AuditRecord{RequestId: "123"}); err == nil {
+		t.Errorf("Expected an error when the webhook fails")
+	}
+}
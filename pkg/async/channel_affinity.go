@@ -0,0 +1,36 @@
+package async
+
+import (
+	"sync/atomic"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+)
+
+// BindWorkersToChannels bypasses the merge policy: every request channel is drained by its own group of
+// workersPerChannel workers instead of all the workers draining one merged channel. With a single worker per channel,
+// the requests of a channel (e.g. a partition of the message queue) are dispatched one at a time, in the order they were
+// received. Returns the channel of each worker, the workers of a channel being next to each other. The channel of the
+// workers is closed once their request channel is, which finishes them.
+//
+// Note: as with PartitionByOrderingKey, ordering is only guaranteed for the first attempt.
+func BindWorkersToChannels(channels []api.RequestChannel, workersPerChannel int) []chan api.EmbelishedRequestMessage {
+	var remaining atomic.Int64
+	remaining.Store(int64(len(channels)))
+	metrics.MergeInputChannels.Set(float64(len(channels)))
+	workerChannels := make([]chan api.EmbelishedRequestMessage, 0, len(channels)*workersPerChannel)
+	for _, channel := range channels {
+		boundChannel := make(chan api.EmbelishedRequestMessage)
+		go func() {
+			for rm := range channel.Channel {
+				handOver(boundChannel, embellish(rm, channel))
+			}
+			close(boundChannel)
+			metrics.MergeInputChannels.Set(float64(remaining.Add(-1)))
+		}()
+		for range workersPerChannel {
+			workerChannels = append(workerChannels, boundChannel)
+		}
+	}
+	return workerChannels
+}
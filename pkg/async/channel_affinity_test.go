@@ -0,0 +1,92 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBindWorkersToChannels(t *testing.T) {
+	msgsPerChannel := 10
+	channels := []api.RequestChannel{
+		{Channel: make(chan api.RequestMessage), Metadata: map[string]any{"inference-gateway": "http://a"}},
+		{Channel: make(chan api.RequestMessage), Metadata: map[string]any{"inference-gateway": "http://b"}},
+	}
+	workerChannels := BindWorkersToChannels(channels, 2)
+	if len(workerChannels) != 4 {
+		t.Fatalf("Expected 4 worker channels, got %d", len(workerChannels))
+	}
+	if workerChannels[0] != workerChannels[1] || workerChannels[2] != workerChannels[3] || workerChannels[0] == workerChannels[2] {
+		t.Fatalf("Expected the workers of a request channel to share it, and only them")
+	}
+
+	for c, ch := range channels {
+		go func() {
+			for i := range msgsPerChannel {
+				ch.Channel <- api.RequestMessage{Id: fmt.Sprintf("%d-%d", c, i)}
+			}
+			close(ch.Channel)
+		}()
+	}
+	for c, gateway := range []string{"http://a", "http://b"} {
+		// A single reader per channel gets the requests in order.
+		i := 0
+		for msg := range workerChannels[2*c] {
+			if expected := fmt.Sprintf("%d-%d", c, i); msg.Id != expected {
+				t.Errorf("Expected request %s, got %s", expected, msg.Id)
+			}
+			if msg.InferenceGateway != gateway {
+				t.Errorf("Expected request %s for %s, got %s", msg.Id, gateway, msg.InferenceGateway)
+			}
+			i++
+		}
+		if i != msgsPerChannel {
+			t.Errorf("Expected %d requests from channel %d, got %d", msgsPerChannel, c, i)
+		}
+	}
+
+	// Both channels are closed: none is left to drain.
+	deadline := time.Now().Add(time.Second)
+	for {
+		var m dto.Metric
+		metrics.MergeInputChannels.Write(&m) // nolint:errcheck
+		if m.GetGauge().GetValue() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no input channel left, got %v", m.GetGauge().GetValue())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBindWorkersToChannels_closedChannelStopsWorkers(t *testing.T) {
+	channel := api.RequestChannel{Channel: make(chan api.RequestMessage), Metadata: map[string]any{}}
+	workerChannels := BindWorkersToChannels([]api.RequestChannel{channel}, 2)
+	resultChannel := make(chan api.ResultMessage, 1)
+	done := make(chan struct{}, len(workerChannels))
+	for _, ch := range workerChannels {
+		go func() {
+			api.Worker(context.Background(), api.Characteristics{}, nil, ch, make(chan api.RetryMessage, 1), resultChannel,
+				api.WorkerOptions{})
+			done <- struct{}{}
+		}()
+	}
+
+	close(channel.Channel)
+	for range workerChannels {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the workers bound to a closed channel to finish")
+		}
+	}
+	if len(resultChannel) != 0 {
+		t.Errorf("Expected no result once the channel is closed, got %+v", <-resultChannel)
+	}
+}
@@ -0,0 +1,337 @@
+package async
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// fallbackFlowMetadataKey tags every request with the index of the flow it came from.
+const fallbackFlowMetadataKey = "fallback-flow"
+
+// fallbackRouteBufferSize is the least number of messages buffered for each flow, so that a flow that is down doesn't
+// hold back the other one right away.
+const fallbackRouteBufferSize = 100
+
+// FallbackFlow combines a primary and a secondary Flow. Requests are consumed from the active flow only: the primary
+// while it is healthy, the secondary while the primary is not. Flows implementing api.HealthCheckFlow are checked every
+// checkInterval, the others are always considered healthy. Results, retries and dead letters always go back to the flow
+// their request came from: only that flow can acknowledge the request. Each flow is fed by its own route worker, so a
+// flow that is down holds back its own messages only, until its buffers are full.
+type FallbackFlow struct {
+	flows         [2]api.Flow
+	routes        [2]fallbackRoute
+	checkInterval time.Duration
+
+	mu       sync.Mutex
+	active   int
+	switched chan struct{} // closed when the active flow changes
+
+	requestChannels []api.RequestChannel
+	retryChannel    chan api.RetryMessage
+	resultChannel   chan api.ResultMessage
+	errorChannel    chan api.ResultMessage
+	deadLetters     chan api.ResultMessage
+}
+
+// fallbackRoute buffers the messages going back to one of the flows.
+type fallbackRoute struct {
+	retries     chan api.RetryMessage
+	results     chan api.ResultMessage
+	errors      chan api.ResultMessage
+	deadLetters chan api.ResultMessage
+}
+
+func NewFallbackFlow(primary, secondary api.Flow, checkInterval time.Duration) *FallbackFlow {
+	f := &FallbackFlow{
+		flows:         [2]api.Flow{primary, secondary},
+		checkInterval: checkInterval,
+		switched:      make(chan struct{}),
+		retryChannel:  make(chan api.RetryMessage),
+		resultChannel: api.NewResultChannel(),
+	}
+	for i, flow := range f.flows {
+		size := max(*api.ResultBufferSize, fallbackRouteBufferSize)
+		f.routes[i] = fallbackRoute{
+			retries:     make(chan api.RetryMessage, size),
+			results:     make(chan api.ResultMessage, size),
+			errors:      make(chan api.ResultMessage, size),
+			deadLetters: make(chan api.ResultMessage, size),
+		}
+		for _, ch := range flow.RequestChannels() {
+			f.requestChannels = append(f.requestChannels, api.RequestChannel{
+				Channel:  make(chan api.RequestMessage),
+				Metadata: ch.Metadata,
+			})
+		}
+		if errorChannel(flow) != nil {
+			f.errorChannel = api.NewErrorResultChannel()
+		}
+		if deadLetterChannel(flow) != nil {
+			f.deadLetters = api.NewErrorResultChannel()
+		}
+	}
+	return f
+}
+
+func (f *FallbackFlow) Characteristics() api.Characteristics {
+	characteristics := f.flows[0].Characteristics()
+	characteristics.AcksOnResult = characteristics.AcksOnResult || f.flows[1].Characteristics().AcksOnResult
+	return characteristics
+}
+
+func (f *FallbackFlow) RequestChannels() []api.RequestChannel {
+	return f.requestChannels
+}
+
+func (f *FallbackFlow) RetryChannel() chan api.RetryMessage {
+	return f.retryChannel
+}
+
+func (f *FallbackFlow) ResultChannel() chan api.ResultMessage {
+	return f.resultChannel
+}
+
+func (f *FallbackFlow) ErrorResultChannel() chan api.ResultMessage {
+	return f.errorChannel
+}
+
+func (f *FallbackFlow) DeadLetterChannel() chan api.ResultMessage {
+	return f.deadLetters
+}
+
+// Healthy reports the composite healthy as long as one of its flows is.
+func (f *FallbackFlow) Healthy(ctx context.Context) error {
+	var err error
+	for _, flow := range f.flows {
+		if err = checkHealth(ctx, flow); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// PendingResults counts the results routed to the flows and not published by them yet.
+func (f *FallbackFlow) PendingResults() int {
+	pending := 0
+	for i, flow := range f.flows {
+		route := &f.routes[i]
+		pending += len(route.results) + len(route.errors) + len(route.deadLetters) + len(flow.ResultChannel())
+		if ch := errorChannel(flow); ch != nil {
+			pending += len(ch)
+		}
+		if ch := deadLetterChannel(flow); ch != nil {
+			pending += len(ch)
+		}
+		if pendingResultsFlow, ok := flow.(api.PendingResultsFlow); ok {
+			pending += pendingResultsFlow.PendingResults()
+		}
+	}
+	return pending
+}
+
+func (f *FallbackFlow) Start(ctx context.Context) {
+	for _, flow := range f.flows {
+		flow.Start(ctx)
+	}
+
+	next := 0
+	for i, flow := range f.flows {
+		for _, ch := range flow.RequestChannels() {
+			go f.tagRequests(api.ConsumeContext(ctx), ch.Channel, f.requestChannels[next].Channel, i)
+			next++
+		}
+		go f.routeWorker(ctx, i)
+	}
+
+	go f.dispatchWorker(ctx)
+	go f.healthWorker(ctx)
+}
+
+// activeFlow returns the index of the flow requests are consumed from, and a channel closed once it changes.
+func (f *FallbackFlow) activeFlow() (int, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.switched
+}
+
+// activate makes requests be consumed from the given flow, reporting whether it wasn't active already.
+func (f *FallbackFlow) activate(flow int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == flow {
+		return false
+	}
+	f.active = flow
+	close(f.switched)
+	f.switched = make(chan struct{})
+	return true
+}
+
+// healthWorker activates the primary flow while it is healthy, the secondary one while only it is healthy. When both
+// are unhealthy the active flow is kept.
+func (f *FallbackFlow) healthWorker(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("fallback-flow")
+	ticker := time.NewTicker(f.checkInterval)
+	defer ticker.Stop()
+	for {
+		var errs [2]error
+		for i, flow := range f.flows {
+			checkCtx, cancel := context.WithTimeout(ctx, f.checkInterval)
+			errs[i] = checkHealth(checkCtx, flow)
+			cancel()
+		}
+		switch {
+		case errs[0] == nil:
+			if f.activate(0) {
+				logger.V(logutil.DEFAULT).Info("Primary message queue is healthy again, consuming from it")
+			}
+		case errs[1] == nil:
+			if f.activate(1) {
+				logger.V(logutil.DEFAULT).Error(errs[0], "Primary message queue is unhealthy, falling back to the secondary one")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tagRequests forwards the requests of a flow while it is the active one, tagged with the index of the flow.
+func (f *FallbackFlow) tagRequests(ctx context.Context, from, to chan api.RequestMessage, flow int) {
+	for {
+		active, switched := f.activeFlow()
+		if active != flow {
+			select {
+			case <-ctx.Done():
+				return
+			case <-switched:
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-switched:
+		case msg, ok := <-from:
+			if !ok {
+				close(to)
+				return
+			}
+			msg.Metadata = maps.Clone(msg.Metadata)
+			if msg.Metadata == nil {
+				msg.Metadata = map[string]string{}
+			}
+			msg.Metadata[fallbackFlowMetadataKey] = strconv.Itoa(flow)
+			select {
+			case to <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// dispatchWorker hands the messages to the route of the flow their request came from, without the tag added to it.
+func (f *FallbackFlow) dispatchWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-f.retryChannel:
+			var route *fallbackRoute
+			route, msg.RequestMessage.Metadata = f.route(msg.RequestMessage.Metadata)
+			sendOrDone(ctx, route.retries, msg)
+		case msg := <-f.resultChannel:
+			var route *fallbackRoute
+			route, msg.Metadata = f.route(msg.Metadata)
+			sendOrDone(ctx, route.results, msg)
+		case msg := <-f.errorChannel:
+			var route *fallbackRoute
+			route, msg.Metadata = f.route(msg.Metadata)
+			sendOrDone(ctx, route.errors, msg)
+		case msg := <-f.deadLetters:
+			var route *fallbackRoute
+			route, msg.Metadata = f.route(msg.Metadata)
+			sendOrDone(ctx, route.deadLetters, msg)
+		}
+	}
+}
+
+// routeWorker publishes the messages routed to one of the flows.
+func (f *FallbackFlow) routeWorker(ctx context.Context, i int) {
+	flow, route := f.flows[i], &f.routes[i]
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-route.retries:
+			sendOrDone(ctx, flow.RetryChannel(), msg)
+		case msg := <-route.results:
+			sendOrDone(ctx, flow.ResultChannel(), msg)
+		case msg := <-route.errors:
+			if ch := errorChannel(flow); ch != nil {
+				sendOrDone(ctx, ch, msg)
+			} else {
+				sendOrDone(ctx, flow.ResultChannel(), msg)
+			}
+		case msg := <-route.deadLetters:
+			if ch := deadLetterChannel(flow); ch != nil {
+				sendOrDone(ctx, ch, msg)
+			} else if ch := errorChannel(flow); ch != nil {
+				sendOrDone(ctx, ch, msg)
+			} else {
+				sendOrDone(ctx, flow.ResultChannel(), msg)
+			}
+		}
+	}
+}
+
+// route returns the route of the flow a request came from, and its metadata without the tag.
+func (f *FallbackFlow) route(metadata map[string]string) (*fallbackRoute, map[string]string) {
+	origin, err := strconv.Atoi(metadata[fallbackFlowMetadataKey])
+	if err != nil || origin < 0 || origin > 1 {
+		origin = 0
+	}
+	if _, ok := metadata[fallbackFlowMetadataKey]; ok {
+		metadata = maps.Clone(metadata)
+		delete(metadata, fallbackFlowMetadataKey)
+	}
+	return &f.routes[origin], metadata
+}
+
+func sendOrDone[T any](ctx context.Context, ch chan T, msg T) {
+	select {
+	case ch <- msg:
+	case <-ctx.Done():
+	}
+}
+
+func checkHealth(ctx context.Context, flow api.Flow) error {
+	if healthCheckFlow, ok := flow.(api.HealthCheckFlow); ok {
+		return healthCheckFlow.Healthy(ctx)
+	}
+	return nil
+}
+
+func errorChannel(flow api.Flow) chan api.ResultMessage {
+	if errorResultFlow, ok := flow.(api.ErrorResultFlow); ok {
+		return errorResultFlow.ErrorResultChannel()
+	}
+	return nil
+}
+
+func deadLetterChannel(flow api.Flow) chan api.ResultMessage {
+	if deadLetterFlow, ok := flow.(api.DeadLetterFlow); ok {
+		return deadLetterFlow.DeadLetterChannel()
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+type fakeFlow struct {
+	requestChannel chan api.RequestMessage
+	retryChannel   chan api.RetryMessage
+	resultChannel  chan api.ResultMessage
+	down           atomic.Bool
+}
+
+func newFakeFlow() *fakeFlow {
+	return &fakeFlow{
+		requestChannel: make(chan api.RequestMessage, 1),
+		retryChannel:   make(chan api.RetryMessage, 1),
+		resultChannel:  make(chan api.ResultMessage, 1),
+	}
+}
+
+func (f *fakeFlow) Characteristics() api.Characteristics { return api.Characteristics{} }
+func (f *fakeFlow) Start(ctx context.Context)            {}
+func (f *fakeFlow) RequestChannels() []api.RequestChannel {
+	return []api.RequestChannel{{Channel: f.requestChannel, Metadata: map[string]any{}}}
+}
+func (f *fakeFlow) RetryChannel() chan api.RetryMessage   { return f.retryChannel }
+func (f *fakeFlow) ResultChannel() chan api.ResultMessage { return f.resultChannel }
+func (f *fakeFlow) Healthy(ctx context.Context) error {
+	if f.down.Load() {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func receiveFallbackRequest(t *testing.T, ch chan api.EmbelishedRequestMessage) api.EmbelishedRequestMessage {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a request")
+		return api.EmbelishedRequestMessage{}
+	}
+}
+
+func TestFallbackFlow(t *testing.T) {
+	primary, secondary := newFakeFlow(), newFakeFlow()
+	flow := NewFallbackFlow(primary, secondary, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow.Start(ctx)
+
+	// Only the primary flow is consumed while it is healthy.
+	mergedChannel := NewRandomRobinPolicy().MergeRequestChannels(flow.RequestChannels()).Channel
+	secondary.requestChannel <- api.RequestMessage{Id: "from-secondary", Metadata: map[string]string{"receipt": "r"}}
+	primary.requestChannel <- api.RequestMessage{Id: "from-primary"}
+	if msg := receiveFallbackRequest(t, mergedChannel); msg.Id != "from-primary" {
+		t.Fatalf("Expected the request of the primary flow, got %s", msg.Id)
+	}
+	select {
+	case msg := <-mergedChannel:
+		t.Fatalf("Expected the secondary flow not to be consumed while the primary is healthy, got %s", msg.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The primary goes down: requests are consumed from the secondary.
+	primary.down.Store(true)
+	msg := receiveFallbackRequest(t, mergedChannel)
+	if msg.Id != "from-secondary" {
+		t.Fatalf("Expected the request of the secondary flow, got %s", msg.Id)
+	}
+
+	// The result goes back to the flow of the request, without the tag of the fallback flow.
+	flow.ResultChannel() <- api.ResultMessage{Id: msg.Id, Metadata: msg.Metadata}
+	select {
+	case result := <-secondary.resultChannel:
+		if _, ok := result.Metadata[fallbackFlowMetadataKey]; ok || result.Metadata["receipt"] != "r" {
+			t.Errorf("Expected the metadata of the request only, got %v", result.Metadata)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the result on the secondary flow")
+	}
+
+	// Even when that flow is down: only it can acknowledge the request.
+	secondary.down.Store(true)
+	flow.ResultChannel() <- api.ResultMessage{Id: msg.Id, Metadata: msg.Metadata}
+	select {
+	case <-primary.resultChannel:
+		t.Errorf("Expected the result not to go to the primary flow")
+	case <-secondary.resultChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the result on the secondary flow")
+	}
+}
+
+func TestFallbackFlow_primaryRecovers(t *testing.T) {
+	primary, secondary := newFakeFlow(), newFakeFlow()
+	primary.down.Store(true)
+	flow := NewFallbackFlow(primary, secondary, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow.Start(ctx)
+
+	mergedChannel := NewRandomRobinPolicy().MergeRequestChannels(flow.RequestChannels()).Channel
+	secondary.requestChannel <- api.RequestMessage{Id: "from-secondary"}
+	if msg := receiveFallbackRequest(t, mergedChannel); msg.Id != "from-secondary" {
+		t.Fatalf("Expected the request of the secondary flow, got %s", msg.Id)
+	}
+
+	// Back up, the primary is consumed again, and the secondary isn't anymore.
+	primary.down.Store(false)
+	primary.requestChannel <- api.RequestMessage{Id: "from-primary"}
+	if msg := receiveFallbackRequest(t, mergedChannel); msg.Id != "from-primary" {
+		t.Fatalf("Expected the request of the primary flow, got %s", msg.Id)
+	}
+	secondary.requestChannel <- api.RequestMessage{Id: "from-secondary"}
+	select {
+	case msg := <-mergedChannel:
+		t.Fatalf("Expected the secondary flow not to be consumed once the primary is healthy again, got %s", msg.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFallbackFlow_blockedFlow(t *testing.T) {
+	primary, secondary := newFakeFlow(), newFakeFlow()
+	flow := NewFallbackFlow(primary, secondary, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow.Start(ctx)
+
+	// The secondary flow doesn't consume its results: the results of the primary flow still go through.
+	for i := range 3 {
+		flow.ResultChannel() <- api.ResultMessage{Id: strconv.Itoa(i), Metadata: map[string]string{fallbackFlowMetadataKey: "1"}}
+	}
+	flow.ResultChannel() <- api.ResultMessage{Id: "primary", Metadata: map[string]string{fallbackFlowMetadataKey: "0"}}
+	select {
+	case result := <-primary.resultChannel:
+		if result.Id != "primary" {
+			t.Errorf("Expected the result of the primary flow, got %s", result.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the result on the primary flow")
+	}
+}
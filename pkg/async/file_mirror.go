@@ -0,0 +1,114 @@
+package async
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// FileMirror is a Mirror writing a sample of the request/response pairs as JSON lines to files in a local directory.
+// The current file is rotated once it grows over maxFileSize bytes or gets older than maxFileAge.
+type FileMirror struct {
+	dir         string
+	sampleRate  float64
+	maxFileSize int64
+	maxFileAge  time.Duration
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+type mirrorRecord struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Request   api.RequestMessage `json:"request"`
+	Response  json.RawMessage    `json:"response"`
+}
+
+// NewFileMirror creates the directory if needed. sampleRate is the fraction of the requests to record, between 0
+// and 1. A zero maxFileSize or maxFileAge disables the respective rotation.
+func NewFileMirror(dir string, sampleRate float64, maxFileSize int64, maxFileAge time.Duration) (*FileMirror, error) {
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("mirror sample rate must be between 0 and 1, got %v", sampleRate)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mirror directory: %w", err)
+	}
+	return &FileMirror{
+		dir:         dir,
+		sampleRate:  sampleRate,
+		maxFileSize: maxFileSize,
+		maxFileAge:  maxFileAge,
+	}, nil
+}
+
+func (m *FileMirror) Record(request api.RequestMessage, response []byte) {
+	if rand.Float64() >= m.sampleRate {
+		return
+	}
+	record := mirrorRecord{Timestamp: time.Now(), Request: request, Response: response}
+	if !json.Valid(response) {
+		// keep the line valid JSON even if the model server didn't answer with JSON
+		record.Response, _ = json.Marshal(string(response))
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Log.WithName("file-mirror").V(logutil.DEFAULT).Error(err, "Failed to marshal mirror record", "id", request.Id)
+		return
+	}
+	line = append(line, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.rotateIfNeeded(record.Timestamp); err != nil {
+		log.Log.WithName("file-mirror").V(logutil.DEFAULT).Error(err, "Failed to open mirror file")
+		return
+	}
+	n, err := m.file.Write(line)
+	m.size += int64(n)
+	if err != nil {
+		log.Log.WithName("file-mirror").V(logutil.DEFAULT).Error(err, "Failed to write mirror record", "id", request.Id)
+	}
+}
+
+func (m *FileMirror) rotateIfNeeded(now time.Time) error {
+	if m.file != nil {
+		tooBig := m.maxFileSize > 0 && m.size >= m.maxFileSize
+		tooOld := m.maxFileAge > 0 && now.Sub(m.openedAt) >= m.maxFileAge
+		if !tooBig && !tooOld {
+			return nil
+		}
+		m.file.Close() // nolint:errcheck
+		m.file = nil
+	}
+	name := filepath.Join(m.dir, fmt.Sprintf("mirror-%s.jsonl", now.UTC().Format("20060102T150405.000000000")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	m.file = file
+	m.size = 0
+	m.openedAt = now
+	return nil
+}
+
+// Close closes the current file.
+func (m *FileMirror) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
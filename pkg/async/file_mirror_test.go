@@ -0,0 +1,55 @@
+package async
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+func TestFileMirror_rotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	mirror, err := NewFileMirror(dir, 1, 1, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mirror.Record(api.RequestMessage{Id: "1", Payload: map[string]any{"prompt": "hi"}}, []byte(`{"text": "hello"}`))
+	mirror.Record(api.RequestMessage{Id: "2"}, []byte("not json"))
+	mirror.Close() // nolint:errcheck
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mirror-*.jsonl"))
+	if len(files) != 2 {
+		t.Fatalf("Expected every record to rotate the file, got %d files", len(files))
+	}
+	f, _ := os.Open(files[0])
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatalf("Expected a record in %s", files[0])
+	}
+	var record map[string]any
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatalf("Expected the record to be valid JSON: %v", err)
+	}
+	if record["response"].(map[string]any)["text"] != "hello" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestFileMirror_sampleRate(t *testing.T) {
+	dir := t.TempDir()
+	mirror, err := NewFileMirror(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for range 10 {
+		mirror.Record(api.RequestMessage{Id: "1"}, []byte("{}"))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 0 {
+		t.Errorf("Expected no record with a zero sample rate, got %d files", len(files))
+	}
+}
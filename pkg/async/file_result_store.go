@@ -0,0 +1,32 @@
+package async
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileResultStore is a ResultStore writing each response to its own file in a directory, typically a volume shared
+// with the consumers of the results. The reference is the path of the file.
+type FileResultStore struct {
+	dir string
+}
+
+// NewFileResultStore creates the directory if needed.
+func NewFileResultStore(dir string) (*FileResultStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create result store directory: %w", err)
+	}
+	return &FileResultStore{dir: dir}, nil
+}
+
+func (s *FileResultStore) Store(id string, payload []byte) (string, error) {
+	// A request may be answered more than once, each answer gets its own file.
+	name := filepath.Join(s.dir, fmt.Sprintf("%s-%d.json", url.PathEscape(id), time.Now().UnixNano()))
+	if err := os.WriteFile(name, payload, 0o644); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,26 @@
+package async
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileResultStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "results")
+	store, err := NewFileResultStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := store.Store("a/b", []byte(`{"choices": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(ref) != dir {
+		t.Errorf("Expected the payload to be stored in %s, got %s", dir, ref)
+	}
+	payload, err := os.ReadFile(ref)
+	if err != nil || string(payload) != `{"choices": []}` {
+		t.Errorf("Expected the stored payload, got %q (%v)", payload, err)
+	}
+}
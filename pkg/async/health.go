@@ -0,0 +1,48 @@
+package async
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+// HealthHandler serves the liveness (/healthz) and readiness (/readyz) probes of the processor. It is live as long as
+// it answers, and ready once marked so, e.g. after the flow is started, for as long as the message queue is reachable
+// (for flows implementing api.HealthCheckFlow).
+type HealthHandler struct {
+	flow  api.Flow
+	ready atomic.Bool
+	mux   *http.ServeMux
+}
+
+func NewHealthHandler(flow api.Flow) *HealthHandler {
+	h := &HealthHandler{flow: flow, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok") // nolint:errcheck
+	})
+	h.mux.HandleFunc("/readyz", h.readyz)
+	return h
+}
+
+// SetReady marks the processor ready, or not ready, e.g. when shutting down.
+func (h *HealthHandler) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *HealthHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	if err := checkHealth(r.Context(), h.flow); err != nil {
+		http.Error(w, fmt.Sprintf("message queue unhealthy: %s", err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok") // nolint:errcheck
+}
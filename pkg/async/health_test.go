@@ -0,0 +1,35 @@
+package async
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	flow := newFakeFlow()
+	handler := NewHealthHandler(flow)
+	status := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	if got := status("/healthz"); got != http.StatusOK {
+		t.Errorf("Expected to be live, got %d", got)
+	}
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected not to be ready before being started, got %d", got)
+	}
+	handler.SetReady(true)
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("Expected to be ready, got %d", got)
+	}
+	flow.down.Store(true)
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected not to be ready with the message queue down, got %d", got)
+	}
+	if got := status("/healthz"); got != http.StatusOK {
+		t.Errorf("Expected to be live with the message queue down, got %d", got)
+	}
+}
@@ -0,0 +1,85 @@
+package async
+
+import (
+	"context"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+// inMemoryBufferSize is how many requests and results the in-memory flow holds before Enqueue blocks, or the workers
+// block on results nobody reads.
+const inMemoryBufferSize = 1024
+
+// InMemoryMQFlow is a Flow entirely in the process, for tests to drive the workers and the merge policies without any
+// message queue: requests are enqueued with Enqueue, results are read from Results. Retries wait for their backoff
+// before being enqueued again.
+type InMemoryMQFlow struct {
+	requestChannel chan api.RequestMessage
+	retryChannel   chan api.RetryMessage
+	resultChannel  chan api.ResultMessage
+	metadata       map[string]any
+}
+
+func NewInMemoryMQFlow() *InMemoryMQFlow {
+	return &InMemoryMQFlow{
+		requestChannel: make(chan api.RequestMessage, inMemoryBufferSize),
+		retryChannel:   make(chan api.RetryMessage),
+		resultChannel:  make(chan api.ResultMessage, inMemoryBufferSize),
+		metadata: map[string]any{
+			"inference-gateway":   "http://localhost:30080/v1/completions",
+			"inference-objective": "",
+		},
+	}
+}
+
+// Enqueue adds a request, as if published to a message queue.
+func (f *InMemoryMQFlow) Enqueue(req api.RequestMessage) {
+	f.requestChannel <- req
+}
+
+// Results returns the channel the results of the requests, errors included, are published to.
+func (f *InMemoryMQFlow) Results() <-chan api.ResultMessage {
+	return f.resultChannel
+}
+
+func (f *InMemoryMQFlow) Start(ctx context.Context) {
+	go f.retryWorker(ctx)
+}
+
+func (f *InMemoryMQFlow) Characteristics() api.Characteristics {
+	return api.Characteristics{
+		HasExternalBackoff: false,
+	}
+}
+
+func (f *InMemoryMQFlow) RequestChannels() []api.RequestChannel {
+	return []api.RequestChannel{{Channel: f.requestChannel, Metadata: f.metadata}}
+}
+
+func (f *InMemoryMQFlow) RetryChannel() chan api.RetryMessage {
+	return f.retryChannel
+}
+
+func (f *InMemoryMQFlow) ResultChannel() chan api.ResultMessage {
+	return f.resultChannel
+}
+
+// Enqueues the requests to retry again once their backoff is over. Pending retries are dropped once the context is
+// done.
+func (f *InMemoryMQFlow) retryWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-f.retryChannel:
+			time.AfterFunc(time.Duration(msg.BackoffDurationSeconds*float64(time.Second)), func() {
+				select {
+				case f.requestChannel <- msg.RequestMessage:
+				case <-ctx.Done():
+				}
+			})
+		}
+	}
+}
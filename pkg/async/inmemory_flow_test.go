@@ -0,0 +1,68 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestInMemoryMQFlow(t *testing.T) {
+	flow := NewInMemoryMQFlow()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow.Start(ctx)
+
+	httpClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"text": "hello"}`)),
+			Header:     make(http.Header),
+		}, nil
+	})}
+	mergedChannel := NewRandomRobinPolicy().MergeRequestChannels(flow.RequestChannels()).Channel
+	go api.Worker(ctx, flow.Characteristics(), httpClient, mergedChannel, flow.RetryChannel(), flow.ResultChannel(),
+		api.WorkerOptions{})
+
+	deadline := fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix())
+	flow.Enqueue(api.RequestMessage{Id: "123", DeadlineUnixSec: deadline, Payload: map[string]any{"model": "m"}})
+	select {
+	case result := <-flow.Results():
+		if result.Id != "123" || result.Payload != `{"text": "hello"}` {
+			t.Errorf("Unexpected result %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a result")
+	}
+}
+
+func TestInMemoryMQFlow_retry(t *testing.T) {
+	flow := NewInMemoryMQFlow()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flow.Start(ctx)
+
+	flow.RetryChannel() <- api.RetryMessage{
+		EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: api.RequestMessage{Id: "123", RetryCount: 1}},
+		BackoffDurationSeconds:   0.01,
+	}
+	select {
+	case msg := <-flow.RequestChannels()[0].Channel:
+		if msg.Id != "123" || msg.RetryCount != 1 {
+			t.Errorf("Unexpected request %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the request to be enqueued again")
+	}
+}
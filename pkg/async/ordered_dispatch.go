@@ -0,0 +1,54 @@
+package async
+
+import (
+	"hash/fnv"
+	"reflect"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+// partitionBufferSize is the number of requests each partition buffers, so that a worker busy with a slow request
+// holds back the other partitions only once its own buffer is full.
+const partitionBufferSize = 64
+
+// PartitionByOrderingKey splits a merged request channel into one channel per worker. Requests sharing an OrderingKey
+// always land on the same partition, so a single worker dispatches them in arrival order while different keys are
+// dispatched concurrently. Requests without a key are handed to whichever partition has room first.
+//
+// Note: ordering is only guaranteed for the first attempt. A retried request re-enters the flow and may be dispatched
+// after requests that arrived later.
+func PartitionByOrderingKey(channel api.EmbelishedRequestChannel, partitions int) []chan api.EmbelishedRequestMessage {
+	outChannels := make([]chan api.EmbelishedRequestMessage, partitions)
+	sendCases := make([]reflect.SelectCase, partitions)
+	for i := range outChannels {
+		outChannels[i] = make(chan api.EmbelishedRequestMessage, partitionBufferSize)
+		sendCases[i] = reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(outChannels[i])}
+	}
+
+	go func() {
+		defer func() {
+			for _, ch := range outChannels {
+				close(ch)
+			}
+		}()
+		for msg := range channel.Channel {
+			if msg.OrderingKey != "" {
+				outChannels[partitionOf(msg.OrderingKey, partitions)] <- msg
+				continue
+			}
+			value := reflect.ValueOf(msg)
+			for i := range sendCases {
+				sendCases[i].Send = value
+			}
+			reflect.Select(sendCases)
+		}
+	}()
+
+	return outChannels
+}
+
+func partitionOf(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
@@ -0,0 +1,101 @@
+package async
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+func TestPartitionByOrderingKey(t *testing.T) {
+	msgsPerKey := 10
+	keys := []string{"session-a", "session-b", "session-c"}
+	merged := make(chan api.EmbelishedRequestMessage)
+	partitions := PartitionByOrderingKey(api.EmbelishedRequestChannel{Channel: merged}, 4)
+
+	go func() {
+		for i := range msgsPerKey {
+			for _, key := range keys {
+				merged <- api.EmbelishedRequestMessage{
+					RequestMessage: api.RequestMessage{Id: fmt.Sprintf("%s-%d", key, i), OrderingKey: key},
+				}
+			}
+			merged <- api.EmbelishedRequestMessage{RequestMessage: api.RequestMessage{Id: fmt.Sprintf("unkeyed-%d", i)}}
+		}
+		close(merged)
+	}()
+
+	var mu sync.Mutex
+	seenOn := map[string]int{}
+	received := map[string][]string{}
+	unkeyed := 0
+	var wg sync.WaitGroup
+	for p, ch := range partitions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range ch {
+				mu.Lock()
+				if msg.OrderingKey == "" {
+					unkeyed++
+				} else {
+					if prev, ok := seenOn[msg.OrderingKey]; ok && prev != p {
+						t.Errorf("Key %s was dispatched on partitions %d and %d", msg.OrderingKey, prev, p)
+					}
+					seenOn[msg.OrderingKey] = p
+					received[msg.OrderingKey] = append(received[msg.OrderingKey], msg.Id)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if unkeyed != msgsPerKey {
+		t.Errorf("Expected %d unkeyed messages, got %d", msgsPerKey, unkeyed)
+	}
+	for _, key := range keys {
+		ids := received[key]
+		if len(ids) != msgsPerKey {
+			t.Errorf("Expected %d messages for key %s, got %d", msgsPerKey, key, len(ids))
+			continue
+		}
+		for i, id := range ids {
+			if id != fmt.Sprintf("%s-%d", key, i) {
+				t.Errorf("Expected message %d of key %s to be %s-%d, got %s", i, key, key, i, id)
+			}
+		}
+	}
+}
+
+func TestPartitionByOrderingKey_slowPartition(t *testing.T) {
+	merged := make(chan api.EmbelishedRequestMessage)
+	partitions := PartitionByOrderingKey(api.EmbelishedRequestChannel{Channel: merged}, 2)
+	slowKey, fastKey := "", ""
+	for i := 0; slowKey == "" || fastKey == ""; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		if partitionOf(key, 2) == 0 && slowKey == "" {
+			slowKey = key
+		} else if partitionOf(key, 2) == 1 && fastKey == "" {
+			fastKey = key
+		}
+	}
+
+	// Nobody reads the first partition: the requests of the second one still go through.
+	go func() {
+		for i := range partitionBufferSize {
+			merged <- api.EmbelishedRequestMessage{RequestMessage: api.RequestMessage{Id: fmt.Sprintf("slow-%d", i), OrderingKey: slowKey}}
+		}
+		merged <- api.EmbelishedRequestMessage{RequestMessage: api.RequestMessage{Id: "fast", OrderingKey: fastKey}}
+	}()
+	select {
+	case msg := <-partitions[1]:
+		if msg.Id != "fast" {
+			t.Errorf("Expected the request of the second partition, got %s", msg.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the second partition not to be held back by the first one")
+	}
+}
@@ -0,0 +1,164 @@
+package async
+
+import (
+	"container/heap"
+	"reflect"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// NewPriorityPolicy returns a PriorityPolicy buffering up to bufferSize requests. With an agingThreshold above 0, once
+// that many requests are dispatched by priority while the oldest waiting request is passed over, that one is
+// dispatched next whatever its priority.
+func NewPriorityPolicy(agingThreshold int, bufferSize int) api.RequestMergePolicy {
+	return &PriorityPolicy{agingThreshold: agingThreshold, bufferSize: max(bufferSize, 1)}
+}
+
+// PriorityPolicy dispatches the waiting request of highest priority first, requests of the same priority in arrival
+// order. It receives requests from the channels, whatever their priority, until it holds bufferSize of them: a request
+// is only passed over for a higher-priority one among those. Without aging, lower-priority requests wait for as long
+// as higher-priority ones keep coming.
+type PriorityPolicy struct {
+	agingThreshold int
+	bufferSize     int
+}
+
+type pendingRequest struct {
+	msg api.EmbelishedRequestMessage
+	// seq is the arrival order of the request.
+	seq uint64
+	// arrival is the number of requests dispatched before this one arrived.
+	arrival uint64
+}
+
+// pendingRequests is a heap of the requests waiting to be dispatched, the one of highest priority on top.
+type pendingRequests []*pendingRequest
+
+func (q pendingRequests) Len() int { return len(q) }
+func (q pendingRequests) Less(i, j int) bool {
+	if q[i].msg.Priority != q[j].msg.Priority {
+		return q[i].msg.Priority > q[j].msg.Priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q pendingRequests) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *pendingRequests) Push(x any)   { *q = append(*q, x.(*pendingRequest)) }
+func (q *pendingRequests) Pop() any {
+	old := *q
+	req := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return req
+}
+
+func (p *PriorityPolicy) MergeRequestChannels(channels []api.RequestChannel) api.EmbelishedRequestChannel {
+	mergedChannel := make(chan api.EmbelishedRequestMessage)
+
+	logger := log.Log.WithName("priority-policy")
+	values := make([]reflect.Value, len(channels))
+	for i, ch := range channels {
+		values[i] = reflect.ValueOf(ch.Channel)
+	}
+	logger.V(logutil.DEFAULT).Info("Merging request channels", "channels", len(channels))
+	metrics.MergeInputChannels.Set(float64(len(channels)))
+
+	go func() {
+		var pending pendingRequests
+		closed := make([]bool, len(channels))
+		remaining := len(channels)
+		var seq, dispatched, lastAged uint64
+		receive := func(i int, val reflect.Value, ok bool) {
+			if !ok {
+				closed[i] = true
+				remaining--
+				logger.V(logutil.DEFAULT).Info("Request channel closed", "remaining-channels", remaining)
+				metrics.MergeInputChannels.Set(float64(remaining))
+				return
+			}
+			seq++
+			heap.Push(&pending, &pendingRequest{
+				msg: embellish(val.Interface().(api.RequestMessage), channels[i]), seq: seq, arrival: dispatched,
+			})
+		}
+
+		for {
+			// Taking what is already waiting first, so that the selection sees every request it can.
+			start := time.Now()
+			for received := true; received && len(pending) < p.bufferSize; {
+				received = false
+				for i := range channels {
+					if closed[i] || len(pending) >= p.bufferSize {
+						continue
+					}
+					if val, ok := values[i].TryRecv(); ok || val.IsValid() {
+						receive(i, val, ok)
+						received = received || ok
+					}
+				}
+			}
+			next, aged := p.selectRequest(pending, dispatched, lastAged)
+			if next >= 0 {
+				metrics.MergeSelectionDuration.WithLabelValues("priority").Observe(time.Since(start).Seconds())
+			} else if remaining == 0 {
+				close(mergedChannel)
+				return
+			}
+
+			// Waiting for the selected request to be taken by a worker, or for a new one, which may take precedence.
+			cases := make([]reflect.SelectCase, 0, len(channels)+1)
+			indexes := make([]int, 0, len(channels))
+			if len(pending) < p.bufferSize {
+				for i := range channels {
+					if !closed[i] {
+						cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: values[i]})
+						indexes = append(indexes, i)
+					}
+				}
+			}
+			if next >= 0 {
+				cases = append(cases, reflect.SelectCase{
+					Dir: reflect.SelectSend, Chan: reflect.ValueOf(mergedChannel), Send: reflect.ValueOf(pending[next].msg),
+				})
+			}
+			chosen, val, ok := reflect.Select(cases)
+			if chosen < len(indexes) {
+				receive(indexes[chosen], val, ok)
+				continue
+			}
+			heap.Remove(&pending, next)
+			metrics.RequestBacklog.Dec()
+			dispatched++
+			if aged {
+				lastAged = dispatched
+			}
+		}
+	}()
+
+	return api.EmbelishedRequestChannel{
+		Channel: mergedChannel,
+	}
+}
+
+// selectRequest returns the index of the pending request to dispatch next, or -1 if there is none, and whether it is
+// dispatched for its age: the oldest one if agingThreshold requests were dispatched while it was waiting since the last
+// request dispatched for its age, otherwise the one of highest priority.
+func (p *PriorityPolicy) selectRequest(pending pendingRequests, dispatched, lastAged uint64) (int, bool) {
+	if len(pending) == 0 {
+		return -1, false
+	}
+	if p.agingThreshold > 0 {
+		oldest := 0
+		for i, req := range pending {
+			if req.seq < pending[oldest].seq {
+				oldest = i
+			}
+		}
+		if dispatched-max(pending[oldest].arrival, lastAged) >= uint64(p.agingThreshold) {
+			return oldest, oldest != 0
+		}
+	}
+	return 0, false
+}
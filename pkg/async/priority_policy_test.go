@@ -0,0 +1,62 @@
+package async
+
+import (
+	"testing"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+func priorityChannels(msgsPerChannel int, priorities ...int) []api.RequestChannel {
+	channels := make([]api.RequestChannel, len(priorities))
+	for i, priority := range priorities {
+		channels[i] = api.RequestChannel{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{}}
+		for range msgsPerChannel {
+			channels[i].Channel <- api.RequestMessage{Id: string(rune('A' + i)), Priority: priority}
+		}
+		close(channels[i].Channel)
+	}
+	return channels
+}
+
+func TestPriorityPolicy(t *testing.T) {
+	mergedChannel := NewPriorityPolicy(0, 100).MergeRequestChannels(priorityChannels(5, 0, 10)).Channel
+
+	var order string
+	for msg := range mergedChannel {
+		order += msg.Id
+	}
+	if order != "BBBBBAAAAA" {
+		t.Errorf("Expected the high-priority channel to be drained first, got %s", order)
+	}
+}
+
+func TestPriorityPolicy_aging(t *testing.T) {
+	mergedChannel := NewPriorityPolicy(2, 100).MergeRequestChannels(priorityChannels(5, 0, 10)).Channel
+
+	var order string
+	for msg := range mergedChannel {
+		order += msg.Id
+	}
+	// The oldest low-priority request is dispatched after every two high-priority ones.
+	if order != "BBABBABAAA" {
+		t.Errorf("Expected the low-priority channel to make progress, got %s", order)
+	}
+}
+
+func TestPriorityPolicy_reordersWithinChannel(t *testing.T) {
+	channel := api.RequestChannel{Channel: make(chan api.RequestMessage, 4), Metadata: map[string]any{}}
+	for i, priority := range []int{1, 2, 3, 4} {
+		channel.Channel <- api.RequestMessage{Id: string(rune('A' + i)), Priority: priority}
+	}
+	close(channel.Channel)
+
+	// Holding two requests at most, the policy picks the highest of those it holds.
+	mergedChannel := NewPriorityPolicy(0, 2).MergeRequestChannels([]api.RequestChannel{channel}).Channel
+	var order string
+	for msg := range mergedChannel {
+		order += msg.Id
+	}
+	if order != "BCDA" {
+		t.Errorf("Expected the requests of a channel to be reordered by priority within the buffer, got %s", order)
+	}
+}
@@ -2,8 +2,12 @@ package async
 
 import (
 	"reflect"
+	"time"
 
 	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
 )
 
 func NewRandomRobinPolicy() api.RequestMergePolicy {
@@ -16,14 +20,17 @@ type RandomRobinPolicy struct {
 func (r *RandomRobinPolicy) MergeRequestChannels(channels []api.RequestChannel) api.EmbelishedRequestChannel {
 	mergedChannel := make(chan api.EmbelishedRequestMessage)
 
+	logger := log.Log.WithName("random-robin-policy")
 	cases := make([]reflect.SelectCase, len(channels)) //nolint:staticcheck
 	for i, ch := range channels {
 		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.Channel)}
 	}
+	logger.V(logutil.DEFAULT).Info("Merging request channels", "channels", len(cases))
+	metrics.MergeInputChannels.Set(float64(len(cases)))
 
 	go func() {
 		for {
-			i1, val, ok := reflect.Select(cases)
+			i1, val, ok := selectRequest(cases)
 			if !ok {
 				// one of the channels is closed, remove it
 				newCases := make([]reflect.SelectCase, 0, len(cases)-1)
@@ -33,24 +40,14 @@ func (r *RandomRobinPolicy) MergeRequestChannels(channels []api.RequestChannel)
 					}
 				}
 				cases = newCases
+				logger.V(logutil.DEFAULT).Info("Request channel closed", "remaining-channels", len(cases))
+				metrics.MergeInputChannels.Set(float64(len(cases)))
 				if len(cases) == 0 {
 					close(mergedChannel)
 					break
 				}
 			} else {
-				rm := val.Interface().(api.RequestMessage)
-				erm := api.EmbelishedRequestMessage{
-					RequestMessage: rm,
-					OrgChannel:     channels[i1].Channel,
-					// TODO: move from here
-					HttpHeaders: map[string]string{
-						"Content-Type":                  "application/json",
-						"x-gateway-inference-objective": channels[i1].Metadata["inference-objective"].(string),
-					},
-					InferenceGateway: channels[i1].Metadata["inference-gateway"].(string),
-					Metadata:         rm.Metadata,
-				}
-				mergedChannel <- erm
+				handOver(mergedChannel, embellish(val.Interface().(api.RequestMessage), channels[i1]))
 			}
 
 		}
@@ -60,3 +57,42 @@ func (r *RandomRobinPolicy) MergeRequestChannels(channels []api.RequestChannel)
 		Channel: mergedChannel,
 	}
 }
+
+// selectRequest receives from one of the ready channels, or waits for one if none is. Only the selection among ready
+// channels is observed, not the wait.
+func selectRequest(cases []reflect.SelectCase) (int, reflect.Value, bool) {
+	start := time.Now()
+	i, val, ok := reflect.Select(append(cases, reflect.SelectCase{Dir: reflect.SelectDefault}))
+	if i < len(cases) {
+		metrics.MergeSelectionDuration.WithLabelValues("random-robin").Observe(time.Since(start).Seconds())
+		return i, val, ok
+	}
+	return reflect.Select(cases)
+}
+
+// embellish attaches to the request what the merged channel needs to know about the channel it came from. Every
+// request emitted by a merge policy goes through here, which is where it is counted as received and joins the backlog
+// until handed over to a worker.
+func embellish(rm api.RequestMessage, channel api.RequestChannel) api.EmbelishedRequestMessage {
+	metrics.ReceivedReqs.Inc()
+	metrics.RequestBacklog.Inc()
+	inferenceObjective, _ := channel.Metadata["inference-objective"].(string)
+	inferenceGateway, _ := channel.Metadata["inference-gateway"].(string)
+	return api.EmbelishedRequestMessage{
+		RequestMessage: rm,
+		OrgChannel:     channel.Channel,
+		// TODO: move from here
+		HttpHeaders: map[string]string{
+			"Content-Type":                  "application/json",
+			"x-gateway-inference-objective": inferenceObjective,
+		},
+		InferenceGateway: inferenceGateway,
+		Metadata:         rm.Metadata,
+	}
+}
+
+// handOver sends the request to the workers, taking it out of the backlog once one of them has it.
+func handOver(ch chan api.EmbelishedRequestMessage, msg api.EmbelishedRequestMessage) {
+	ch <- msg
+	metrics.RequestBacklog.Dec()
+}
@@ -2,8 +2,12 @@ package async
 
 import (
 	"testing"
+	"time"
 
 	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestProcessAllChannels(t *testing.T) {
@@ -14,6 +18,12 @@ func TestProcessAllChannels(t *testing.T) {
 		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{}},
 	}
 	policy := NewRandomRobinPolicy()
+	var received dto.Metric
+	metrics.ReceivedReqs.Write(&received) // nolint:errcheck
+	receivedBefore := received.GetCounter().GetValue()
+	var selections dto.Metric
+	metrics.MergeSelectionDuration.WithLabelValues("random-robin").(prometheus.Histogram).Write(&selections) // nolint:errcheck
+	selectionsBefore := selections.GetHistogram().GetSampleCount()
 
 	// Send messages to each channel
 	for i, ch := range channels {
@@ -40,4 +50,43 @@ func TestProcessAllChannels(t *testing.T) {
 			t.Errorf("Expected %d messages from channel %s, got %d", msgsPerChannel, id, counts[id])
 		}
 	}
+
+	metrics.ReceivedReqs.Write(&received) // nolint:errcheck
+	if got := received.GetCounter().GetValue() - receivedBefore; got != float64(totalMessages) {
+		t.Errorf("Expected %d received requests, got %v", totalMessages, got)
+	}
+	// Every message was waiting, so each one was selected among ready channels.
+	metrics.MergeSelectionDuration.WithLabelValues("random-robin").(prometheus.Histogram).Write(&selections) // nolint:errcheck
+	if got := selections.GetHistogram().GetSampleCount() - selectionsBefore; got < uint64(totalMessages) {
+		t.Errorf("Expected at least %d observed selections, got %d", totalMessages, got)
+	}
+}
+
+func TestRequestBacklog(t *testing.T) {
+	backlog := func() float64 {
+		var m dto.Metric
+		metrics.RequestBacklog.Write(&m) // nolint:errcheck
+		return m.GetGauge().GetValue()
+	}
+	before := backlog()
+	channel := api.RequestChannel{Channel: make(chan api.RequestMessage, 3), Metadata: map[string]any{}}
+	for range 3 {
+		channel.Channel <- api.RequestMessage{Id: "A"}
+	}
+	close(channel.Channel)
+	mergedChannel := NewRandomRobinPolicy().MergeRequestChannels([]api.RequestChannel{channel}).Channel
+
+	// The merge policy holds a request until a worker takes it.
+	deadline := time.Now().Add(time.Second)
+	for backlog()-before != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a request in the backlog, got %v", backlog()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for range mergedChannel {
+	}
+	if got := backlog() - before; got != 0 {
+		t.Errorf("Expected an empty backlog once every request is taken, got %v", got)
+	}
 }
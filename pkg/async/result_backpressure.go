@@ -0,0 +1,147 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The policies applied when results are produced faster than the flow publishes them.
+const (
+	// BlockPolicy makes the workers wait for the publisher.
+	BlockPolicy = "block"
+	// DropOldestPolicy drops the oldest waiting result to make room for the new one.
+	DropOldestPolicy = "drop-oldest"
+	// SpillPolicy writes the results over the buffer to a file, and blocks once that holds its share as well.
+	SpillPolicy = "spill"
+)
+
+// ResultBuffer holds the channel the workers send their results to, in front of the result channel of the flow.
+type ResultBuffer struct {
+	Channel chan api.ResultMessage
+
+	flowChannel chan api.ResultMessage
+	queued      atomic.Int64
+}
+
+// Pending returns the number of results not taken by the flow yet.
+func (b *ResultBuffer) Pending() int {
+	return int(b.queued.Load()) + len(b.flowChannel)
+}
+
+// WaitForResults waits until the flow took all the results of the buffers and, if it is an api.PendingResultsFlow,
+// published them, checking every interval. A flow counts a result only once it took it from its channel: no results
+// must be pending on two checks in a row, for those taken in between.
+func WaitForResults(ctx context.Context, interval time.Duration, flow api.Flow, buffers ...*ResultBuffer) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	settled := false
+	for {
+		pending := 0
+		if pendingResultsFlow, ok := flow.(api.PendingResultsFlow); ok {
+			pending += pendingResultsFlow.PendingResults()
+		}
+		for _, b := range buffers {
+			pending += b.Pending()
+		}
+		if pending == 0 && settled {
+			return nil
+		}
+		settled = pending == 0
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ResultBackpressure returns the buffer the workers should send their results to. Except for the block policy,
+// results are buffered, up to bufferSize of them, before being handed to resultChannel, and the policy decides what
+// happens once the buffer is full. The spill policy writes up to spillSize results over the buffer to the file at
+// spillPath, the results left there by a previous run included.
+func ResultBackpressure(ctx context.Context, resultChannel chan api.ResultMessage, policy string, bufferSize int,
+	spillPath string, spillSize int) (*ResultBuffer, error) {
+	switch policy {
+	case BlockPolicy:
+		// The workers send to the flow directly, which may buffer the results itself (see api.ResultBufferSize).
+		return &ResultBuffer{Channel: resultChannel, flowChannel: resultChannel}, nil
+	case DropOldestPolicy, SpillPolicy:
+	default:
+		return nil, fmt.Errorf("unknown result backpressure policy %q", policy)
+	}
+	if bufferSize <= 0 {
+		return nil, fmt.Errorf("the %s result backpressure policy needs a positive buffer size", policy)
+	}
+	var spill *resultSpill
+	if policy == SpillPolicy {
+		if spillPath == "" {
+			return nil, fmt.Errorf("the %s result backpressure policy needs a spill file", policy)
+		}
+		var err error
+		if spill, err = openResultSpill(spillPath); err != nil {
+			return nil, err
+		}
+	}
+
+	logger := log.FromContext(ctx).WithName("result-backpressure")
+	b := &ResultBuffer{Channel: make(chan api.ResultMessage), flowChannel: resultChannel}
+	b.queued.Store(int64(spill.pending()))
+	go func() {
+		defer spill.close()
+		var queue []api.ResultMessage
+		for {
+			// Refilling the buffer from the file, which holds the newer results.
+			for len(queue) < bufferSize && spill.pending() > 0 {
+				msg, err := spill.read()
+				if err != nil {
+					logger.Error(err, "Failed to read spilled result")
+					metrics.DroppedResults.Inc()
+					continue
+				}
+				queue = append(queue, msg)
+			}
+			b.queued.Store(int64(len(queue) + spill.pending()))
+
+			var out chan api.ResultMessage
+			var next api.ResultMessage
+			if len(queue) > 0 {
+				out = resultChannel
+				next = queue[0]
+			}
+			receive := b.Channel
+			if spill != nil && len(queue) >= bufferSize && spill.pending() >= spillSize {
+				// Blocking the workers until the flow catches up.
+				receive = nil
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-receive:
+				switch {
+				case spill != nil && (len(queue) >= bufferSize || spill.pending() > 0):
+					if err := spill.write(msg); err != nil {
+						// Kept in memory rather than lost, ahead of the results in the file.
+						logger.Error(err, "Failed to spill result", "id", msg.Id)
+						queue = append(queue, msg)
+						break
+					}
+					metrics.SpilledResults.Inc()
+				case len(queue) >= bufferSize:
+					queue = append(queue[1:], msg)
+					metrics.DroppedResults.Inc()
+				default:
+					queue = append(queue, msg)
+				}
+			case out <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return b, nil
+}
@@ -0,0 +1,119 @@
+package async
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+func sendResult(ch chan api.ResultMessage, id string) bool {
+	select {
+	case ch <- api.ResultMessage{Id: id}:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestResultBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		policy   string
+		accepted []string
+		received []string
+	}{
+		{policy: DropOldestPolicy, accepted: []string{"1", "2", "3", "4"}, received: []string{"3", "4"}},
+		{policy: SpillPolicy, accepted: []string{"1", "2", "3"}, received: []string{"1", "2", "3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			// Nobody publishes the results until all of them are sent.
+			resultChannel := make(chan api.ResultMessage)
+			buffer, err := ResultBackpressure(ctx, resultChannel, test.policy, 2, filepath.Join(t.TempDir(), "results.jsonl"), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var accepted []string
+			for _, id := range []string{"1", "2", "3", "4"} {
+				if sendResult(buffer.Channel, id) {
+					accepted = append(accepted, id)
+				}
+			}
+			if len(accepted) != len(test.accepted) {
+				t.Fatalf("Expected results %v to be accepted, got %v", test.accepted, accepted)
+			}
+			for _, id := range test.received {
+				if msg := <-resultChannel; msg.Id != id {
+					t.Errorf("Expected result %s, got %s", id, msg.Id)
+				}
+			}
+			waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			if err := WaitForResults(waitCtx, time.Millisecond, newFakeFlow(), buffer); err != nil {
+				t.Errorf("Expected no pending results once the flow took them, got %d", buffer.Pending())
+			}
+		})
+	}
+
+	resultChannel := make(chan api.ResultMessage)
+	if buffer, _ := ResultBackpressure(ctx, resultChannel, BlockPolicy, 2, "", 1); buffer.Channel != resultChannel {
+		t.Errorf("Expected the block policy to send to the flow directly")
+	}
+	if _, err := ResultBackpressure(ctx, make(chan api.ResultMessage), DropOldestPolicy, 0, "", 0); err == nil {
+		t.Errorf("Expected an error without a buffer")
+	}
+	if _, err := ResultBackpressure(ctx, make(chan api.ResultMessage), "unknown", 1, "", 0); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+	if _, err := ResultBackpressure(ctx, make(chan api.ResultMessage), SpillPolicy, 1, "", 1); err == nil {
+		t.Errorf("Expected an error without a spill file")
+	}
+}
+
+func TestResultBackpressure_spilledResultsOutliveTheProcessor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	ctx, stop := context.WithCancel(context.Background())
+	buffer, err := ResultBackpressure(ctx, make(chan api.ResultMessage), SpillPolicy, 1, path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if !sendResult(buffer.Channel, id) {
+			t.Fatalf("Expected result %s to be accepted", id)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); buffer.Pending() != 3; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the results to be buffered and spilled, got %d pending", buffer.Pending())
+		}
+	}
+	// The buffered result is lost, the spilled ones are published by the next processor.
+	stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resultChannel := make(chan api.ResultMessage)
+	buffer, err = ResultBackpressure(ctx, resultChannel, SpillPolicy, 1, path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.Pending() != 2 {
+		t.Errorf("Expected the 2 spilled results to be pending, got %d", buffer.Pending())
+	}
+	for _, id := range []string{"2", "3"} {
+		if msg := <-resultChannel; msg.Id != id {
+			t.Errorf("Expected result %s, got %s", id, msg.Id)
+		}
+	}
+	if !sendResult(buffer.Channel, "4") {
+		t.Fatalf("Expected result 4 to be accepted")
+	}
+	if msg := <-resultChannel; msg.Id != "4" {
+		t.Errorf("Expected result 4, got %s", msg.Id)
+	}
+}
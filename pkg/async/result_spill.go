@@ -0,0 +1,111 @@
+package async
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+// resultSpill is the file the spill result backpressure policy writes the results over its buffer to, as JSON lines,
+// and reads them back from in order. The file is emptied once all of its results are read back. The results a stopped
+// processor left in it are read back on start, so a result may be published more than once.
+type resultSpill struct {
+	writer *os.File
+	reader *os.File
+	lines  *bufio.Reader
+	// count is the number of results written and not read back yet.
+	count int
+}
+
+// openResultSpill opens the spill file at path, creating its directory if needed, and counts the results left in it.
+func openResultSpill(path string) (*resultSpill, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create result spill directory: %w", err)
+	}
+	writer, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result spill file: %w", err)
+	}
+	reader, err := os.Open(path)
+	if err != nil {
+		writer.Close() // nolint:errcheck
+		return nil, fmt.Errorf("failed to open result spill file: %w", err)
+	}
+	s := &resultSpill{writer: writer, reader: reader, lines: bufio.NewReader(reader)}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to read result spill file: %w", err)
+	}
+	s.count = bytes.Count(content, []byte("\n"))
+	return s, nil
+}
+
+// pending returns the number of results in the file, zero without a file.
+func (s *resultSpill) pending() int {
+	if s == nil {
+		return 0
+	}
+	return s.count
+}
+
+func (s *resultSpill) write(msg api.ResultMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// read returns the oldest result of the file. A result that can't be decoded is given up on, and so are all the results
+// left in the file if it can't be read.
+func (s *resultSpill) read() (api.ResultMessage, error) {
+	var msg api.ResultMessage
+	line, err := s.lines.ReadBytes('\n')
+	if err == nil {
+		s.count--
+		err = json.Unmarshal(line, &msg)
+	} else {
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("result spill file ends after %d missing results", s.count)
+		}
+		s.count = 0
+	}
+	if s.count == 0 {
+		if resetErr := s.reset(); resetErr != nil {
+			err = errors.Join(err, resetErr)
+		}
+	}
+	return msg, err
+}
+
+// reset empties the file once all of its results are read back.
+func (s *resultSpill) reset() error {
+	if err := s.writer.Truncate(0); err != nil {
+		return fmt.Errorf("failed to empty result spill file: %w", err)
+	}
+	if _, err := s.reader.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind result spill file: %w", err)
+	}
+	s.lines.Reset(s.reader)
+	return nil
+}
+
+func (s *resultSpill) close() {
+	if s == nil {
+		return
+	}
+	s.writer.Close() // nolint:errcheck
+	s.reader.Close() // nolint:errcheck
+}
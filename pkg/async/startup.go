@@ -0,0 +1,48 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// WaitForReadiness polls url every interval until it answers with a 2xx status, e.g. the readiness endpoint of the
+// service mesh proxy, so that requests aren't consumed before they can be dispatched. Returns an error if the context
+// is done first.
+func WaitForReadiness(ctx context.Context, httpClient *http.Client, url string, interval time.Duration) error {
+	logger := log.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := checkReadiness(ctx, httpClient, url)
+		if err == nil {
+			return nil
+		}
+		logger.V(logutil.VERBOSE).Info("Waiting for readiness", "url", url, "reason", err.Error())
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkReadiness(ctx context.Context, httpClient *http.Client, url string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close() // nolint:errcheck
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
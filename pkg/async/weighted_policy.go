@@ -0,0 +1,165 @@
+package async
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/llm-d-incubation/llm-d-async/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// WeightMetadataKey is the RequestChannel metadata entry a Flow uses to set the weight of a channel.
+const WeightMetadataKey = "weight"
+
+// NewWeightedPolicy returns a WeightedPolicy weighting the request channels by their inference objective. Channels
+// whose objective isn't in weights are weighted by their metadata.
+func NewWeightedPolicy(weights map[string]float64) api.RequestMergePolicy {
+	return &WeightedPolicy{weights: weights}
+}
+
+// WeightedPolicy drains the request channels in proportion to their weight: while all of them have messages waiting, a
+// channel of weight 4 is drained four times as fast as a channel of weight 1. Channels without a weight count as 1,
+// and a channel of weight 0 is only drained when all the others are empty.
+type WeightedPolicy struct {
+	weights map[string]float64
+}
+
+// ParseChannelWeights parses a comma separated list of 'inference-objective=weight' pairs.
+func ParseChannelWeights(s string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		objective, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid channel weight %q, expected 'inference-objective=weight'", pair)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid channel weight %q, expected a weight of 0 or more", pair)
+		}
+		weights[strings.TrimSpace(objective)] = weight
+	}
+	return weights, nil
+}
+
+type weightedChannel struct {
+	api.RequestChannel
+	value  reflect.Value
+	weight float64
+	// current is the smooth weighted round-robin credit of the channel.
+	current float64
+}
+
+func (w *WeightedPolicy) MergeRequestChannels(channels []api.RequestChannel) api.EmbelishedRequestChannel {
+	mergedChannel := make(chan api.EmbelishedRequestMessage)
+
+	logger := log.Log.WithName("weighted-policy")
+	active := make([]*weightedChannel, len(channels))
+	for i, ch := range channels {
+		active[i] = &weightedChannel{RequestChannel: ch, value: reflect.ValueOf(ch.Channel), weight: w.channelWeight(ch)}
+	}
+	logger.V(logutil.DEFAULT).Info("Merging request channels", "channels", len(active))
+	metrics.MergeInputChannels.Set(float64(len(active)))
+
+	go func() {
+		for len(active) > 0 {
+			i, rm, ok := receiveWeighted(active)
+			if !ok {
+				// the channel is closed, remove it
+				active = append(active[:i], active[i+1:]...)
+				logger.V(logutil.DEFAULT).Info("Request channel closed", "remaining-channels", len(active))
+				metrics.MergeInputChannels.Set(float64(len(active)))
+				continue
+			}
+			handOver(mergedChannel, embellish(rm, active[i].RequestChannel))
+		}
+		close(mergedChannel)
+	}()
+
+	return api.EmbelishedRequestChannel{
+		Channel: mergedChannel,
+	}
+}
+
+// receiveWeighted receives the next message, trying the channels in smooth weighted round-robin order and waiting on
+// all of them if they are all empty. Returns false if the channel at the returned index is closed.
+func receiveWeighted(active []*weightedChannel) (int, api.RequestMessage, bool) {
+	start := time.Now()
+	total := 0.0
+	for _, ch := range active {
+		total += ch.weight
+	}
+	for _, ch := range active {
+		// Capping the credit keeps a channel that has been empty for a while from bursting once it fills up again.
+		ch.current = min(ch.current+ch.weight, total)
+	}
+	consumed := func(i int) {
+		if active[i].weight > 0 {
+			active[i].current -= total
+		}
+	}
+
+	for _, i := range preferenceOrder(active) {
+		val, ok := active[i].value.TryRecv()
+		if ok {
+			consumed(i)
+			metrics.MergeSelectionDuration.WithLabelValues("weighted").Observe(time.Since(start).Seconds())
+			return i, val.Interface().(api.RequestMessage), true
+		}
+		if val.IsValid() {
+			return i, api.RequestMessage{}, false
+		}
+	}
+
+	// Every channel is empty: take the first message to arrive, whatever its weight. The wait is not a selection cost.
+	cases := make([]reflect.SelectCase, len(active))
+	for i, ch := range active {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: ch.value}
+	}
+	i, val, ok := reflect.Select(cases)
+	if !ok {
+		return i, api.RequestMessage{}, false
+	}
+	consumed(i)
+	return i, val.Interface().(api.RequestMessage), true
+}
+
+// preferenceOrder returns the channel indexes by decreasing credit, zero-weight channels last.
+func preferenceOrder(active []*weightedChannel) []int {
+	order := make([]int, 0, len(active))
+	for i := range active {
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		chA, chB := active[order[a]], active[order[b]]
+		if (chA.weight > 0) != (chB.weight > 0) {
+			return chA.weight > 0
+		}
+		return chA.current > chB.current
+	})
+	return order
+}
+
+func (w *WeightedPolicy) channelWeight(ch api.RequestChannel) float64 {
+	objective, _ := ch.Metadata["inference-objective"].(string)
+	if weight, ok := w.weights[objective]; ok {
+		return weight
+	}
+	switch w := ch.Metadata[WeightMetadataKey].(type) {
+	case float64:
+		return max(w, 0)
+	case int:
+		return float64(max(w, 0))
+	default:
+		return 1
+	}
+}
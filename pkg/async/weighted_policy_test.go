@@ -0,0 +1,94 @@
+package async
+
+import (
+	"testing"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+func TestWeightedPolicy_drainsByWeight(t *testing.T) {
+	msgsPerChannel := 50
+	channels := []api.RequestChannel{
+		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{WeightMetadataKey: 4}},
+		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{}},
+	}
+	for i, ch := range channels {
+		for range msgsPerChannel {
+			ch.Channel <- api.RequestMessage{Id: string(rune('A' + i))}
+		}
+		close(ch.Channel)
+	}
+	mergedChannel := NewWeightedPolicy(nil).MergeRequestChannels(channels).Channel
+
+	counts := map[string]int{}
+	for range 25 {
+		msg := <-mergedChannel
+		counts[msg.Id]++
+	}
+	if counts["A"] != 20 || counts["B"] != 5 {
+		t.Errorf("Expected 20 messages from A and 5 from B, got %d and %d", counts["A"], counts["B"])
+	}
+
+	// The remaining messages are all delivered.
+	for range mergedChannel {
+		counts["total"]++
+	}
+	if counts["total"] != 2*msgsPerChannel-25 {
+		t.Errorf("Expected %d remaining messages, got %d", 2*msgsPerChannel-25, counts["total"])
+	}
+}
+
+func TestWeightedPolicy_zeroWeight(t *testing.T) {
+	msgsPerChannel := 5
+	channels := []api.RequestChannel{
+		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{WeightMetadataKey: 0.0}},
+		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{WeightMetadataKey: 1.0}},
+	}
+	for i, ch := range channels {
+		for range msgsPerChannel {
+			ch.Channel <- api.RequestMessage{Id: string(rune('A' + i))}
+		}
+		close(ch.Channel)
+	}
+	mergedChannel := NewWeightedPolicy(nil).MergeRequestChannels(channels).Channel
+
+	var order string
+	for msg := range mergedChannel {
+		order += msg.Id
+	}
+	if order != "BBBBBAAAAA" {
+		t.Errorf("Expected the zero-weight channel to be drained last, got %s", order)
+	}
+}
+
+func TestWeightedPolicy_weightsByObjective(t *testing.T) {
+	weights, err := ParseChannelWeights("high-priority=7, batch=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgsPerChannel := 50
+	channels := []api.RequestChannel{
+		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{"inference-objective": "batch", WeightMetadataKey: 100}},
+		{Channel: make(chan api.RequestMessage, msgsPerChannel), Metadata: map[string]any{"inference-objective": "high-priority"}},
+	}
+	for i, ch := range channels {
+		for range msgsPerChannel {
+			ch.Channel <- api.RequestMessage{Id: string(rune('A' + i))}
+		}
+		close(ch.Channel)
+	}
+	mergedChannel := NewWeightedPolicy(weights).MergeRequestChannels(channels).Channel
+
+	counts := map[string]int{}
+	for range 20 {
+		msg := <-mergedChannel
+		counts[msg.Id]++
+	}
+	if counts["A"] != 6 || counts["B"] != 14 {
+		t.Errorf("Expected 6 messages from A and 14 from B, got %d and %d", counts["A"], counts["B"])
+	}
+
+	if _, err := ParseChannelWeights("high-priority=-1"); err == nil {
+		t.Errorf("Expected a negative weight to be rejected")
+	}
+}
@@ -0,0 +1,292 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/segmentio/kafka-go"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// KAFKA_ID is the metadata entry holding the partition and offset a request was fetched from, to commit it once its
+// result is published.
+const KAFKA_ID = "kafka-id"
+
+var (
+	brokers = flag.String("kafka.brokers", "localhost:9092", "comma separated list of Kafka broker addresses")
+
+	inferenceGateway   = flag.String("kafka.inference-gateway", "http://localhost:30080/v1/completions", "inference gateway endpoint")
+	inferenceObjective = flag.String("kafka.inference-objective", "", "inference objective to use in requests")
+	requestTopic       = flag.String("kafka.request-topic", "request-queue", "Kafka topic of the request messages")
+	groupID            = flag.String("kafka.group-id", "llm-d-async", "Kafka consumer group shared by the processors, which split the partitions of the request topic between them")
+	resultTopic        = flag.String("kafka.result-topic", "result-queue", "Kafka topic of the result messages")
+	errorTopic         = flag.String("kafka.error-topic", "", "Kafka topic of the error results. Errors are published to the result topic if empty")
+	commitInterval     = flag.Duration("kafka.commit-interval", time.Second, "how often the offsets of the processed requests are committed")
+)
+
+// reader is the part of kafka.Reader the flow uses.
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// writer is the part of kafka.Writer the flow uses.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaMQFlow is a Flow over a Kafka consumer group. The offset of a request is committed only once it is processed,
+// i.e. once its result is published or it is published again for retry, and once all the requests before it in its
+// partition are processed as well. Requests in flight when the processor stops are delivered again. Retries wait for
+// their backoff in memory before being published again to the request topic.
+type KafkaMQFlow struct {
+	reader  reader
+	writer  writer
+	offsets *offsetTracker
+	brokers []string
+
+	requestChannel chan api.RequestMessage
+	retryChannel   chan api.RetryMessage
+	resultChannel  chan api.ResultMessage
+	errorChannel   chan api.ResultMessage
+	pendingResults api.PendingResults
+}
+
+func NewKafkaMQFlow() *KafkaMQFlow {
+	brokerAddrs := strings.Split(*brokers, ",")
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokerAddrs,
+		GroupID: *groupID,
+		Topic:   *requestTopic,
+	})
+	w := &kafka.Writer{
+		Addr:     kafka.TCP(brokerAddrs...),
+		Balancer: &kafka.Hash{},
+		// The result workers collect the batches, the writer doesn't need to wait for more.
+		BatchSize:    max(*api.ResultPublishBatchSize, 1),
+		BatchTimeout: time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+	}
+	flow := newKafkaMQFlow(r, w)
+	flow.brokers = brokerAddrs
+	return flow
+}
+
+func newKafkaMQFlow(r reader, w writer) *KafkaMQFlow {
+	flow := &KafkaMQFlow{
+		reader:         r,
+		writer:         w,
+		offsets:        newOffsetTracker(),
+		requestChannel: make(chan api.RequestMessage),
+		retryChannel:   make(chan api.RetryMessage),
+		resultChannel:  api.NewResultChannel(),
+	}
+	if *errorTopic != "" {
+		flow.errorChannel = api.NewErrorResultChannel()
+	}
+	return flow
+}
+
+func (r *KafkaMQFlow) Start(ctx context.Context) {
+	go requestWorker(api.ConsumeContext(ctx), r.reader, r.offsets, r.requestChannel)
+
+	go retryWorker(ctx, r.writer, r.offsets, r.retryChannel, *requestTopic)
+
+	batchSize, batchWindow := *api.ResultPublishBatchSize, *api.ResultPublishBatchWindow
+	for range api.ResultWorkerCount() {
+		go resultWorker(ctx, r.writer, r.offsets, r.resultChannel, &r.pendingResults, *resultTopic, batchSize, batchWindow)
+	}
+	if r.errorChannel != nil {
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, r.writer, r.offsets, r.errorChannel, &r.pendingResults, *errorTopic, batchSize, batchWindow)
+		}
+	}
+
+	go commitWorker(ctx, r.reader, r.writer, r.offsets, *commitInterval)
+}
+
+func (r *KafkaMQFlow) Characteristics() api.Characteristics {
+	return api.Characteristics{
+		HasExternalBackoff: false,
+		AcksOnResult:       true,
+	}
+}
+
+func (r *KafkaMQFlow) RequestChannels() []api.RequestChannel {
+
+	metadata := map[string]any{
+		"inference-gateway":   *inferenceGateway,
+		"inference-objective": *inferenceObjective,
+	}
+
+	return []api.RequestChannel{{Channel: r.requestChannel, Metadata: metadata}}
+}
+
+func (r *KafkaMQFlow) RetryChannel() chan api.RetryMessage {
+	return r.retryChannel
+}
+
+func (r *KafkaMQFlow) ResultChannel() chan api.ResultMessage {
+	return r.resultChannel
+}
+
+func (r *KafkaMQFlow) ErrorResultChannel() chan api.ResultMessage {
+	return r.errorChannel
+}
+
+func (r *KafkaMQFlow) PendingResults() int {
+	return r.pendingResults.Count()
+}
+
+// Healthy reports the flow healthy as long as one of the brokers can be reached.
+func (r *KafkaMQFlow) Healthy(ctx context.Context) error {
+	err := fmt.Errorf("no Kafka broker")
+	for _, broker := range r.brokers {
+		var conn *kafka.Conn
+		if conn, err = kafka.DialContext(ctx, "tcp", broker); err == nil {
+			return conn.Close()
+		}
+	}
+	return err
+}
+
+// Fetches the requests of the partitions assigned to this processor and puts them in the request channel.
+func requestWorker(ctx context.Context, r reader, offsets *offsetTracker, msgChannel chan api.RequestMessage) {
+	logger := log.FromContext(ctx)
+	for {
+		kmsg, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.V(logutil.DEFAULT).Error(err, "Failed to fetch message from request topic")
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		id := offsets.add(kmsg)
+
+		var msg api.RequestMessage
+		if err := json.Unmarshal(kmsg.Value, &msg); err != nil {
+			logger.V(logutil.DEFAULT).Error(err, "Failed to unmarshal message from request topic")
+			offsets.done(id) // skip this message
+			continue
+		}
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string)
+		}
+		msg.Metadata[KAFKA_ID] = id
+		select {
+		case msgChannel <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Publishes the requests to retry back to the request topic once their backoff is over, and only then lets their
+// offset be committed. Requests waiting for their backoff when the processor stops are delivered again.
+func retryWorker(ctx context.Context, w writer, offsets *offsetTracker, retryChannel chan api.RetryMessage, topic string) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-retryChannel:
+			bytes, err := json.Marshal(msg.RequestMessage)
+			if err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to marshal message for retry")
+				offsets.done(msg.RequestMessage.Metadata[KAFKA_ID])
+				continue // skip this message.
+			}
+			time.AfterFunc(time.Duration(msg.BackoffDurationSeconds*float64(time.Second)), func() {
+				if ctx.Err() != nil {
+					return
+				}
+				kmsg := kafka.Message{Topic: topic, Key: []byte(msg.Id), Value: bytes}
+				if err := w.WriteMessages(ctx, kmsg); err != nil {
+					// Not committed, the request is delivered again on restart.
+					logger.V(logutil.DEFAULT).Error(err, "Failed to publish message for retry", "id", msg.Id)
+					return
+				}
+				offsets.done(msg.RequestMessage.Metadata[KAFKA_ID])
+			})
+		}
+	}
+}
+
+// Listening on the results channel and publishing the results to the result topic, then letting the offsets of their
+// requests be committed.
+func resultWorker(ctx context.Context, w writer, offsets *offsetTracker, resultChannel chan api.ResultMessage,
+	pending *api.PendingResults, topic string, batchSize int, batchWindow time.Duration) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-resultChannel:
+			batch := api.CollectResultBatch(ctx, msg, resultChannel, batchSize, batchWindow, pending)
+			kmsgs := make([]kafka.Message, len(batch))
+			for i, msg := range batch {
+				kmsgs[i] = kafka.Message{Topic: topic, Key: []byte(msg.Id), Value: api.MarshalResult(msg)}
+			}
+			err := w.WriteMessages(ctx, kmsgs...)
+			pending.Add(-len(batch))
+			if err != nil {
+				if ctx.Err() != nil {
+					// Not committed, the requests are delivered again on restart.
+					return
+				}
+				// Not going to retry here, the writer already did. Not committed either: the requests are delivered
+				// again on restart, for their results to be published then.
+				logger.V(logutil.DEFAULT).Error(err, "Failed to publish result message to Kafka", "results", len(batch))
+				continue
+			}
+			for _, msg := range batch {
+				offsets.done(msg.Metadata[KAFKA_ID])
+			}
+		}
+	}
+}
+
+// Commits the offsets of the processed requests every interval, from a single goroutine so that the commits of a
+// partition never go backwards. Commits a last time and closes the connections once the context is done.
+func commitWorker(ctx context.Context, r reader, w writer, offsets *offsetTracker, interval time.Duration) {
+	logger := log.FromContext(ctx)
+	commit := func(ctx context.Context) {
+		if msgs := offsets.committable(); len(msgs) > 0 {
+			if err := r.CommitMessages(ctx, msgs...); err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to commit offsets to Kafka")
+			}
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			commitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			commit(commitCtx)
+			cancel()
+			r.Close() // nolint:errcheck
+			w.Close() // nolint:errcheck
+			return
+		case <-ticker.C:
+			commit(ctx)
+		}
+	}
+}
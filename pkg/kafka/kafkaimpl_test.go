@@ -0,0 +1,234 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeReader hands out the messages put in its channel and records the commits.
+type fakeReader struct {
+	messages chan kafka.Message
+
+	mu      sync.Mutex
+	commits map[int]int64
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{messages: make(chan kafka.Message, 10), commits: map[int]int64{}}
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-r.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range msgs {
+		// Like Kafka, the committed offset is the next one to read.
+		r.commits[msg.Partition] = msg.Offset + 1
+	}
+	return nil
+}
+
+func (r *fakeReader) committed(partition int) (int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset, ok := r.commits[partition]
+	return offset, ok
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+// fakeWriter records the written messages.
+type fakeWriter struct {
+	written chan kafka.Message
+	err     error
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	for _, msg := range msgs {
+		w.written <- msg
+	}
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+func requestMessage(t *testing.T, partition int, offset int64, id string) kafka.Message {
+	value, err := json.Marshal(api.RequestMessage{Id: id, DeadlineUnixSec: "9999999999", Payload: map[string]any{"model": "m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{Topic: "request-queue", Partition: partition, Offset: offset, Value: value}
+}
+
+func startFlow(t *testing.T, r *fakeReader, w *fakeWriter) (*KafkaMQFlow, context.CancelFunc) {
+	if err := flag.Set("kafka.commit-interval", "10ms"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("kafka.commit-interval", "1s") }) // nolint:errcheck
+	flow := newKafkaMQFlow(r, w)
+	ctx, cancel := context.WithCancel(context.Background())
+	flow.Start(ctx)
+	t.Cleanup(cancel)
+	return flow, cancel
+}
+
+func receiveRequest(t *testing.T, flow *KafkaMQFlow) api.RequestMessage {
+	select {
+	case msg := <-flow.RequestChannels()[0].Channel:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a request")
+		return api.RequestMessage{}
+	}
+}
+
+func TestKafkaMQFlow_commitsProcessedRequests(t *testing.T) {
+	r := newFakeReader()
+	w := &fakeWriter{written: make(chan kafka.Message, 10)}
+	flow, _ := startFlow(t, r, w)
+	for offset, id := range []string{"a", "b", "c"} {
+		r.messages <- requestMessage(t, 0, int64(offset), id)
+	}
+	a, b := receiveRequest(t, flow), receiveRequest(t, flow)
+	receiveRequest(t, flow) // never processed
+
+	// b is processed before a: its offset can't be committed, a would be lost on restart.
+	flow.ResultChannel() <- api.NewResultMessage(b, `{"text": "b"}`)
+	if written := <-w.written; written.Topic != "result-queue" || string(written.Key) != "b" {
+		t.Errorf("Expected the result of b on the result topic, got %s on %s", written.Key, written.Topic)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if offset, ok := r.committed(0); ok {
+		t.Fatalf("Expected nothing to be committed while a is in flight, got %d", offset)
+	}
+
+	flow.ResultChannel() <- api.NewResultMessage(a, `{"text": "a"}`)
+	<-w.written
+	deadline := time.Now().Add(time.Second)
+	for {
+		if offset, ok := r.committed(0); ok {
+			// c is still in flight, it is delivered again on restart.
+			if offset != 2 {
+				t.Errorf("Expected offset 2 to be committed, got %d", offset)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the offsets of a and b to be committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKafkaMQFlow_retry(t *testing.T) {
+	r := newFakeReader()
+	w := &fakeWriter{written: make(chan kafka.Message, 10)}
+	flow, _ := startFlow(t, r, w)
+	r.messages <- requestMessage(t, 3, 7, "a")
+	msg := receiveRequest(t, flow)
+
+	msg.RetryCount++
+	flow.RetryChannel() <- api.RetryMessage{
+		EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: msg},
+		BackoffDurationSeconds:   0.01,
+	}
+	written := <-w.written
+	var retried api.RequestMessage
+	if err := json.Unmarshal(written.Value, &retried); err != nil {
+		t.Fatal(err)
+	}
+	if written.Topic != "request-queue" || retried.Id != "a" || retried.RetryCount != 1 {
+		t.Errorf("Expected request a to be published again for retry, got %+v on %s", retried, written.Topic)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if offset, ok := r.committed(3); ok {
+			if offset != 8 {
+				t.Errorf("Expected offset 8 to be committed, got %d", offset)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the offset of the retried request to be committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKafkaMQFlow_failedRetryIsNotCommitted(t *testing.T) {
+	r := newFakeReader()
+	w := &fakeWriter{err: errors.New("broker unavailable")}
+	flow, _ := startFlow(t, r, w)
+	r.messages <- requestMessage(t, 0, 0, "a")
+	msg := receiveRequest(t, flow)
+
+	flow.RetryChannel() <- api.RetryMessage{
+		EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: msg},
+	}
+	time.Sleep(50 * time.Millisecond)
+	if offset, ok := r.committed(0); ok {
+		t.Errorf("Expected a request that couldn't be retried not to be committed, got %d", offset)
+	}
+}
+
+func TestKafkaMQFlow_failedResultIsNotCommitted(t *testing.T) {
+	r := newFakeReader()
+	w := &fakeWriter{err: errors.New("broker unavailable")}
+	flow, _ := startFlow(t, r, w)
+	r.messages <- requestMessage(t, 0, 0, "a")
+	msg := receiveRequest(t, flow)
+
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	time.Sleep(50 * time.Millisecond)
+	if offset, ok := r.committed(0); ok {
+		t.Errorf("Expected a request whose result couldn't be published not to be committed, got %d", offset)
+	}
+}
+
+func TestOffsetTracker_rewind(t *testing.T) {
+	tracker := newOffsetTracker()
+	msg := func(offset int64) kafka.Message {
+		return kafka.Message{Topic: "t", Partition: 0, Offset: offset}
+	}
+	tracker.add(msg(0))
+	stale := tracker.add(msg(1))
+	tracker.done(tracker.add(msg(2)))
+
+	// The partition is assigned again from offset 1, e.g. after a rebalance.
+	redelivered := tracker.add(msg(1))
+	tracker.done(stale)
+	if committable := tracker.committable(); len(committable) != 0 {
+		t.Errorf("Expected nothing committable, got %v", committable)
+	}
+	tracker.done(redelivered)
+	committable := tracker.committable()
+	if len(committable) != 1 || committable[0].Offset != 1 {
+		t.Errorf("Expected offset 1 to be committable, got %v", committable)
+	}
+	if committable := tracker.committable(); len(committable) != 0 {
+		t.Errorf("Expected a committable offset to be returned once, got %v", committable)
+	}
+}
@@ -0,0 +1,99 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetTracker follows the requests fetched from each partition until they are processed. Kafka commits an offset
+// for the whole partition, so an offset is only committable once the request at that offset and all the requests
+// before it are processed.
+type offsetTracker struct {
+	mu sync.Mutex
+	// pending holds the requests fetched from each partition, in order, until they are processed along with all the
+	// previous ones.
+	pending map[int][]*trackedMessage
+	byId    map[string]*trackedMessage
+	// ready holds, for each partition, the last message whose offset can be committed and isn't yet.
+	ready map[int]kafka.Message
+	// fetches tells apart the fetches of a message delivered again.
+	fetches uint64
+}
+
+type trackedMessage struct {
+	id   string
+	msg  kafka.Message
+	done bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		pending: make(map[int][]*trackedMessage),
+		byId:    make(map[string]*trackedMessage),
+		ready:   make(map[int]kafka.Message),
+	}
+}
+
+// add tracks a fetched message, returns the id to mark it done with.
+func (t *offsetTracker) add(msg kafka.Message) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetches++
+	id := fmt.Sprintf("%s/%d/%d/%d", msg.Topic, msg.Partition, msg.Offset, t.fetches)
+	tracked := &trackedMessage{id: id, msg: msg}
+	pending := t.pending[msg.Partition]
+	if len(pending) > 0 && pending[len(pending)-1].msg.Offset >= msg.Offset {
+		// The partition was rewound, e.g. reassigned by a rebalance: the requests from there on are delivered again,
+		// the ones in flight are not to be committed anymore.
+		for _, stale := range pending {
+			delete(t.byId, stale.id)
+		}
+		pending = nil
+	}
+	t.pending[msg.Partition] = append(pending, tracked)
+	t.byId[id] = tracked
+	return id
+}
+
+// done marks the message processed. Unknown ids, e.g. of requests that didn't come from Kafka or were fetched before
+// a rewind, are ignored.
+func (t *offsetTracker) done(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked, ok := t.byId[id]
+	if !ok {
+		return
+	}
+	delete(t.byId, id)
+	tracked.done = true
+
+	partition := tracked.msg.Partition
+	pending := t.pending[partition]
+	i := 0
+	for i < len(pending) && pending[i].done {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	t.ready[partition] = pending[i-1].msg
+	if i == len(pending) {
+		delete(t.pending, partition)
+	} else {
+		t.pending[partition] = pending[i:]
+	}
+}
+
+// committable returns the last committable message of each partition, if not returned before.
+func (t *offsetTracker) committable() []kafka.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	msgs := make([]kafka.Message, 0, len(t.ready))
+	for partition, msg := range t.ready {
+		msgs = append(msgs, msg)
+		delete(t.ready, partition)
+	}
+	return msgs
+}
@@ -14,10 +14,10 @@ const (
 )
 
 var (
-	Retries = prometheus.NewCounter(prometheus.CounterOpts{
+	Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: SchedulerSubsystem, Name: "async_request_retries_total",
-		Help: "Total number of async request retries.",
-	})
+		Help: "Total number of async request retries, by reason.",
+	}, []string{"reason"})
 	AsyncReqs = prometheus.NewCounter(prometheus.CounterOpts{
 		Subsystem: SchedulerSubsystem, Name: "async_request_total",
 		Help: "Total number of async requests.",
@@ -30,6 +30,10 @@ var (
 		Subsystem: SchedulerSubsystem, Name: "async_failed_requests_total",
 		Help: "Total number of async requests that failed.",
 	})
+	ReceivedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_requests_received_total",
+		Help: "Total number of request messages emitted by the request merge policy, retries included.",
+	})
 	SuccessfulReqs = prometheus.NewCounter(prometheus.CounterOpts{
 		Subsystem: SchedulerSubsystem, Name: "async_successful_requests_total",
 		Help: "Total number of async requests that succeeded.",
@@ -38,12 +42,120 @@ var (
 		Subsystem: SchedulerSubsystem, Name: "async_shedded_requests_total",
 		Help: "Total number of async requests that were shedded.",
 	})
+	CoalescedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_coalesced_requests_total",
+		Help: "Total number of async requests that were served by an identical request's dispatch.",
+	})
+	ResponseCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_response_cache_hits_total",
+		Help: "Total number of async requests that were answered from the response cache.",
+	})
+	MergeInputChannels = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_merge_input_channels",
+		Help: "Number of request channels currently merged by the request merge policy.",
+	})
+	Tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_tokens_total",
+		Help: "Total number of tokens reported by the model servers, by tenant, model and type (prompt or completion).",
+	}, []string{"tenant", "model", "type"})
+	BudgetExhaustedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_budget_exhausted_requests_total",
+		Help: "Total number of async requests that were failed because their total time budget was exhausted.",
+	})
+	CancelledDispatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_dispatches_cancelled_total",
+		Help: "Total number of dispatches cut short by shutdown or by the exhaustion of the request's budget.",
+	})
+	InvalidResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_invalid_responses_total",
+		Help: "Total number of successful responses missing the required fields, handled as failures.",
+	})
+	DroppedResults = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_dropped_results_total",
+		Help: "Total number of results dropped by the drop-oldest result backpressure policy, or lost by the spill one.",
+	})
+	SpilledResults = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_spilled_results_total",
+		Help: "Total number of results written to the file of the spill result backpressure policy.",
+	})
+	AuditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_audit_failures_total",
+		Help: "Total number of requests whose audit record could not be written.",
+	})
+	EmptyResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_empty_responses_total",
+		Help: "Total number of successful responses with an empty body, handled as failures.",
+	})
+	OversizedResults = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_oversized_results_total",
+		Help: "Total number of responses larger than the maximum result size.",
+	})
+	DrainedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_drained_requests_total",
+		Help: "Total number of async requests dead-lettered without dispatch in drain mode.",
+	})
+	RetryLimitedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_retry_limited_requests_total",
+		Help: "Total number of async requests that were failed instead of retried because too many requests were in the retry pipeline.",
+	})
+	SLOBreaches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_slo_breaches_total",
+		Help: "Total number of async requests whose result came later than their SLO, by model and tenant.",
+	}, []string{"model", "tenant"})
+	DispatchPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_dispatch_phase_duration_seconds",
+		Help:    "Duration of the phases of dispatching a request to the inference gateway (dns, connect, tls, ttfb and total).",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"phase"})
+	AbandonedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_abandoned_requests_total",
+		Help: "Total number of requests abandoned on shutdown, because they couldn't be finished within the drain timeout.",
+	})
+	ThrottledReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_throttled_requests_total",
+		Help: "Total number of times a request was held by its worker until its tenant's turn to dispatch.",
+	})
+	RetriesExhaustedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_retries_exhausted_requests_total",
+		Help: "Total number of requests dead-lettered because they failed once more after their last allowed retry.",
+	})
+	RequestTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_request_timeouts_total",
+		Help: "Total number of dispatches cut short by the request timeout.",
+	})
+	RetryQueueDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_retry_queue_duration_seconds",
+		Help:    "Time spent by the retried requests between being sent for retry and being dequeued again.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+	ActiveWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_active_workers",
+		Help: "Number of workers currently processing a request.",
+	})
+	IdleWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_idle_workers",
+		Help: "Number of workers currently waiting for a request.",
+	})
+	RequestBacklog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_request_backlog",
+		Help: "Number of requests received by the merge policy and not yet taken by a worker.",
+	})
+	MergeSelectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: SchedulerSubsystem, Name: "async_merge_selection_seconds",
+		Help:    "Time taken by the merge policy to select the next request among the waiting ones, by policy.",
+		Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+	}, []string{"policy"})
 )
 
 // GetCollectors returns all custom collectors for the async processor.
 func GetAsyncProcessorCollectors() []prometheus.Collector {
 	return []prometheus.Collector{
-		Retries, AsyncReqs, ExceededDeadlineReqs, FailedReqs, SuccessfulReqs, SheddedRequests,
+		Retries, AsyncReqs, ExceededDeadlineReqs, FailedReqs, SuccessfulReqs, SheddedRequests, CoalescedReqs,
+		ResponseCacheHits, MergeInputChannels, Tokens, DispatchPhaseDuration, ReceivedReqs,
+		BudgetExhaustedReqs, DrainedReqs, SLOBreaches, RetryLimitedReqs, CancelledDispatches, InvalidResponses,
+		DroppedResults, SpilledResults, AuditFailures, OversizedResults, MergeSelectionDuration,
+		EmptyResponses, AbandonedReqs, ActiveWorkers, IdleWorkers, RequestBacklog,
+		RetriesExhaustedReqs, RequestTimeouts, RetryQueueDuration, ThrottledReqs,
 	}
 }
 
@@ -0,0 +1,345 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// JETSTREAM_ID is the metadata entry holding the stream sequence of a request, to ack or nak it once processed.
+const JETSTREAM_ID = "jetstream-id"
+
+// notBeforeHeader is the header of a request published again for retry, holding the Unix milliseconds its backoff is
+// over at. It is nak'd until then.
+const notBeforeHeader = "Llm-D-Async-Not-Before"
+
+// failedResultNakDelay is how long JetStream waits before delivering again a request whose result couldn't be
+// published, for NATS to recover.
+const failedResultNakDelay = 2 * time.Second
+
+var (
+	streamName   = flag.String("nats.stream", "llm-d-async-requests", "JetStream stream holding the request subject, created if missing")
+	consumerName = flag.String("nats.durable-consumer", "llm-d-async", "durable JetStream consumer shared by the processors, created if missing")
+	ackWait      = flag.Duration("nats.ack-wait", 5*time.Minute, "how long a stopped processor holds its requests before JetStream delivers them again")
+)
+
+// JetStreamMQFlow is a Flow over a durable JetStream consumer. A request is acked once its result is published. A
+// request to retry is published again with its retry count and the end of its backoff, then acked, so that its retry
+// count only grows with its retries, not with the times JetStream delivers it. Requests being processed are kept in
+// progress, those in flight when the processor stops are delivered again once their ack wait is over.
+type JetStreamMQFlow struct {
+	nc       *nats.Conn
+	js       jetstream.JetStream
+	consumer jetstream.Consumer
+	// pending holds the requests being processed, by stream sequence, until they are acked or nak'd.
+	pending sync.Map
+
+	requestChannel chan api.RequestMessage
+	retryChannel   chan api.RetryMessage
+	resultChannel  chan api.ResultMessage
+	errorChannel   chan api.ResultMessage
+}
+
+// NewJetStreamMQFlow connects to the NATS server and creates the stream and the consumer if missing.
+func NewJetStreamMQFlow() (*JetStreamMQFlow, error) {
+	nc, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	consumer, err := ensureConsumer(context.Background(), js)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to set up the JetStream consumer %s of stream %s: %w", *consumerName, *streamName, err)
+	}
+	return newJetStreamMQFlow(nc, js, consumer), nil
+}
+
+func newJetStreamMQFlow(nc *nats.Conn, js jetstream.JetStream, consumer jetstream.Consumer) *JetStreamMQFlow {
+	flow := &JetStreamMQFlow{
+		nc:             nc,
+		js:             js,
+		consumer:       consumer,
+		requestChannel: make(chan api.RequestMessage),
+		retryChannel:   make(chan api.RetryMessage),
+		resultChannel:  api.NewResultChannel(),
+	}
+	if *errorSubject != "" {
+		flow.errorChannel = api.NewErrorResultChannel()
+	}
+	return flow
+}
+
+// Start pulls the requests from the consumer. The connection is drained once the context is done.
+func (r *JetStreamMQFlow) Start(ctx context.Context) {
+	logger := log.FromContext(ctx)
+	nc := r.nc
+	iter, err := r.consumer.Messages()
+	if err != nil {
+		logger.V(logutil.DEFAULT).Error(err, "Failed to pull messages from the JetStream consumer", "consumer", *consumerName)
+		nc.Close()
+		return
+	}
+	consumeCtx := api.ConsumeContext(ctx)
+	go func() {
+		<-consumeCtx.Done()
+		iter.Stop()
+	}()
+	go func() {
+		<-ctx.Done()
+		nc.Drain() // nolint:errcheck
+	}()
+
+	go jetStreamRequestWorker(consumeCtx, iter, &r.pending, r.requestChannel)
+
+	go jetStreamRetryWorker(ctx, r.js, &r.pending, r.retryChannel, *requestSubject)
+
+	go jetStreamHeartbeatWorker(ctx, &r.pending, *ackWait/2)
+
+	for range api.ResultWorkerCount() {
+		go jetStreamResultWorker(ctx, nc, &r.pending, r.resultChannel, *resultSubject)
+	}
+	if r.errorChannel != nil {
+		for range api.DeadLetterWorkerCount() {
+			go jetStreamResultWorker(ctx, nc, &r.pending, r.errorChannel, *errorSubject)
+		}
+	}
+}
+
+// ensureConsumer returns the durable consumer of the request subject, creating the stream and the consumer if missing.
+func ensureConsumer(ctx context.Context, js jetstream.JetStream) (jetstream.Consumer, error) {
+	stream, err := js.Stream(ctx, *streamName)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     *streamName,
+			Subjects: []string{*requestSubject},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := stream.Consumer(ctx, *consumerName)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		consumer, err = stream.CreateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       *consumerName,
+			FilterSubject: *requestSubject,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       *ackWait,
+		})
+	}
+	return consumer, err
+}
+
+func (r *JetStreamMQFlow) Characteristics() api.Characteristics {
+	return api.Characteristics{
+		HasExternalBackoff: true,
+		AcksOnResult:       true,
+	}
+}
+
+func (r *JetStreamMQFlow) RequestChannels() []api.RequestChannel {
+
+	metadata := map[string]any{
+		"inference-gateway":   *inferenceGateway,
+		"inference-objective": *inferenceObjective,
+	}
+
+	return []api.RequestChannel{{Channel: r.requestChannel, Metadata: metadata}}
+}
+
+func (r *JetStreamMQFlow) RetryChannel() chan api.RetryMessage {
+	return r.retryChannel
+}
+
+func (r *JetStreamMQFlow) ResultChannel() chan api.ResultMessage {
+	return r.resultChannel
+}
+
+func (r *JetStreamMQFlow) ErrorResultChannel() chan api.ResultMessage {
+	return r.errorChannel
+}
+
+// Healthy makes a round trip to the NATS server.
+func (r *JetStreamMQFlow) Healthy(ctx context.Context) error {
+	if r.nc == nil {
+		return errors.New("not connected to NATS")
+	}
+	return r.nc.FlushWithContext(ctx)
+}
+
+// Pulls the requests from the consumer and puts them in the request channel, until the iterator is stopped.
+func jetStreamRequestWorker(ctx context.Context, iter jetstream.MessagesContext, pending *sync.Map,
+	msgChannel chan api.RequestMessage) {
+	logger := log.FromContext(ctx)
+	for {
+		jmsg, err := iter.Next()
+		if err != nil {
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+				return
+			}
+			logger.V(logutil.DEFAULT).Error(err, "Failed to pull message from the JetStream consumer")
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		var msg api.RequestMessage
+		if err := json.Unmarshal(jmsg.Data(), &msg); err != nil {
+			logger.V(logutil.DEFAULT).Error(err, "Failed to unmarshal message from request subject")
+			jmsg.Term() // nolint:errcheck // never going to be processed, don't deliver it again
+			continue
+		}
+		if wait := backoffLeft(jmsg); wait > 0 {
+			// A retry whose backoff isn't over yet.
+			jmsg.NakWithDelay(wait) // nolint:errcheck
+			continue
+		}
+		meta, err := jmsg.Metadata()
+		if err != nil {
+			logger.V(logutil.DEFAULT).Error(err, "Failed to read the JetStream metadata of the message", "id", msg.Id)
+			jmsg.Nak() // nolint:errcheck
+			continue
+		}
+		id := strconv.FormatUint(meta.Sequence.Stream, 10)
+		pending.Store(id, jmsg)
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string)
+		}
+		msg.Metadata[JETSTREAM_ID] = id
+		select {
+		case msgChannel <- msg:
+		case <-ctx.Done():
+			// Nobody takes requests anymore, for JetStream to deliver it to another processor.
+			pending.Delete(id)
+			jmsg.Nak() // nolint:errcheck
+			return
+		}
+	}
+}
+
+// backoffLeft returns how long is left until the backoff of a request published again for retry is over.
+func backoffLeft(jmsg jetstream.Msg) time.Duration {
+	notBefore, err := strconv.ParseInt(jmsg.Headers().Get(notBeforeHeader), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.UnixMilli(notBefore))
+}
+
+// retryPublisher persists the requests to retry in the stream, it is a jetstream.JetStream outside of tests.
+type retryPublisher interface {
+	PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error)
+}
+
+// Publishes the requests to retry again to the request subject, with their retry count and the end of their backoff,
+// then acks the delivery they come from. Requests that couldn't be published are nak'd with their backoff instead, to
+// be retried without counting the attempt.
+func jetStreamRetryWorker(ctx context.Context, p retryPublisher, pending *sync.Map, retryChannel chan api.RetryMessage,
+	subject string) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-retryChannel:
+			value, ok := pending.LoadAndDelete(msg.RequestMessage.Metadata[JETSTREAM_ID])
+			if !ok {
+				continue
+			}
+			jmsg := value.(jetstream.Msg)
+			backoff := time.Duration(msg.BackoffDurationSeconds * float64(time.Second))
+			bytes, err := json.Marshal(msg.RequestMessage)
+			if err == nil {
+				retry := nats.NewMsg(subject)
+				retry.Data = bytes
+				retry.Header.Set(notBeforeHeader, strconv.FormatInt(time.Now().Add(backoff).UnixMilli(), 10))
+				_, err = p.PublishMsg(ctx, retry)
+			}
+			if err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to publish message for retry", "id", msg.Id)
+				// Delivered again anyway once the ack wait is over.
+				jmsg.NakWithDelay(backoff) // nolint:errcheck
+				continue
+			}
+			if err := jmsg.Ack(); err != nil {
+				// Delivered again once the ack wait is over, on top of its retry.
+				logger.V(logutil.DEFAULT).Error(err, "Failed to ack request message after its retry was published", "id", msg.Id)
+			}
+		}
+	}
+}
+
+// Marks the requests being processed as in progress every interval, for JetStream not to deliver them again while
+// their ack wait is over.
+func jetStreamHeartbeatWorker(ctx context.Context, pending *sync.Map, interval time.Duration) {
+	logger := log.FromContext(ctx)
+	ticker := time.NewTicker(max(interval, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pending.Range(func(id, value any) bool {
+				if err := value.(jetstream.Msg).InProgress(); err != nil {
+					logger.V(logutil.DEFAULT).Error(err, "Failed to mark request message as in progress", "sequence", id)
+				}
+				return ctx.Err() == nil
+			})
+		}
+	}
+}
+
+// publisher publishes the results, it is a *nats.Conn outside of tests.
+type publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Listening on the results channel and publishing the results to the result subject, then acking their requests.
+// Requests whose result couldn't be published are nak'd to be processed again once NATS has had time to recover.
+func jetStreamResultWorker(ctx context.Context, p publisher, pending *sync.Map, resultChannel chan api.ResultMessage,
+	subject string) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-resultChannel:
+			err := p.Publish(subject, api.MarshalResult(msg))
+			if err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to publish result message to NATS", "id", msg.Id)
+			}
+			value, ok := pending.LoadAndDelete(msg.Metadata[JETSTREAM_ID])
+			if !ok {
+				continue
+			}
+			jmsg := value.(jetstream.Msg)
+			if err != nil {
+				jmsg.NakWithDelay(failedResultNakDelay) // nolint:errcheck
+			} else if err := jmsg.Ack(); err != nil {
+				// Delivered again once the ack wait is over, its result is published twice.
+				logger.V(logutil.DEFAULT).Error(err, "Failed to ack request message", "id", msg.Id)
+			}
+		}
+	}
+}
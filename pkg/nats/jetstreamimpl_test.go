@@ -0,0 +1,292 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeMsg is a delivered request message recording how it is settled.
+type fakeMsg struct {
+	jetstream.Msg
+	data      []byte
+	headers   nats.Header
+	sequence  uint64
+	delivered uint64
+
+	mu         sync.Mutex
+	acked      bool
+	nakDelay   time.Duration
+	nakd       bool
+	inProgress int
+}
+
+func (m *fakeMsg) Data() []byte {
+	return m.data
+}
+
+func (m *fakeMsg) Headers() nats.Header {
+	return m.headers
+}
+
+func (m *fakeMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{Sequence: jetstream.SequencePair{Stream: m.sequence}, NumDelivered: max(m.delivered, 1)}, nil
+}
+
+func (m *fakeMsg) Ack() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acked = true
+	return nil
+}
+
+func (m *fakeMsg) Nak() error {
+	return m.NakWithDelay(0)
+}
+
+func (m *fakeMsg) NakWithDelay(delay time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nakd, m.nakDelay = true, delay
+	return nil
+}
+
+func (m *fakeMsg) InProgress() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inProgress++
+	return nil
+}
+
+func (m *fakeMsg) settled() (acked bool, nakd bool, nakDelay time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.acked, m.nakd, m.nakDelay
+}
+
+func (m *fakeMsg) inProgressCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inProgress
+}
+
+// fakeIterator hands out the messages put in its channel until stopped.
+type fakeIterator struct {
+	messages chan jetstream.Msg
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+func newFakeIterator() *fakeIterator {
+	return &fakeIterator{messages: make(chan jetstream.Msg, 10), stopped: make(chan struct{})}
+}
+
+func (it *fakeIterator) Next(opts ...jetstream.NextOpt) (jetstream.Msg, error) {
+	select {
+	case msg := <-it.messages:
+		return msg, nil
+	case <-it.stopped:
+		return nil, jetstream.ErrMsgIteratorClosed
+	}
+}
+
+func (it *fakeIterator) Stop() {
+	it.once.Do(func() { close(it.stopped) })
+}
+
+func (it *fakeIterator) Drain() {
+	it.Stop()
+}
+
+// fakeRetryPublisher records the requests published again for retry.
+type fakeRetryPublisher struct {
+	published chan *nats.Msg
+}
+
+func (p *fakeRetryPublisher) PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	p.published <- msg
+	return &jetstream.PubAck{}, nil
+}
+
+// fakePublisher records the published results.
+type fakePublisher struct {
+	published chan []byte
+	err       error
+}
+
+func (p *fakePublisher) Publish(subject string, data []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published <- data
+	return nil
+}
+
+func requestMessage(t *testing.T, sequence uint64, id string) *fakeMsg {
+	data, err := json.Marshal(api.RequestMessage{Id: id, DeadlineUnixSec: "9999999999", Payload: map[string]any{"model": "m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeMsg{data: data, sequence: sequence}
+}
+
+// startWorkers starts the request, retry and result workers of a flow over the fake iterator and publishers.
+func startWorkers(t *testing.T, it *fakeIterator, p *fakePublisher, heartbeat time.Duration) (*JetStreamMQFlow, *fakeRetryPublisher) {
+	flow := newJetStreamMQFlow(nil, nil, nil)
+	retries := &fakeRetryPublisher{published: make(chan *nats.Msg, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	t.Cleanup(it.Stop)
+	go jetStreamRequestWorker(ctx, it, &flow.pending, flow.requestChannel)
+	go jetStreamRetryWorker(ctx, retries, &flow.pending, flow.retryChannel, "request-subject")
+	go jetStreamHeartbeatWorker(ctx, &flow.pending, heartbeat)
+	go jetStreamResultWorker(ctx, p, &flow.pending, flow.resultChannel, "result-subject")
+	return flow, retries
+}
+
+func receiveRequest(t *testing.T, flow *JetStreamMQFlow) api.RequestMessage {
+	select {
+	case msg := <-flow.RequestChannels()[0].Channel:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a request")
+		return api.RequestMessage{}
+	}
+}
+
+// waitFor polls the condition until it holds or a second is over.
+func waitFor(t *testing.T, condition func() bool, failure string) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(failure)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJetStreamMQFlow_acksPublishedResults(t *testing.T) {
+	it := newFakeIterator()
+	p := &fakePublisher{published: make(chan []byte, 10)}
+	flow, _ := startWorkers(t, it, p, time.Hour)
+	jmsg := requestMessage(t, 1, "a")
+	it.messages <- jmsg
+	msg := receiveRequest(t, flow)
+
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	var result api.ResultMessage
+	if err := json.Unmarshal(<-p.published, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Id != "a" {
+		t.Errorf("Expected the result of a to be published, got %s", result.Id)
+	}
+	waitFor(t, func() bool {
+		acked, _, _ := jmsg.settled()
+		return acked
+	}, "Expected the request to be acked once its result is published")
+}
+
+func TestJetStreamMQFlow_retryIsPublishedAgain(t *testing.T) {
+	it := newFakeIterator()
+	flow, retries := startWorkers(t, it, &fakePublisher{published: make(chan []byte, 10)}, time.Hour)
+	jmsg := requestMessage(t, 1, "a")
+	it.messages <- jmsg
+	msg := receiveRequest(t, flow)
+
+	msg.RetryCount++
+	flow.RetryChannel() <- api.RetryMessage{
+		EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: msg},
+		BackoffDurationSeconds:   3,
+	}
+	var retry *nats.Msg
+	select {
+	case retry = <-retries.published:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the request to be published again for retry")
+	}
+	var retried api.RequestMessage
+	if err := json.Unmarshal(retry.Data, &retried); err != nil {
+		t.Fatal(err)
+	}
+	if retry.Subject != "request-subject" || retried.Id != "a" || retried.RetryCount != 1 {
+		t.Errorf("Expected request a to be published again with its retry count, got %+v on %s", retried, retry.Subject)
+	}
+	waitFor(t, func() bool {
+		acked, _, _ := jmsg.settled()
+		return acked
+	}, "Expected the delivery of the retried request to be acked")
+
+	// Delivered before its backoff is over, it is nak'd until then.
+	redelivered := &fakeMsg{data: retry.Data, headers: retry.Header, sequence: 2}
+	it.messages <- redelivered
+	waitFor(t, func() bool {
+		_, nakd, _ := redelivered.settled()
+		return nakd
+	}, "Expected a retry delivered before its backoff is over to be nak'd")
+	if _, _, delay := redelivered.settled(); delay <= 2*time.Second || delay > 3*time.Second {
+		t.Errorf("Expected the retry to be nak'd until its backoff is over, got %s", delay)
+	}
+}
+
+func TestJetStreamMQFlow_redeliveriesAreNotRetries(t *testing.T) {
+	it := newFakeIterator()
+	flow, _ := startWorkers(t, it, &fakePublisher{published: make(chan []byte, 10)}, time.Hour)
+	jmsg := requestMessage(t, 1, "a")
+	// Delivered before to processors that stopped, or failed to publish its result.
+	jmsg.delivered = 3
+	it.messages <- jmsg
+	if msg := receiveRequest(t, flow); msg.RetryCount != 0 {
+		t.Errorf("Expected redeliveries not to count as retries, got retry count %d", msg.RetryCount)
+	}
+}
+
+func TestJetStreamMQFlow_failedResultIsNakdWithDelay(t *testing.T) {
+	it := newFakeIterator()
+	flow, _ := startWorkers(t, it, &fakePublisher{err: errors.New("connection closed")}, time.Hour)
+	jmsg := requestMessage(t, 1, "a")
+	it.messages <- jmsg
+	msg := receiveRequest(t, flow)
+
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	waitFor(t, func() bool {
+		_, nakd, _ := jmsg.settled()
+		return nakd
+	}, "Expected a request whose result couldn't be published to be nak'd")
+	if acked, _, delay := jmsg.settled(); acked || delay != failedResultNakDelay {
+		t.Errorf("Expected the request to be nak'd with a %s delay, got acked %t, delay %s", failedResultNakDelay,
+			acked, delay)
+	}
+}
+
+func TestJetStreamMQFlow_heldRequestsAreInProgress(t *testing.T) {
+	it := newFakeIterator()
+	p := &fakePublisher{published: make(chan []byte, 10)}
+	flow, _ := startWorkers(t, it, p, 10*time.Millisecond)
+	jmsg := requestMessage(t, 1, "a")
+	it.messages <- jmsg
+	msg := receiveRequest(t, flow)
+
+	waitFor(t, func() bool { return jmsg.inProgressCount() >= 2 },
+		"Expected the request being processed to be marked in progress")
+
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	<-p.published
+	waitFor(t, func() bool {
+		acked, _, _ := jmsg.settled()
+		return acked
+	}, "Expected the request to be acked once its result is published")
+	time.Sleep(20 * time.Millisecond) // for a heartbeat that loaded it before it was acked
+	count := jmsg.inProgressCount()
+	time.Sleep(50 * time.Millisecond)
+	if jmsg.inProgressCount() != count {
+		t.Errorf("Expected an acked request not to be marked in progress anymore")
+	}
+}
@@ -0,0 +1,182 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"github.com/nats-io/nats.go"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+var (
+	natsURL = flag.String("nats.url", nats.DefaultURL, "URL of the NATS server")
+
+	inferenceGateway   = flag.String("nats.inference-gateway", "http://localhost:30080/v1/completions", "inference gateway endpoint")
+	inferenceObjective = flag.String("nats.inference-objective", "", "inference objective to use in requests")
+	requestSubject     = flag.String("nats.request-subject", "request-queue", "NATS subject of the request messages")
+	queueGroup         = flag.String("nats.queue-group", "", "NATS queue group shared by the processors, so that each request is received by only one of them. Every processor receives every request if empty")
+	resultSubject      = flag.String("nats.result-subject", "result-queue", "NATS subject of the result messages")
+	errorSubject       = flag.String("nats.error-subject", "", "NATS subject of the error results. Errors are published to the result subject if empty")
+)
+
+// NATSCoreMQFlow is a Flow over core NATS, without JetStream. Nothing is persisted: requests published while no
+// processor is subscribed, or dropped by a slow processor, are lost, and retries wait for their backoff in memory
+// before being published again. Meant for latency-sensitive requests that are better dropped than delayed.
+type NATSCoreMQFlow struct {
+	nc             *nats.Conn
+	requestChannel chan api.RequestMessage
+	retryChannel   chan api.RetryMessage
+	resultChannel  chan api.ResultMessage
+	errorChannel   chan api.ResultMessage
+}
+
+func NewNATSCoreMQFlow() (*NATSCoreMQFlow, error) {
+	nc, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	flow := &NATSCoreMQFlow{
+		nc:             nc,
+		requestChannel: make(chan api.RequestMessage),
+		retryChannel:   make(chan api.RetryMessage),
+		resultChannel:  api.NewResultChannel(),
+	}
+	if *errorSubject != "" {
+		flow.errorChannel = api.NewErrorResultChannel()
+	}
+	return flow, nil
+}
+
+// connect connects to the NATS server, reconnecting forever when the connection is lost.
+func connect() (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name("llm-d-async"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if *api.BrokerKeepaliveInterval > 0 {
+		opts = append(opts, nats.PingInterval(*api.BrokerKeepaliveInterval))
+	}
+	return nats.Connect(*natsURL, opts...)
+}
+
+func (r *NATSCoreMQFlow) Start(ctx context.Context) {
+	go requestWorker(api.ConsumeContext(ctx), r.nc, r.requestChannel, *requestSubject, *queueGroup)
+
+	go retryWorker(ctx, r.nc, r.retryChannel, *requestSubject)
+
+	for range api.ResultWorkerCount() {
+		go resultWorker(ctx, r.nc, r.resultChannel, *resultSubject)
+	}
+	if r.errorChannel != nil {
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, r.nc, r.errorChannel, *errorSubject)
+		}
+	}
+}
+
+func (r *NATSCoreMQFlow) Characteristics() api.Characteristics {
+	return api.Characteristics{
+		HasExternalBackoff: false,
+	}
+}
+
+func (r *NATSCoreMQFlow) RequestChannels() []api.RequestChannel {
+
+	metadata := map[string]any{
+		"inference-gateway":   *inferenceGateway,
+		"inference-objective": *inferenceObjective,
+	}
+
+	return []api.RequestChannel{{Channel: r.requestChannel, Metadata: metadata}}
+}
+
+func (r *NATSCoreMQFlow) RetryChannel() chan api.RetryMessage {
+	return r.retryChannel
+}
+
+func (r *NATSCoreMQFlow) ResultChannel() chan api.ResultMessage {
+	return r.resultChannel
+}
+
+func (r *NATSCoreMQFlow) ErrorResultChannel() chan api.ResultMessage {
+	return r.errorChannel
+}
+
+// Healthy makes a round trip to the NATS server.
+func (r *NATSCoreMQFlow) Healthy(ctx context.Context) error {
+	return r.nc.FlushWithContext(ctx)
+}
+
+// Subscribes to the request subject and puts the requests in the request channel. The subscription is drained once
+// the context is done.
+func requestWorker(ctx context.Context, nc *nats.Conn, msgChannel chan api.RequestMessage, subject string, queue string) {
+	logger := log.FromContext(ctx)
+	sub, err := nc.QueueSubscribe(subject, queue, func(nmsg *nats.Msg) {
+		var msg api.RequestMessage
+		if err := json.Unmarshal(nmsg.Data, &msg); err != nil {
+			logger.V(logutil.DEFAULT).Error(err, "Failed to unmarshal message from request subject")
+			return // skip this message
+		}
+		select {
+		case msgChannel <- msg:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		logger.V(logutil.DEFAULT).Error(err, "Failed to subscribe to the request subject", "subject", subject)
+		return
+	}
+	<-ctx.Done()
+	sub.Drain() // nolint:errcheck
+}
+
+// Publishes the requests to retry back to the request subject once their backoff is over. Pending retries are lost if
+// the processor stops.
+func retryWorker(ctx context.Context, nc *nats.Conn, retryChannel chan api.RetryMessage, subject string) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-retryChannel:
+			bytes, err := json.Marshal(msg.RequestMessage)
+			if err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to marshal message for retry")
+				continue // skip this message.
+			}
+			time.AfterFunc(time.Duration(msg.BackoffDurationSeconds*float64(time.Second)), func() {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := nc.Publish(subject, bytes); err != nil {
+					logger.V(logutil.DEFAULT).Error(err, "Failed to publish message for retry", "id", msg.Id)
+				}
+			})
+		}
+	}
+}
+
+// Listening on the results channel and publishing the results to the result subject.
+func resultWorker(ctx context.Context, nc *nats.Conn, resultChannel chan api.ResultMessage, subject string) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-resultChannel:
+			if err := nc.Publish(subject, api.MarshalResult(msg)); err != nil {
+				// Not going to retry here. Just log the error.
+				logger.V(logutil.DEFAULT).Error(err, "Failed to publish result message to NATS", "id", msg.Id)
+			}
+		}
+	}
+}
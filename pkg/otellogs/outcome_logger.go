@@ -0,0 +1,65 @@
+package otellogs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+const loggerName = "github.com/llm-d-incubation/llm-d-async"
+
+// OutcomeLogger is an api.OutcomeSink emitting a sample of the request outcomes as OpenTelemetry log records. The
+// records are batched and handed to the exporter in the background.
+type OutcomeLogger struct {
+	provider   *sdklog.LoggerProvider
+	logger     otellog.Logger
+	sampleRate float64
+}
+
+// NewOutcomeLogger creates an OutcomeLogger exporting to the given exporter, typically an OTLP one. sampleRate is the
+// fraction of the outcomes to emit, between 0 and 1.
+func NewOutcomeLogger(exporter sdklog.Exporter, sampleRate float64) (*OutcomeLogger, error) {
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("otel logs sample rate must be between 0 and 1, got %v", sampleRate)
+	}
+	provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)))
+	return &OutcomeLogger{
+		provider:   provider,
+		logger:     provider.Logger(loggerName),
+		sampleRate: sampleRate,
+	}, nil
+}
+
+func (l *OutcomeLogger) RecordOutcome(ctx context.Context, outcome api.Outcome) {
+	if rand.Float64() >= l.sampleRate {
+		return
+	}
+	var record otellog.Record
+	record.SetTimestamp(time.Now())
+	record.SetEventName("async.request.outcome")
+	if outcome.Result == api.OutcomeFailed {
+		record.SetSeverity(otellog.SeverityWarn)
+	} else {
+		record.SetSeverity(otellog.SeverityInfo)
+	}
+	record.SetBody(otellog.StringValue(fmt.Sprintf("request %s %s", outcome.Request.Id, outcome.Result)))
+	record.AddAttributes(
+		otellog.String("request.id", outcome.Request.Id),
+		otellog.String("endpoint", outcome.Endpoint),
+		otellog.Float64("latency_seconds", outcome.Latency.Seconds()),
+		otellog.Int("http.status_code", outcome.StatusCode),
+		otellog.String("outcome", string(outcome.Result)),
+		otellog.Int("retry_count", outcome.Request.RetryCount),
+	)
+	l.logger.Emit(ctx, record)
+}
+
+// Shutdown flushes the pending records and shuts the exporter down.
+func (l *OutcomeLogger) Shutdown(ctx context.Context) error {
+	return l.provider.Shutdown(ctx)
+}
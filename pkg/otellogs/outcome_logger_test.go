@@ -0,0 +1,94 @@
+package otellogs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+type fakeExporter struct {
+	mu      sync.Mutex
+	records []sdklog.Record
+}
+
+func (e *fakeExporter) Export(_ context.Context, records []sdklog.Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range records {
+		e.records = append(e.records, r.Clone())
+	}
+	return nil
+}
+
+func (e *fakeExporter) Shutdown(context.Context) error   { return nil }
+func (e *fakeExporter) ForceFlush(context.Context) error { return nil }
+
+func TestOutcomeLogger(t *testing.T) {
+	ctx := context.Background()
+	exporter := &fakeExporter{}
+	logger, err := NewOutcomeLogger(exporter, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.RecordOutcome(ctx, api.Outcome{
+		Request:    api.RequestMessage{Id: "123", RetryCount: 2},
+		Endpoint:   "http://gateway/v1/completions",
+		Latency:    1500 * time.Millisecond,
+		StatusCode: 503,
+		Result:     api.OutcomeRetried,
+	})
+	if err := logger.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exporter.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(exporter.records))
+	}
+	attributes := map[string]otellog.Value{}
+	exporter.records[0].WalkAttributes(func(kv otellog.KeyValue) bool {
+		attributes[kv.Key] = kv.Value
+		return true
+	})
+	if got := attributes["request.id"].AsString(); got != "123" {
+		t.Errorf("expected request.id 123, got %q", got)
+	}
+	if got := attributes["endpoint"].AsString(); got != "http://gateway/v1/completions" {
+		t.Errorf("unexpected endpoint %q", got)
+	}
+	if got := attributes["latency_seconds"].AsFloat64(); got != 1.5 {
+		t.Errorf("expected latency 1.5s, got %v", got)
+	}
+	if got := attributes["http.status_code"].AsInt64(); got != 503 {
+		t.Errorf("expected status 503, got %d", got)
+	}
+	if got := attributes["outcome"].AsString(); got != "retried" {
+		t.Errorf("expected outcome retried, got %q", got)
+	}
+}
+
+func TestOutcomeLogger_sampling(t *testing.T) {
+	ctx := context.Background()
+	exporter := &fakeExporter{}
+	logger, err := NewOutcomeLogger(exporter, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		logger.RecordOutcome(ctx, api.Outcome{Request: api.RequestMessage{Id: "123"}, Result: api.OutcomeSuccess})
+	}
+	if err := logger.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.records) != 0 {
+		t.Errorf("expected no record with a zero sample rate, got %d", len(exporter.records))
+	}
+
+	if _, err := NewOutcomeLogger(exporter, 2); err == nil {
+		t.Error("expected an error for a sample rate over 1")
+	}
+}
@@ -8,13 +8,21 @@ import (
 	"sync"
 
 	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
 	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
 )
 
 const PUBSUB_ID = "pubsub-id"
 
+// CONTENT_TYPE_ATTRIBUTE marks a binary request message. Its data is sent as is, with this Content-Type, and its 'id'
+// and 'deadline' are taken from the attributes.
+const CONTENT_TYPE_ATTRIBUTE = "content_type"
+
 var pubSubClient *pubsub.Client
 
 var (
@@ -24,32 +32,54 @@ var (
 	inferenceObjective  = flag.String("pubsub.inference-objective", "", "inference objective to use in requests")
 	requestSubscriberID = flag.String("pubsub.request-subscriber-id", "", "GCP PubSub request topic subscriber ID")
 	resultTopicID       = flag.String("pubsub.result-topic-id", "", "GCP PubSub topic ID for results")
+	errorTopicID        = flag.String("pubsub.error-topic-id", "", "GCP PubSub topic ID for error results. Errors are published to the result topic if empty")
+	deadLetterTopicID   = flag.String("pubsub.dead-letter-topic-id", "", "GCP PubSub topic ID for the requests that exhausted their retries. They are published with the error results if empty")
 	resultChannels      sync.Map
 )
 
 type PubSubMQFlow struct {
 	resultTopicID  string
+	errorTopicID   string
+	deadLetterID   string
 	requestChannel chan api.RequestMessage
 	retryChannel   chan api.RetryMessage
 	resultChannel  chan api.ResultMessage
+	errorChannel   chan api.ResultMessage
+	deadLetters    chan api.ResultMessage
+	pendingResults api.PendingResults
 }
 
-func NewGCPPubSubMQFlow() *PubSubMQFlow {
+func NewGCPPubSubMQFlow() (*PubSubMQFlow, error) {
 
 	ctx := context.Background()
 	var err error
-	pubSubClient, err = pubsub.NewClient(ctx, *projectID)
+	var opts []option.ClientOption
+	if *api.BrokerKeepaliveInterval > 0 {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                *api.BrokerKeepaliveInterval,
+			PermitWithoutStream: true,
+		})))
+	}
+	pubSubClient, err = pubsub.NewClient(ctx, *projectID, opts...)
 	if err != nil {
-		// TODO:
-		panic(err)
+		return nil, err
 	}
 
-	return &PubSubMQFlow{
+	flow := &PubSubMQFlow{
 		resultTopicID:  *resultTopicID,
+		errorTopicID:   *errorTopicID,
+		deadLetterID:   *deadLetterTopicID,
 		requestChannel: make(chan api.RequestMessage),
 		retryChannel:   make(chan api.RetryMessage),
-		resultChannel:  make(chan api.ResultMessage),
+		resultChannel:  api.NewResultChannel(),
+	}
+	if flow.errorTopicID != "" {
+		flow.errorChannel = api.NewErrorResultChannel()
+	}
+	if flow.deadLetterID != "" {
+		flow.deadLetters = api.NewErrorResultChannel()
 	}
+	return flow, nil
 }
 
 func (r *PubSubMQFlow) RetryChannel() chan api.RetryMessage {
@@ -60,9 +90,30 @@ func (r *PubSubMQFlow) ResultChannel() chan api.ResultMessage {
 	return r.resultChannel
 }
 
+func (r *PubSubMQFlow) ErrorResultChannel() chan api.ResultMessage {
+	return r.errorChannel
+}
+
+func (r *PubSubMQFlow) DeadLetterChannel() chan api.ResultMessage {
+	return r.deadLetters
+}
+
+// Healthy reports the flow healthy as long as the request subscription can be looked up.
+func (r *PubSubMQFlow) Healthy(ctx context.Context) error {
+	_, err := pubSubClient.SubscriptionAdminClient.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{
+		Subscription: pubSubClient.Subscriber(*requestSubscriberID).String(),
+	})
+	return err
+}
+
+func (r *PubSubMQFlow) PendingResults() int {
+	return r.pendingResults.Count()
+}
+
 func (r *PubSubMQFlow) Characteristics() api.Characteristics {
 	return api.Characteristics{
 		HasExternalBackoff: true,
+		AcksOnResult:       true,
 	}
 }
 
@@ -77,14 +128,34 @@ func (r *PubSubMQFlow) RequestChannels() []api.RequestChannel {
 }
 
 func (r *PubSubMQFlow) Start(ctx context.Context) {
-	go requestWorker(ctx, pubSubClient, *requestSubscriberID, r.requestChannel)
-	publisher := pubSubClient.Publisher(r.resultTopicID)
-	go resultWorker(ctx, publisher, r.resultChannel)
+	go requestWorker(api.ConsumeContext(ctx), pubSubClient, *requestSubscriberID, r.requestChannel)
+	publisher := newPublisher(r.resultTopicID)
+	var errorPublisher *pubsub.Publisher
+	if r.errorChannel != nil {
+		errorPublisher = newPublisher(r.errorTopicID)
+	}
+	// Publishers are safe for concurrent use, the result workers share them.
+	for range api.ResultWorkerCount() {
+		go resultWorker(ctx, publisher, r.resultChannel, &r.pendingResults)
+	}
+	if r.errorChannel != nil {
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, errorPublisher, r.errorChannel, &r.pendingResults)
+		}
+	}
+	if r.deadLetters != nil {
+		deadLetterPublisher := newPublisher(r.deadLetterID)
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, deadLetterPublisher, r.deadLetters, &r.pendingResults)
+		}
+	}
 
 	go addMsgToRetryQueue(ctx, r.retryChannel)
 }
 
-func resultWorker(ctx context.Context, publisher *pubsub.Publisher, resultChannel chan api.ResultMessage) {
+func resultWorker(ctx context.Context, publisher *pubsub.Publisher, resultChannel chan api.ResultMessage,
+	pending *api.PendingResults) {
+	logger := log.FromContext(ctx)
 
 	for {
 		select {
@@ -92,6 +163,7 @@ func resultWorker(ctx context.Context, publisher *pubsub.Publisher, resultChanne
 			return
 
 		case msg := <-resultChannel:
+			pending.Add(1)
 			bytes, err := json.Marshal(msg)
 			var msgBytes []byte
 			if err != nil {
@@ -99,23 +171,45 @@ func resultWorker(ctx context.Context, publisher *pubsub.Publisher, resultChanne
 			} else {
 				msgBytes = bytes
 			}
-			publishPubSub(ctx, publisher, msgBytes, map[string]string{})
+			publishResult := publishPubSub(ctx, publisher, msgBytes, map[string]string{})
 			pubsubID := msg.Metadata[PUBSUB_ID]
-			value, _ := resultChannels.Load(pubsubID)
-			resultChannel := value.(chan bool)
-			resultChannel <- true
+			value, ok := resultChannels.Load(pubsubID)
+			if !ok {
+				// The request isn't held anymore, e.g. its receive callback returned: nothing to ack.
+				logger.V(logutil.DEFAULT).Info("No pending request for result", "id", msg.Id, "pubsubID", pubsubID)
+			}
+			// The result may wait for its batch: the request is acked once the result is actually published, and
+			// redelivered if it couldn't be.
+			go func() {
+				_, err := publishResult.Get(ctx)
+				if ok {
+					value.(chan bool) <- err == nil
+				}
+				pending.Add(-1)
+			}()
 
 		}
 	}
 }
 
-func publishPubSub(ctx context.Context, publisher *pubsub.Publisher, msg []byte, attrs map[string]string) {
-	// TODO: check how to validate that message are actually being published
-	publisher.Publish(ctx, &pubsub.Message{
+func publishPubSub(ctx context.Context, publisher *pubsub.Publisher, msg []byte, attrs map[string]string) *pubsub.PublishResult {
+	return publisher.Publish(ctx, &pubsub.Message{
 		Data:       msg,
 		Attributes: attrs,
 	})
+}
 
+// newPublisher returns a publisher batching the results as configured. The client batches by default, the flags only
+// override its settings.
+func newPublisher(topicID string) *pubsub.Publisher {
+	publisher := pubSubClient.Publisher(topicID)
+	if *api.ResultPublishBatchSize > 0 {
+		publisher.PublishSettings.CountThreshold = *api.ResultPublishBatchSize
+	}
+	if *api.ResultPublishBatchWindow > 0 {
+		publisher.PublishSettings.DelayThreshold = *api.ResultPublishBatchWindow
+	}
+	return publisher
 }
 
 func addMsgToRetryQueue(ctx context.Context, retryChannel chan api.RetryMessage) {
@@ -128,7 +222,11 @@ func addMsgToRetryQueue(ctx context.Context, retryChannel chan api.RetryMessage)
 
 		case msg := <-retryChannel:
 			pubsubID := msg.RequestMessage.Metadata[PUBSUB_ID]
-			value, _ := resultChannels.Load(pubsubID)
+			value, ok := resultChannels.Load(pubsubID)
+			if !ok {
+				logger.V(logutil.DEFAULT).Info("No pending request for retry", "id", msg.Id, "pubsubID", pubsubID)
+				continue
+			}
 			resultChannel := value.(chan bool)
 			logger.V(logutil.DEBUG).Info("Retrying message", "pubsubID", pubsubID)
 			resultChannel <- false
@@ -145,8 +243,15 @@ func requestWorker(ctx context.Context, pubSubClient *pubsub.Client, subscriberI
 
 	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
 		var msgObj api.RequestMessage
-		err := json.Unmarshal(msg.Data, &msgObj)
-		if err != nil {
+		if contentType, ok := msg.Attributes[CONTENT_TYPE_ATTRIBUTE]; ok {
+			// Binary request: the data is the raw body, the rest of the message is in the attributes.
+			msgObj = api.RequestMessage{
+				Id:              msg.Attributes["id"],
+				DeadlineUnixSec: msg.Attributes["deadline"],
+				ContentType:     contentType,
+				Body:            msg.Data,
+			}
+		} else if err := json.Unmarshal(msg.Data, &msgObj); err != nil {
 			logger.V(logutil.DEFAULT).Error(err, "Failed to unmarshal message from request queue")
 			msg.Ack()
 			return
@@ -154,13 +259,19 @@ func requestWorker(ctx context.Context, pubSubClient *pubsub.Client, subscriberI
 
 		resultsChannel := make(chan bool, 1)
 		resultChannels.Store(msg.ID, resultsChannel)
-		defer resultChannels.Delete(msgObj.Id)
+		defer resultChannels.Delete(msg.ID)
 
 		if msgObj.Metadata == nil {
 			msgObj.Metadata = make(map[string]string)
 		}
 		msgObj.Metadata[PUBSUB_ID] = msg.ID
-		ch <- msgObj
+		select {
+		case ch <- msgObj:
+		case <-ctx.Done():
+			// Nobody takes requests anymore, for Pub/Sub to deliver it to another processor.
+			msg.Nack()
+			return
+		}
 
 		result := <-resultsChannel
 		if !result {
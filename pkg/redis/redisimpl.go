@@ -3,9 +3,10 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-
+	"math/rand/v2"
 	"strconv"
 	"time"
 
@@ -24,37 +25,85 @@ var (
 	inferenceObjective = flag.String("redis.inference-objective", "", "inference objective to use in requests")
 	requestQueueName   = flag.String("redis.request-queue-name", "request-queue", "name of the Redis channel for request messages")
 
-	retryQueueName  = flag.String("redis.retry-queue-name", "retry-sortedset", "name of the Redis sorted set for retry messages")
-	resultQueueName = flag.String("redis.result-queue-name", "result-queue", "name of the Redis channel for result messages")
+	retryQueueName      = flag.String("redis.retry-queue-name", "retry-sortedset", "name of the Redis sorted set for retry messages")
+	resultQueueName     = flag.String("redis.result-queue-name", "result-queue", "name of the Redis channel for result messages")
+	errorQueueName      = flag.String("redis.error-queue-name", "", "name of the Redis channel for error results. Errors are published to the result channel if empty")
+	deadLetterQueueName = flag.String("redis.dead-letter-queue-name", "", "name of the Redis channel for the requests that exhausted their retries. They are published with the error results if empty")
+
+	retryPayloadByReference = flag.Bool("redis.retry-payload-by-reference", false, "store the payload of a retried request in its own key, instead of in the retry sorted set")
 )
 
+// retryMember is a message waiting in the retry sorted set. When PayloadRef is set, the payload and body of the
+// request are stored under that key instead of in the member.
+type retryMember struct {
+	api.RequestMessage
+	PayloadRef string `json:"payload_ref,omitempty"`
+}
+
+// retryPayload is what is stored under the PayloadRef of a retryMember.
+type retryPayload struct {
+	Payload map[string]any `json:"payload,omitempty"`
+	Body    []byte         `json:"body,omitempty"`
+}
+
+// payloadRetention is how long a stored payload outlives the deadline of its request, for the last retry to be able to
+// read it.
+const payloadRetention = time.Minute
+
 type RedisMQFlow struct {
 	rdb            *redis.Client
 	requestChannel chan api.RequestMessage
 	retryChannel   chan api.RetryMessage
 	resultChannel  chan api.ResultMessage
+	errorChannel   chan api.ResultMessage
+	deadLetters    chan api.ResultMessage
+	pendingResults api.PendingResults
 }
 
 func NewRedisMQFlow() *RedisMQFlow {
 	rdb := redis.NewClient(&redis.Options{
 		Addr: *redisAddr,
 	})
-	return &RedisMQFlow{
+	flow := &RedisMQFlow{
 		rdb:            rdb,
 		requestChannel: make(chan api.RequestMessage),
 		retryChannel:   make(chan api.RetryMessage),
-		resultChannel:  make(chan api.ResultMessage),
+		resultChannel:  api.NewResultChannel(),
+	}
+	if *errorQueueName != "" {
+		flow.errorChannel = api.NewErrorResultChannel()
+	}
+	if *deadLetterQueueName != "" {
+		flow.deadLetters = api.NewErrorResultChannel()
 	}
+	return flow
 }
 
 func (r *RedisMQFlow) Start(ctx context.Context) {
-	go requestWorker(ctx, r.rdb, r.requestChannel, *requestQueueName)
+	go requestWorker(api.ConsumeContext(ctx), r.rdb, r.requestChannel, *requestQueueName)
 
-	go addMsgToRetryWorker(ctx, r.rdb, r.retryChannel, *retryQueueName)
+	go addMsgToRetryWorker(ctx, r.rdb, r.retryChannel, *retryQueueName, *retryPayloadByReference)
 
-	go retryWorker(ctx, r.rdb, r.requestChannel)
+	go retryWorker(api.ConsumeContext(ctx), r.rdb, r.requestChannel)
 
-	go resultWorker(ctx, r.rdb, r.resultChannel, *resultQueueName)
+	batchSize, batchWindow := *api.ResultPublishBatchSize, *api.ResultPublishBatchWindow
+	for range api.ResultWorkerCount() {
+		go resultWorker(ctx, r.rdb, r.resultChannel, &r.pendingResults, *resultQueueName, batchSize, batchWindow)
+	}
+	if r.errorChannel != nil {
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, r.rdb, r.errorChannel, &r.pendingResults, *errorQueueName, batchSize, batchWindow)
+		}
+	}
+	if r.deadLetters != nil {
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, r.rdb, r.deadLetters, &r.pendingResults, *deadLetterQueueName, batchSize, batchWindow)
+		}
+	}
+
+	if *api.BrokerKeepaliveInterval > 0 {
+		go keepaliveWorker(ctx, r.rdb, *api.BrokerKeepaliveInterval)
+	}
 }
 func (r *RedisMQFlow) RequestChannels() []api.RequestChannel {
 
@@ -74,8 +123,42 @@ func (r *RedisMQFlow) ResultChannel() chan api.ResultMessage {
 	return r.resultChannel
 }
 
+func (r *RedisMQFlow) ErrorResultChannel() chan api.ResultMessage {
+	return r.errorChannel
+}
+
+func (r *RedisMQFlow) DeadLetterChannel() chan api.ResultMessage {
+	return r.deadLetters
+}
+
+func (r *RedisMQFlow) PendingResults() int {
+	return r.pendingResults.Count()
+}
+
+func (r *RedisMQFlow) Healthy(ctx context.Context) error {
+	return r.rdb.Ping(ctx).Err()
+}
+
+// Pings Redis every interval, so a dead connection is detected and replaced while idle.
+func keepaliveWorker(ctx context.Context, rdb *redis.Client, interval time.Duration) {
+	logger := log.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rdb.Ping(ctx).Err(); err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to ping Redis")
+			}
+		}
+	}
+}
+
 // Listening on the results channel and responsible for writing results into Redis.
-func resultWorker(ctx context.Context, rdb *redis.Client, resultChannel chan api.ResultMessage, resultsQueueName string) {
+func resultWorker(ctx context.Context, rdb *redis.Client, resultChannel chan api.ResultMessage, pending *api.PendingResults,
+	resultsQueueName string, batchSize int, batchWindow time.Duration) {
 	logger := log.FromContext(ctx)
 	for {
 		select {
@@ -83,18 +166,17 @@ func resultWorker(ctx context.Context, rdb *redis.Client, resultChannel chan api
 			return
 
 		case msg := <-resultChannel:
-			bytes, err := json.Marshal(msg)
-			var msgStr string
-			if err != nil {
-				msgStr = fmt.Sprintf(`{"id" : "%s", "error": "%s"}`, msg.Id, "Failed to marshal result to string")
-			} else {
-				msgStr = string(bytes)
+			batch := api.CollectResultBatch(ctx, msg, resultChannel, batchSize, batchWindow, pending)
+			msgStrs := make([]string, len(batch))
+			for i, msg := range batch {
+				msgStrs[i] = string(api.MarshalResult(msg))
 			}
-			err = publishRedis(ctx, rdb, resultsQueueName, msgStr)
+			err := publishRedis(ctx, rdb, resultsQueueName, msgStrs...)
 			if err != nil {
 				// Not going to retry here. Just log the error.
-				logger.V(logutil.DEFAULT).Error(err, "Failed to publish result message to Redis")
+				logger.V(logutil.DEFAULT).Error(err, "Failed to publish result message to Redis", "results", len(batch))
 			}
+			pending.Add(-len(batch))
 		}
 	}
 }
@@ -105,7 +187,11 @@ func requestWorker(ctx context.Context, rdb *redis.Client, msgChannel chan api.R
 	sub := rdb.Subscribe(ctx, queueName)
 	defer sub.Close()
 
-	ch := sub.Channel()
+	var channelOpts []redis.ChannelOption
+	if *api.BrokerKeepaliveInterval > 0 {
+		channelOpts = append(channelOpts, redis.WithChannelHealthCheckInterval(*api.BrokerKeepaliveInterval))
+	}
+	ch := sub.Channel(channelOpts...)
 	for {
 		select {
 		case <-ctx.Done():
@@ -120,7 +206,15 @@ func requestWorker(ctx context.Context, rdb *redis.Client, msgChannel chan api.R
 				continue // skip this message
 
 			}
-			msgChannel <- msg
+			select {
+			case msgChannel <- msg:
+			case <-ctx.Done():
+				// Nobody takes requests anymore: handing it back to the queue for another processor.
+				if err := publishRedis(context.WithoutCancel(ctx), rdb, queueName, rmsg.Payload); err != nil {
+					logger.V(logutil.DEFAULT).Error(err, "Failed to hand a request back to the request queue", "id", msg.Id)
+				}
+				return
+			}
 		}
 	}
 
@@ -132,8 +226,10 @@ func (r *RedisMQFlow) Characteristics() api.Characteristics {
 	}
 }
 
-// Puts msgs from the retry channel into a Redis sorted-set with a duration Score.
-func addMsgToRetryWorker(ctx context.Context, rdb *redis.Client, retryChannel chan api.RetryMessage, sortedSetName string) {
+// Puts msgs from the retry channel into a Redis sorted-set with a duration Score. When byReference is set, the payload
+// of a request is stored in its own key, and the member only carries the key.
+func addMsgToRetryWorker(ctx context.Context, rdb *redis.Client, retryChannel chan api.RetryMessage, sortedSetName string,
+	byReference bool) {
 	logger := log.FromContext(ctx)
 	for {
 		select {
@@ -142,7 +238,19 @@ func addMsgToRetryWorker(ctx context.Context, rdb *redis.Client, retryChannel ch
 
 		case msg := <-retryChannel:
 			score := float64(time.Now().Unix()) + msg.BackoffDurationSeconds
-			bytes, err := json.Marshal(msg.RequestMessage)
+			member := retryMember{RequestMessage: msg.RequestMessage}
+			if byReference {
+				ref, err := storeRetryPayload(ctx, rdb, sortedSetName, msg.RequestMessage)
+				if err != nil {
+					// Not fatal, the payload travels with the retry as usual.
+					logger.V(logutil.DEFAULT).Error(err, "Failed to store the payload for retry in Redis", "id", msg.Id)
+				} else {
+					member.PayloadRef = ref
+					member.Payload = nil
+					member.Body = nil
+				}
+			}
+			bytes, err := json.Marshal(member)
 			if err != nil {
 				logger.V(logutil.DEFAULT).Error(err, "Failed to marshal message for retry in Redis")
 				continue // skip this message.
@@ -161,8 +269,43 @@ func addMsgToRetryWorker(ctx context.Context, rdb *redis.Client, retryChannel ch
 
 }
 
+// Stores the payload of the request under a key of its own, until a while after its deadline. Returns the key. Every
+// retry gets its own key, so that retries of requests sharing an id never read or delete each other's payload.
+func storeRetryPayload(ctx context.Context, rdb *redis.Client, sortedSetName string, msg api.RequestMessage) (string, error) {
+	deadline, err := strconv.ParseInt(msg.DeadlineUnixSec, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid deadline: %w", err)
+	}
+	bytes, err := json.Marshal(retryPayload{Payload: msg.Payload, Body: msg.Body})
+	if err != nil {
+		return "", err
+	}
+	key := sortedSetName + ":payload:" + msg.Id + ":" + strconv.FormatUint(rand.Uint64(), 36)
+	ttl := time.Until(time.Unix(deadline, 0)) + payloadRetention
+	if err := rdb.Set(ctx, key, bytes, ttl).Err(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Reads back the payload of a retried request stored by reference.
+func loadRetryPayload(ctx context.Context, rdb *redis.Client, member *retryMember) error {
+	bytes, err := rdb.Get(ctx, member.PayloadRef).Bytes()
+	if err != nil {
+		return err
+	}
+	var payload retryPayload
+	if err := json.Unmarshal(bytes, &payload); err != nil {
+		return err
+	}
+	member.Payload = payload.Payload
+	member.Body = payload.Body
+	return nil
+}
+
 // Every second polls the sorted set and publishes the messages that need to be retried into the request queue
 func retryWorker(ctx context.Context, rdb *redis.Client, msgChannel chan api.RequestMessage) {
+	logger := log.FromContext(ctx)
 	for {
 		select {
 		case <-ctx.Done():
@@ -175,23 +318,63 @@ func retryWorker(ctx context.Context, rdb *redis.Client, msgChannel chan api.Req
 				Max: strconv.FormatFloat(currentTimeSec, 'f', -1, 64),
 			}).Result()
 			if err != nil {
-				panic(err)
+				// Redis may be unreachable for a while, keep polling.
+				logger.V(logutil.DEFAULT).Error(err, "Failed to poll the retry sorted set")
+				time.Sleep(time.Second)
+				continue
 			}
 			for _, msg := range results {
-				var message api.RequestMessage
-				err := json.Unmarshal([]byte(msg), &message)
-				if err != nil {
-					fmt.Println(err)
-
+				if ctx.Err() != nil {
+					// Not taking retries anymore, the rest stay in the sorted set for another processor.
+					return
 				}
-				err = rdb.ZRem(ctx, *retryQueueName, msg).Err()
+				var message retryMember
+				if err := json.Unmarshal([]byte(msg), &message); err != nil {
+					logger.V(logutil.DEFAULT).Error(err, "Failed to unmarshal message from the retry sorted set")
+					rdb.ZRem(ctx, *retryQueueName, msg) // nolint:errcheck // never going to be retried
+					continue
+				}
+				if message.PayloadRef != "" {
+					// Loaded before the member is taken out of the sorted set, so it stays there if Redis can't be read.
+					err := loadRetryPayload(ctx, rdb, &message)
+					if errors.Is(err, redis.Nil) {
+						// The payload expired: without it the request can't be dispatched.
+						logger.V(logutil.DEFAULT).Info("Dropping a retried message whose payload expired", "id", message.Id)
+						rdb.ZRem(ctx, *retryQueueName, msg) // nolint:errcheck
+						continue
+					}
+					if err != nil {
+						logger.V(logutil.DEFAULT).Error(err, "Failed to load the payload of a retried message", "id", message.Id)
+						continue
+					}
+				}
+				removed, err := rdb.ZRem(ctx, *retryQueueName, msg).Result()
 				if err != nil {
-					fmt.Println(err)
-
+					logger.V(logutil.DEFAULT).Error(err, "Failed to take a message out of the retry sorted set", "id", message.Id)
+					continue
+				}
+				if removed == 0 {
+					// Taken by another processor.
+					continue
 				}
 				// TODO: We probably want to write here back to the request queue/channel in Redis. Adding the msg to the
 				// golang channel directly is not that wise as this might be blocking.
-				msgChannel <- message
+				select {
+				case msgChannel <- message.RequestMessage:
+				case <-ctx.Done():
+					// Putting it back, due right away, for another processor.
+					err := rdb.ZAdd(context.WithoutCancel(ctx), *retryQueueName, redis.Z{Score: currentTimeSec, Member: msg}).Err()
+					if err != nil {
+						logger.V(logutil.DEFAULT).Error(err, "Failed to put a message back for retry in Redis", "id", message.Id)
+					}
+					return
+				}
+				if message.PayloadRef != "" {
+					// The request is retried with its payload, which is stored again if it fails once more.
+					if err := rdb.Del(ctx, message.PayloadRef).Err(); err != nil {
+						logger.V(logutil.DEFAULT).Error(err, "Failed to delete the payload of a retried message", "id", message.Id)
+					}
+				}
 			}
 			time.Sleep(time.Second)
 		}
@@ -199,9 +382,20 @@ func retryWorker(ctx context.Context, rdb *redis.Client, msgChannel chan api.Req
 
 }
 
-func publishRedis(ctx context.Context, rdb *redis.Client, channelId, msg string) error {
+// Publishes the messages in a single round trip.
+func publishRedis(ctx context.Context, rdb *redis.Client, channelId string, msgs ...string) error {
 	logger := log.FromContext(ctx)
-	err := rdb.Publish(ctx, channelId, msg).Err()
+	var err error
+	if len(msgs) == 1 {
+		err = rdb.Publish(ctx, channelId, msgs[0]).Err()
+	} else {
+		_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, msg := range msgs {
+				pipe.Publish(ctx, channelId, msg)
+			}
+			return nil
+		})
+	}
 	if err != nil {
 		logger.V(logutil.DEFAULT).Error(err, "Error publishing message:%s\n", err.Error())
 		return err
@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+var responseCacheKeyPrefix = flag.String("redis.response-cache-key-prefix", "response-cache:", "prefix of the Redis keys holding cached responses")
+
+// RedisResponseCache is an api.ResponseCache shared by all the processor replicas using the same Redis server.
+type RedisResponseCache struct {
+	rdb *redis.Client
+}
+
+func NewRedisResponseCache() *RedisResponseCache {
+	return &RedisResponseCache{
+		rdb: redis.NewClient(&redis.Options{
+			Addr: *redisAddr,
+		}),
+	}
+}
+
+func (c *RedisResponseCache) Get(ctx context.Context, key string) (string, bool) {
+	payload, err := c.rdb.Get(ctx, *responseCacheKeyPrefix+key).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.FromContext(ctx).V(logutil.DEFAULT).Error(err, "Failed to read cached response from Redis")
+		}
+		return "", false
+	}
+	return payload, true
+}
+
+func (c *RedisResponseCache) Set(ctx context.Context, key string, payload string, ttl time.Duration) {
+	err := c.rdb.Set(ctx, *responseCacheKeyPrefix+key, payload, ttl).Err()
+	if err != nil {
+		// Not caching is fine, the next identical request is simply dispatched.
+		log.FromContext(ctx).V(logutil.DEFAULT).Error(err, "Failed to cache response in Redis")
+	}
+}
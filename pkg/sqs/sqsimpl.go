@@ -0,0 +1,398 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	logutil "sigs.k8s.io/gateway-api-inference-extension/pkg/epp/util/logging"
+)
+
+// SQS_QUEUE_URL and SQS_RECEIPT_HANDLE are the metadata entries holding the queue a request was received from and its
+// receipt handle, to delete it once it is processed.
+const (
+	SQS_QUEUE_URL      = "sqs-queue-url"
+	SQS_RECEIPT_HANDLE = "sqs-receipt-handle"
+)
+
+// NOT_BEFORE_ATTRIBUTE is the message attribute holding the Unix milliseconds before which a retry must not be
+// processed, for backoffs longer than the longest delay of SQS.
+const NOT_BEFORE_ATTRIBUTE = "not_before"
+
+// maxDelay is the longest delay SQS allows when sending a message, maxVisibilityTimeout the longest visibility timeout
+// and maxBatchSize the largest batch of messages sent at once.
+const (
+	maxDelay             = 15 * time.Minute
+	maxVisibilityTimeout = 12 * time.Hour
+	maxBatchSize         = 10
+)
+
+var (
+	region = flag.String("sqs.region", "", "AWS region of the SQS queues. Taken from the AWS configuration of the environment if empty")
+
+	inferenceGateway    = flag.String("sqs.inference-gateway", "http://localhost:30080/v1/completions", "inference gateway endpoint")
+	inferenceObjective  = flag.String("sqs.inference-objective", "", "inference objective to use in requests")
+	requestQueueURL     = flag.String("sqs.request-queue-url", "", "URL of the SQS queue of the request messages")
+	retryQueueURL       = flag.String("sqs.retry-queue-url", "", "URL of the SQS queue the retried requests wait in. Retries are sent back to the request queue if empty")
+	resultQueueURL      = flag.String("sqs.result-queue-url", "", "URL of the SQS queue of the result messages")
+	errorQueueURL       = flag.String("sqs.error-queue-url", "", "URL of the SQS queue of the error results. Errors are sent to the result queue if empty")
+	maxNumberOfMessages = flag.Int("sqs.max-number-of-messages", 10, "maximum number of messages received at once, from 1 to 10")
+	waitTime            = flag.Duration("sqs.wait-time", 20*time.Second, "how long a receive waits for messages to arrive (long polling), up to 20s")
+	visibilityTimeout   = flag.Duration("sqs.visibility-timeout", 5*time.Minute, "how long a received request is hidden from the other processors. It is extended while the request is processed, requests whose processor stopped are delivered again once it is over")
+)
+
+// client is the part of the SQS client the flow uses.
+type client interface {
+	ReceiveMessage(ctx context.Context, params *awssqs.ReceiveMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error)
+	SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error)
+	SendMessageBatch(ctx context.Context, params *awssqs.SendMessageBatchInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error)
+	DeleteMessage(ctx context.Context, params *awssqs.DeleteMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *awssqs.ChangeMessageVisibilityInput, optFns ...func(*awssqs.Options)) (*awssqs.ChangeMessageVisibilityOutput, error)
+	GetQueueAttributes(ctx context.Context, params *awssqs.GetQueueAttributesInput, optFns ...func(*awssqs.Options)) (*awssqs.GetQueueAttributesOutput, error)
+}
+
+// SQSMQFlow is a Flow over SQS queues. A request is deleted from its queue only once it is processed, i.e. once its
+// result is sent or it is sent again for retry. The visibility timeout of the requests being processed is extended
+// until then, so requests are delivered again only if their processor stops or their result can't be sent. Retries wait for their backoff in the retry queue, delayed by SQS and, beyond
+// the longest delay it allows, hidden by their visibility timeout.
+type SQSMQFlow struct {
+	client client
+	held   heldMessages
+
+	requestChannel chan api.RequestMessage
+	retryChannel   chan api.RetryMessage
+	resultChannel  chan api.ResultMessage
+	errorChannel   chan api.ResultMessage
+	pendingResults api.PendingResults
+}
+
+func NewSQSMQFlow() (*SQSMQFlow, error) {
+	var opts []func(*config.LoadOptions) error
+	if *region != "" {
+		opts = append(opts, config.WithRegion(*region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newSQSMQFlow(awssqs.NewFromConfig(cfg)), nil
+}
+
+func newSQSMQFlow(c client) *SQSMQFlow {
+	flow := &SQSMQFlow{
+		client:         c,
+		requestChannel: make(chan api.RequestMessage),
+		retryChannel:   make(chan api.RetryMessage),
+		resultChannel:  api.NewResultChannel(),
+	}
+	if *errorQueueURL != "" {
+		flow.errorChannel = api.NewErrorResultChannel()
+	}
+	return flow
+}
+
+func (r *SQSMQFlow) Start(ctx context.Context) {
+	timeout := *visibilityTimeout
+	go receiveWorker(api.ConsumeContext(ctx), r.client, &r.held, *requestQueueURL, timeout, r.requestChannel)
+	if *retryQueueURL != "" {
+		go receiveWorker(api.ConsumeContext(ctx), r.client, &r.held, *retryQueueURL, timeout, r.requestChannel)
+	}
+
+	go retryWorker(ctx, r.client, &r.held, r.retryChannel, retryQueue())
+
+	go heartbeatWorker(ctx, r.client, &r.held, timeout)
+
+	batchSize, batchWindow := min(max(*api.ResultPublishBatchSize, 1), maxBatchSize), *api.ResultPublishBatchWindow
+	for range api.ResultWorkerCount() {
+		go resultWorker(ctx, r.client, &r.held, r.resultChannel, &r.pendingResults, *resultQueueURL, batchSize, batchWindow)
+	}
+	if r.errorChannel != nil {
+		for range api.DeadLetterWorkerCount() {
+			go resultWorker(ctx, r.client, &r.held, r.errorChannel, &r.pendingResults, *errorQueueURL, batchSize, batchWindow)
+		}
+	}
+}
+
+func (r *SQSMQFlow) Characteristics() api.Characteristics {
+	return api.Characteristics{
+		HasExternalBackoff: false,
+		AcksOnResult:       true,
+	}
+}
+
+func (r *SQSMQFlow) RequestChannels() []api.RequestChannel {
+
+	metadata := map[string]any{
+		"inference-gateway":   *inferenceGateway,
+		"inference-objective": *inferenceObjective,
+	}
+
+	return []api.RequestChannel{{Channel: r.requestChannel, Metadata: metadata}}
+}
+
+func (r *SQSMQFlow) RetryChannel() chan api.RetryMessage {
+	return r.retryChannel
+}
+
+func (r *SQSMQFlow) ResultChannel() chan api.ResultMessage {
+	return r.resultChannel
+}
+
+func (r *SQSMQFlow) ErrorResultChannel() chan api.ResultMessage {
+	return r.errorChannel
+}
+
+func (r *SQSMQFlow) PendingResults() int {
+	return r.pendingResults.Count()
+}
+
+// Healthy reports the flow healthy as long as the request queue can be looked up.
+func (r *SQSMQFlow) Healthy(ctx context.Context) error {
+	_, err := r.client.GetQueueAttributes(ctx, &awssqs.GetQueueAttributesInput{QueueUrl: aws.String(*requestQueueURL)})
+	return err
+}
+
+func retryQueue() string {
+	if *retryQueueURL == "" {
+		return *requestQueueURL
+	}
+	return *retryQueueURL
+}
+
+// Long-polls the queue for requests and puts them in the request channel. Retries whose backoff is not over yet are
+// hidden again until it is.
+func receiveWorker(ctx context.Context, c client, held *heldMessages, queueURL string, timeout time.Duration,
+	msgChannel chan api.RequestMessage) {
+	logger := log.FromContext(ctx)
+	for {
+		output, err := c.ReceiveMessage(ctx, &awssqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(queueURL),
+			MaxNumberOfMessages:   int32(min(max(*maxNumberOfMessages, 1), maxBatchSize)),
+			WaitTimeSeconds:       int32(waitTime.Seconds()),
+			VisibilityTimeout:     int32(max(timeout.Seconds(), 1)),
+			MessageAttributeNames: []string{NOT_BEFORE_ATTRIBUTE},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.V(logutil.DEFAULT).Error(err, "Failed to receive messages from SQS", "queue", queueURL)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		batch := make([]api.RequestMessage, 0, len(output.Messages))
+		for _, sqsMsg := range output.Messages {
+			if wait := notBefore(sqsMsg).Sub(time.Now()); wait > time.Second {
+				hide(ctx, c, queueURL, sqsMsg.ReceiptHandle, wait)
+				continue
+			}
+
+			var msg api.RequestMessage
+			if err := json.Unmarshal([]byte(aws.ToString(sqsMsg.Body)), &msg); err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to unmarshal message from SQS", "queue", queueURL)
+				deleteMessage(ctx, c, queueURL, aws.ToString(sqsMsg.ReceiptHandle)) // skip this message
+				continue
+			}
+			if msg.Metadata == nil {
+				msg.Metadata = make(map[string]string)
+			}
+			msg.Metadata[SQS_QUEUE_URL] = queueURL
+			msg.Metadata[SQS_RECEIPT_HANDLE] = aws.ToString(sqsMsg.ReceiptHandle)
+			// Held as soon as received, for the visibility timeout of the whole batch to be extended while the requests
+			// wait to be handed over.
+			held.hold(queueURL, aws.ToString(sqsMsg.ReceiptHandle))
+			batch = append(batch, msg)
+		}
+		for i, msg := range batch {
+			select {
+			case msgChannel <- msg:
+			case <-ctx.Done():
+				// Delivered again once their visibility timeout is over.
+				for _, msg := range batch[i:] {
+					held.release(msg.Metadata[SQS_RECEIPT_HANDLE])
+				}
+				return
+			}
+		}
+	}
+}
+
+// notBefore returns the time before which a retry must not be processed, or the zero time if it can be right away.
+func notBefore(msg types.Message) time.Time {
+	attribute, ok := msg.MessageAttributes[NOT_BEFORE_ATTRIBUTE]
+	if !ok {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(aws.ToString(attribute.StringValue), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// hide makes a message invisible for the given time, as long as SQS allows.
+func hide(ctx context.Context, c client, queueURL string, receiptHandle *string, wait time.Duration) {
+	_, err := c.ChangeMessageVisibility(ctx, &awssqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     receiptHandle,
+		VisibilityTimeout: int32(math.Ceil(min(wait, maxVisibilityTimeout).Seconds())),
+	})
+	if err != nil {
+		// It shows up again after the visibility timeout, and is hidden again then.
+		log.FromContext(ctx).V(logutil.DEFAULT).Error(err, "Failed to hide retry until its backoff is over")
+	}
+}
+
+// heldMessages are the requests received and not processed yet, by receipt handle, with the URL of their queue.
+type heldMessages struct {
+	sync.Map
+}
+
+func (h *heldMessages) hold(queueURL string, receiptHandle string) {
+	h.Store(receiptHandle, queueURL)
+}
+
+// release stops extending the visibility timeout of a request, for it to be delivered again unless it is deleted.
+func (h *heldMessages) release(receiptHandle string) {
+	h.Delete(receiptHandle)
+}
+
+// Extends the visibility timeout of the requests being processed, every half of it.
+func heartbeatWorker(ctx context.Context, c client, held *heldMessages, timeout time.Duration) {
+	logger := log.FromContext(ctx)
+	ticker := time.NewTicker(max(timeout/2, time.Millisecond))
+	defer ticker.Stop()
+	seconds := int32(max(math.Ceil(min(timeout, maxVisibilityTimeout).Seconds()), 1))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held.Range(func(receiptHandle, queueURL any) bool {
+				_, err := c.ChangeMessageVisibility(ctx, &awssqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(queueURL.(string)),
+					ReceiptHandle:     aws.String(receiptHandle.(string)),
+					VisibilityTimeout: seconds,
+				})
+				if err != nil {
+					logger.V(logutil.DEFAULT).Error(err, "Failed to extend the visibility timeout of a request", "queue", queueURL)
+				}
+				return ctx.Err() == nil
+			})
+		}
+	}
+}
+
+// Sends the requests to retry to the retry queue, delayed by their backoff, and only then deletes them from the queue
+// they were received from. Requests that couldn't be sent are delivered again after their visibility timeout.
+func retryWorker(ctx context.Context, c client, held *heldMessages, retryChannel chan api.RetryMessage, queueURL string) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-retryChannel:
+			bytes, err := json.Marshal(msg.RequestMessage)
+			if err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to marshal message for retry")
+				continue // skip this message.
+			}
+			backoff := time.Duration(msg.BackoffDurationSeconds * float64(time.Second))
+			input := &awssqs.SendMessageInput{
+				QueueUrl:     aws.String(queueURL),
+				MessageBody:  aws.String(string(bytes)),
+				DelaySeconds: int32(min(backoff, maxDelay).Seconds()),
+			}
+			if backoff > maxDelay {
+				input.MessageAttributes = map[string]types.MessageAttributeValue{
+					NOT_BEFORE_ATTRIBUTE: {
+						DataType:    aws.String("Number"),
+						StringValue: aws.String(strconv.FormatInt(time.Now().Add(backoff).UnixMilli(), 10)),
+					},
+				}
+			}
+			if _, err := c.SendMessage(ctx, input); err != nil {
+				logger.V(logutil.DEFAULT).Error(err, "Failed to send message for retry", "id", msg.Id)
+				held.release(msg.RequestMessage.Metadata[SQS_RECEIPT_HANDLE])
+				continue
+			}
+			deleteRequest(ctx, c, held, msg.RequestMessage.Metadata)
+		}
+	}
+}
+
+// Listening on the results channel and sending the results to the result queue, then deleting their requests.
+func resultWorker(ctx context.Context, c client, held *heldMessages, resultChannel chan api.ResultMessage,
+	pending *api.PendingResults, queueURL string, batchSize int, batchWindow time.Duration) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-resultChannel:
+			batch := api.CollectResultBatch(ctx, msg, resultChannel, batchSize, batchWindow, pending)
+			entries := make([]types.SendMessageBatchRequestEntry, len(batch))
+			for i, msg := range batch {
+				entries[i] = types.SendMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)),
+					MessageBody: aws.String(string(api.MarshalResult(msg)))}
+			}
+			output, err := c.SendMessageBatch(ctx, &awssqs.SendMessageBatchInput{QueueUrl: aws.String(queueURL), Entries: entries})
+			if err != nil {
+				// Not deleted, the requests are delivered again after their visibility timeout.
+				logger.V(logutil.DEFAULT).Error(err, "Failed to send result messages to SQS", "results", len(batch))
+				for _, msg := range batch {
+					held.release(msg.Metadata[SQS_RECEIPT_HANDLE])
+				}
+				pending.Add(-len(batch))
+				continue
+			}
+			for _, failed := range output.Failed {
+				logger.V(logutil.DEFAULT).Error(fmt.Errorf("%s", aws.ToString(failed.Message)), "Failed to send result message to SQS",
+					"code", aws.ToString(failed.Code))
+				if i, err := strconv.Atoi(aws.ToString(failed.Id)); err == nil && i < len(batch) {
+					held.release(batch[i].Metadata[SQS_RECEIPT_HANDLE])
+				}
+			}
+			for _, sent := range output.Successful {
+				if i, err := strconv.Atoi(aws.ToString(sent.Id)); err == nil && i < len(batch) {
+					deleteRequest(ctx, c, held, batch[i].Metadata)
+				}
+			}
+			pending.Add(-len(batch))
+		}
+	}
+}
+
+// deleteRequest deletes a processed request from the queue it was received from.
+func deleteRequest(ctx context.Context, c client, held *heldMessages, metadata map[string]string) {
+	if receiptHandle, ok := metadata[SQS_RECEIPT_HANDLE]; ok {
+		held.release(receiptHandle)
+		deleteMessage(ctx, c, metadata[SQS_QUEUE_URL], receiptHandle)
+	}
+}
+
+func deleteMessage(ctx context.Context, c client, queueURL string, receiptHandle string) {
+	_, err := c.DeleteMessage(ctx, &awssqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: aws.String(receiptHandle)})
+	if err != nil {
+		// The message is delivered again after its visibility timeout.
+		log.FromContext(ctx).V(logutil.DEFAULT).Error(err, "Failed to delete message from SQS", "queue", queueURL)
+	}
+}
@@ -0,0 +1,344 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/llm-d-incubation/llm-d-async/pkg/async"
+	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
+)
+
+// fakeClient hands out the messages put in its queues and records what is sent, deleted and hidden.
+type fakeClient struct {
+	queues  map[string]chan types.Message
+	sent    chan *awssqs.SendMessageInput
+	sendErr error
+
+	mu      sync.Mutex
+	deleted map[string]bool
+	hidden  map[string]int32
+}
+
+func newFakeClient(queueURLs ...string) *fakeClient {
+	c := &fakeClient{
+		queues:  map[string]chan types.Message{},
+		sent:    make(chan *awssqs.SendMessageInput, 10),
+		deleted: map[string]bool{},
+		hidden:  map[string]int32{},
+	}
+	for _, url := range queueURLs {
+		c.queues[url] = make(chan types.Message, 10)
+	}
+	return c
+}
+
+func (c *fakeClient) ReceiveMessage(ctx context.Context, params *awssqs.ReceiveMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error) {
+	queue := c.queues[aws.ToString(params.QueueUrl)]
+	select {
+	case msg := <-queue:
+		// Along with the messages already waiting, up to the maximum number of messages.
+		output := &awssqs.ReceiveMessageOutput{Messages: []types.Message{msg}}
+		for len(output.Messages) < int(params.MaxNumberOfMessages) {
+			select {
+			case msg := <-queue:
+				output.Messages = append(output.Messages, msg)
+			default:
+				return output, nil
+			}
+		}
+		return output, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeClient) SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error) {
+	if c.sendErr != nil {
+		return nil, c.sendErr
+	}
+	c.sent <- params
+	return &awssqs.SendMessageOutput{}, nil
+}
+
+func (c *fakeClient) SendMessageBatch(ctx context.Context, params *awssqs.SendMessageBatchInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error) {
+	if c.sendErr != nil {
+		return nil, c.sendErr
+	}
+	output := &awssqs.SendMessageBatchOutput{}
+	for _, entry := range params.Entries {
+		c.sent <- &awssqs.SendMessageInput{QueueUrl: params.QueueUrl, MessageBody: entry.MessageBody}
+		output.Successful = append(output.Successful, types.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
+
+func (c *fakeClient) DeleteMessage(ctx context.Context, params *awssqs.DeleteMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.DeleteMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted[aws.ToString(params.ReceiptHandle)] = true
+	return &awssqs.DeleteMessageOutput{}, nil
+}
+
+func (c *fakeClient) ChangeMessageVisibility(ctx context.Context, params *awssqs.ChangeMessageVisibilityInput, optFns ...func(*awssqs.Options)) (*awssqs.ChangeMessageVisibilityOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hidden[aws.ToString(params.ReceiptHandle)] = params.VisibilityTimeout
+	return &awssqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (c *fakeClient) GetQueueAttributes(ctx context.Context, params *awssqs.GetQueueAttributesInput, optFns ...func(*awssqs.Options)) (*awssqs.GetQueueAttributesOutput, error) {
+	return &awssqs.GetQueueAttributesOutput{}, nil
+}
+
+func (c *fakeClient) isDeleted(receiptHandle string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deleted[receiptHandle]
+}
+
+func (c *fakeClient) hiddenFor(receiptHandle string) (int32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout, ok := c.hidden[receiptHandle]
+	return timeout, ok
+}
+
+func requestMessage(t *testing.T, id string) types.Message {
+	body, err := json.Marshal(api.RequestMessage{Id: id, DeadlineUnixSec: "9999999999", Payload: map[string]any{"model": "m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.Message{Body: aws.String(string(body)), ReceiptHandle: aws.String("receipt-" + id)}
+}
+
+func startFlow(t *testing.T, c *fakeClient) *SQSMQFlow {
+	for name, value := range map[string]string{
+		"sqs.request-queue-url": "request-queue",
+		"sqs.retry-queue-url":   "retry-queue",
+		"sqs.result-queue-url":  "result-queue",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { flag.Set(name, "") }) // nolint:errcheck
+	}
+	flow := newSQSMQFlow(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	flow.Start(ctx)
+	t.Cleanup(cancel)
+	return flow
+}
+
+func receiveRequest(t *testing.T, flow *SQSMQFlow) api.RequestMessage {
+	select {
+	case msg := <-flow.RequestChannels()[0].Channel:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a request")
+		return api.RequestMessage{}
+	}
+}
+
+func TestSQSMQFlow_deletesProcessedRequests(t *testing.T) {
+	c := newFakeClient("request-queue", "retry-queue")
+	flow := startFlow(t, c)
+	c.queues["request-queue"] <- requestMessage(t, "a")
+	msg := receiveRequest(t, flow)
+	if msg.Metadata[SQS_QUEUE_URL] != "request-queue" || msg.Metadata[SQS_RECEIPT_HANDLE] != "receipt-a" {
+		t.Fatalf("Expected the request to carry its receipt, got %v", msg.Metadata)
+	}
+	if c.isDeleted("receipt-a") {
+		t.Errorf("Expected the request not to be deleted before its result is sent")
+	}
+
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	sent := <-c.sent
+	var result api.ResultMessage
+	if err := json.Unmarshal([]byte(aws.ToString(sent.MessageBody)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(sent.QueueUrl) != "result-queue" || result.Id != "a" {
+		t.Errorf("Expected the result of a in the result queue, got %s in %s", result.Id, aws.ToString(sent.QueueUrl))
+	}
+	deadline := time.Now().Add(time.Second)
+	for !c.isDeleted("receipt-a") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the request to be deleted once its result is sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSQSMQFlow_retry(t *testing.T) {
+	c := newFakeClient("request-queue", "retry-queue")
+	flow := startFlow(t, c)
+	c.queues["request-queue"] <- requestMessage(t, "a")
+	c.queues["request-queue"] <- requestMessage(t, "b")
+	a, b := receiveRequest(t, flow), receiveRequest(t, flow)
+
+	flow.RetryChannel() <- api.RetryMessage{EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: a}, BackoffDurationSeconds: 4}
+	sent := <-c.sent
+	if aws.ToString(sent.QueueUrl) != "retry-queue" || sent.DelaySeconds != 4 || sent.MessageAttributes != nil {
+		t.Errorf("Expected a to be delayed by 4s in the retry queue, got %d in %s", sent.DelaySeconds, aws.ToString(sent.QueueUrl))
+	}
+
+	// Longer than SQS can delay a message: the rest of the backoff is waited for after the retry is received.
+	flow.RetryChannel() <- api.RetryMessage{EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: b}, BackoffDurationSeconds: 3600}
+	sent = <-c.sent
+	notBefore, _ := strconv.ParseInt(aws.ToString(sent.MessageAttributes[NOT_BEFORE_ATTRIBUTE].StringValue), 10, 64)
+	if sent.DelaySeconds != 900 || time.Until(time.UnixMilli(notBefore)) < 59*time.Minute {
+		t.Errorf("Expected b to be delayed by 15 minutes and held for an hour, got %d and %v", sent.DelaySeconds, sent.MessageAttributes)
+	}
+	c.queues["retry-queue"] <- types.Message{
+		Body:              sent.MessageBody,
+		ReceiptHandle:     aws.String("retry-b"),
+		MessageAttributes: sent.MessageAttributes,
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if timeout, ok := c.hiddenFor("retry-b"); ok {
+			if timeout < 2700 || timeout > 3600 {
+				t.Errorf("Expected b to be hidden until its backoff is over, got %ds", timeout)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected b to be hidden until its backoff is over")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case msg := <-flow.RequestChannels()[0].Channel:
+		t.Errorf("Expected b not to be processed before its backoff is over, got %s", msg.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for !c.isDeleted("receipt-a") || !c.isDeleted("receipt-b") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the requests to be deleted once sent for retry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSQSMQFlow_failedResultIsNotDeleted(t *testing.T) {
+	c := newFakeClient("request-queue", "retry-queue")
+	c.sendErr = errors.New("unavailable")
+	flow := startFlow(t, c)
+	c.queues["request-queue"] <- requestMessage(t, "a")
+	msg := receiveRequest(t, flow)
+
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	flow.RetryChannel() <- api.RetryMessage{EmbelishedRequestMessage: api.EmbelishedRequestMessage{RequestMessage: msg}}
+	time.Sleep(50 * time.Millisecond)
+	if c.isDeleted("receipt-a") {
+		t.Errorf("Expected the request not to be deleted when its result couldn't be sent")
+	}
+}
+
+func TestSQSMQFlow_extendsVisibilityOfWaitingBatch(t *testing.T) {
+	if err := flag.Set("sqs.visibility-timeout", "100ms"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("sqs.visibility-timeout", "5m") }) // nolint:errcheck
+	c := newFakeClient("request-queue", "retry-queue")
+	for _, id := range []string{"a", "b", "c"} {
+		c.queues["request-queue"] <- requestMessage(t, id)
+	}
+	flow := startFlow(t, c)
+	receiveRequest(t, flow)
+
+	// Received with a, b and c wait to be handed over: they are kept hidden meanwhile.
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, hiddenB := c.hiddenFor("receipt-b")
+		_, hiddenC := c.hiddenFor("receipt-c")
+		if hiddenB && hiddenC {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the visibility timeout of the requests waiting to be handed over to be extended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSQSMQFlow_drainWaitsForBatchedResults(t *testing.T) {
+	for name, value := range map[string]string{"result-publish-batch-size": "10", "result-publish-batch-window": "100ms"} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { flag.Set(name, "0") }) // nolint:errcheck
+	}
+	c := newFakeClient("request-queue", "retry-queue")
+	flow := startFlow(t, c)
+	c.queues["request-queue"] <- requestMessage(t, "a")
+	msg := receiveRequest(t, flow)
+
+	// Taken by the result worker, the result waits for its batch to fill up.
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := async.WaitForResults(ctx, time.Millisecond, flow); err != nil {
+		t.Fatalf("Expected the result to be published in time, got %v", err)
+	}
+	select {
+	case <-c.sent:
+	default:
+		t.Fatalf("Expected the drain to wait for the batched result to be sent")
+	}
+	if !c.isDeleted("receipt-a") {
+		t.Errorf("Expected the request to be deleted by the end of the drain")
+	}
+}
+
+func TestSQSMQFlow_extendsVisibilityWhileProcessing(t *testing.T) {
+	if err := flag.Set("sqs.visibility-timeout", "100ms"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("sqs.visibility-timeout", "5m") }) // nolint:errcheck
+	c := newFakeClient("request-queue", "retry-queue")
+	flow := startFlow(t, c)
+	c.queues["request-queue"] <- requestMessage(t, "a")
+	msg := receiveRequest(t, flow)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if timeout, ok := c.hiddenFor("receipt-a"); ok {
+			if timeout != 1 {
+				t.Errorf("Expected the visibility timeout to be extended by a second at least, got %ds", timeout)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the visibility timeout of the request to be extended while it is processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Not extended anymore once the request is deleted.
+	flow.ResultChannel() <- api.NewResultMessage(msg, `{"text": "a"}`)
+	<-c.sent
+	for !c.isDeleted("receipt-a") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the request to be deleted once its result is sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.mu.Lock()
+	delete(c.hidden, "receipt-a")
+	c.mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := c.hiddenFor("receipt-a"); ok {
+		t.Errorf("Expected the visibility timeout not to be extended once the request is deleted")
+	}
+}
@@ -2,8 +2,10 @@ package integration_test
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/alicebob/miniredis/v2"
 	"github.com/llm-d-incubation/llm-d-async/pkg/async/api"
 	"github.com/llm-d-incubation/llm-d-async/pkg/redis"
+	goredis "github.com/redis/go-redis/v9"
 )
 
 func TestRedisImpl(t *testing.T) {
@@ -67,3 +70,337 @@ func TestRedisImpl(t *testing.T) {
 	}
 
 }
+
+func TestRedisImpl_batchedResults(t *testing.T) {
+	s := miniredis.RunT(t)
+	rAddr := s.Host() + ":" + s.Port()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, value := range map[string]string{
+		"redis.addr":                  rAddr,
+		"result-publish-batch-size":   "3",
+		"result-publish-batch-window": "1s",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer flag.Set("result-publish-batch-size", "0")   // nolint:errcheck
+	defer flag.Set("result-publish-batch-window", "0") // nolint:errcheck
+
+	rdb := goredis.NewClient(&goredis.Options{Addr: rAddr})
+	sub := rdb.Subscribe(ctx, "result-queue")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	flow := redis.NewRedisMQFlow()
+	flow.Start(ctx)
+	for _, id := range []string{"1", "2", "3"} {
+		flow.ResultChannel() <- api.ResultMessage{Id: id, Payload: "{}"}
+	}
+
+	for _, id := range []string{"1", "2", "3"} {
+		select {
+		case msg := <-sub.Channel():
+			var result api.ResultMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &result); err != nil || result.Id != id {
+				t.Errorf("Expected result %s, got %s", id, msg.Payload)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("Expected the full batch to be published before the window ends")
+		}
+	}
+}
+
+func TestRedisImpl_bufferedResults(t *testing.T) {
+	s := miniredis.RunT(t)
+	rAddr := s.Host() + ":" + s.Port()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, value := range map[string]string{
+		"redis.addr":         rAddr,
+		"result-workers":     "2",
+		"result-buffer-size": "3",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer flag.Set("result-workers", "1")     // nolint:errcheck
+	defer flag.Set("result-buffer-size", "0") // nolint:errcheck
+
+	rdb := goredis.NewClient(&goredis.Options{Addr: rAddr})
+	sub := rdb.Subscribe(ctx, "result-queue")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	flow := redis.NewRedisMQFlow()
+	// The results are buffered even before the result workers run.
+	for _, id := range []string{"1", "2", "3"} {
+		select {
+		case flow.ResultChannel() <- api.ResultMessage{Id: id, Payload: "{}"}:
+		default:
+			t.Fatalf("Expected result %s to be buffered", id)
+		}
+	}
+	flow.Start(ctx)
+
+	received := map[string]bool{}
+	for range 3 {
+		select {
+		case msg := <-sub.Channel():
+			var result api.ResultMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &result); err != nil {
+				t.Fatal(err)
+			}
+			received[result.Id] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Expected all the buffered results to be published, got %v", received)
+		}
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected 3 distinct results, got %v", received)
+	}
+}
+
+func TestRedisImpl_deadLetterWorkers(t *testing.T) {
+	s := miniredis.RunT(t)
+	rAddr := s.Host() + ":" + s.Port()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, value := range map[string]string{
+		"redis.addr":              rAddr,
+		"redis.error-queue-name":  "error-queue",
+		"dead-letter-workers":     "2",
+		"dead-letter-buffer-size": "3",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer flag.Set("redis.error-queue-name", "")    // nolint:errcheck
+	defer flag.Set("dead-letter-workers", "0")      // nolint:errcheck
+	defer flag.Set("dead-letter-buffer-size", "-1") // nolint:errcheck
+
+	rdb := goredis.NewClient(&goredis.Options{Addr: rAddr})
+	sub := rdb.Subscribe(ctx, "error-queue")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	flow := redis.NewRedisMQFlow()
+	if cap(flow.ResultChannel()) != 0 {
+		t.Errorf("Expected the results not to be buffered, got a buffer of %d", cap(flow.ResultChannel()))
+	}
+	// The error results have their own buffer.
+	for _, id := range []string{"1", "2", "3"} {
+		select {
+		case flow.ErrorResultChannel() <- api.ResultMessage{Id: id, Payload: `{"error": "failed"}`}:
+		default:
+			t.Fatalf("Expected error result %s to be buffered", id)
+		}
+	}
+	flow.Start(ctx)
+
+	received := map[string]bool{}
+	for range 3 {
+		select {
+		case msg := <-sub.Channel():
+			var result api.ResultMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &result); err != nil {
+				t.Fatal(err)
+			}
+			received[result.Id] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Expected all the buffered error results to be published, got %v", received)
+		}
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected 3 distinct error results, got %v", received)
+	}
+}
+
+func TestRedisImpl_deadLetterQueue(t *testing.T) {
+	s := miniredis.RunT(t)
+	rAddr := s.Host() + ":" + s.Port()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := flag.Set("redis.addr", rAddr); err != nil {
+		t.Fatal(err)
+	}
+	if redis.NewRedisMQFlow().DeadLetterChannel() != nil {
+		t.Errorf("Expected no dead-letter channel without a dead-letter queue")
+	}
+	if err := flag.Set("redis.dead-letter-queue-name", "dead-letter-queue"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("redis.dead-letter-queue-name", "") // nolint:errcheck
+
+	rdb := goredis.NewClient(&goredis.Options{Addr: rAddr})
+	sub := rdb.Subscribe(ctx, "dead-letter-queue")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	flow := redis.NewRedisMQFlow()
+	flow.Start(ctx)
+	flow.DeadLetterChannel() <- api.CreateDeadLetterResultMessage(api.RequestMessage{Id: "123"}, 3, "status 503")
+
+	select {
+	case msg := <-sub.Channel():
+		var result api.ResultMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Id != "123" || !strings.Contains(result.Payload, `"last_error":"status 503"`) {
+			t.Errorf("Expected the dead letter of request 123, got %v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the dead letter to be published")
+	}
+}
+
+func TestRedisImpl_retryPayloadByReference(t *testing.T) {
+	s := miniredis.RunT(t)
+	rAddr := s.Host() + ":" + s.Port()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for name, value := range map[string]string{
+		"redis.addr":                       rAddr,
+		"redis.retry-payload-by-reference": "true",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer flag.Set("redis.retry-payload-by-reference", "false") // nolint:errcheck
+
+	flow := redis.NewRedisMQFlow()
+	flow.Start(ctx)
+
+	payload := map[string]any{"model": "food-review", "prompt": "a long prompt"}
+	for retryCount := range 2 {
+		flow.RetryChannel() <- api.RetryMessage{
+			EmbelishedRequestMessage: api.EmbelishedRequestMessage{
+				RequestMessage: api.RequestMessage{
+					Id:              "test-id",
+					RetryCount:      retryCount + 1,
+					DeadlineUnixSec: strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10),
+					Payload:         payload,
+				},
+			},
+			BackoffDurationSeconds: 60,
+		}
+	}
+
+	// Both retries are waiting, each with a payload of its own.
+	rdb := goredis.NewClient(&goredis.Options{Addr: rAddr})
+	var members []string
+	for range 20 {
+		members, _ = rdb.ZRange(ctx, "retry-sortedset", 0, -1).Result()
+		if len(members) == 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 retries in the sorted set, got %d", len(members))
+	}
+	refs := map[string]bool{}
+	for _, member := range members {
+		var msg map[string]any
+		if err := json.Unmarshal([]byte(member), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["payload"] != nil {
+			t.Errorf("Expected the retry to carry only a reference to its payload, got %s", member)
+		}
+		ref, _ := msg["payload_ref"].(string)
+		if !strings.HasPrefix(ref, "retry-sortedset:payload:test-id:") || !s.Exists(ref) {
+			t.Errorf("Expected a stored payload reference in %s", member)
+		}
+		refs[ref] = true
+	}
+	if len(refs) != 2 {
+		t.Errorf("Expected each retry to have its own payload, got %v", refs)
+	}
+
+	// Once due, the retry comes back with its payload, which isn't needed anymore.
+	var first map[string]any
+	json.Unmarshal([]byte(members[0]), &first) // nolint:errcheck
+	rdb.ZAdd(ctx, "retry-sortedset", goredis.Z{Score: 0, Member: members[0]})
+	select {
+	case req := <-flow.RequestChannels()[0].Channel:
+		if req.Id != "test-id" || req.Payload["prompt"] != "a long prompt" {
+			t.Errorf("Expected the retried request with its payload, got %+v", req)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected the retried request in the request channel")
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Exists(first["payload_ref"].(string)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the payload to be deleted once the retry is consumed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, _ := rdb.ZCard(ctx, "retry-sortedset").Result(); n != 1 {
+		t.Errorf("Expected the other retry to be waiting still, got %d retries", n)
+	}
+}
+
+func TestRedisImpl_draining(t *testing.T) {
+	s := miniredis.RunT(t)
+	rAddr := s.Host() + ":" + s.Port()
+	if err := flag.Set("redis.addr", rAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	flowCtx, stopFlow := context.WithCancel(context.Background())
+	defer stopFlow()
+	consumeCtx, stopConsuming := context.WithCancel(context.Background())
+	flow := redis.NewRedisMQFlow()
+	flow.Start(api.WithConsumeContext(flowCtx, consumeCtx))
+
+	rdb := goredis.NewClient(&goredis.Options{Addr: rAddr})
+	results := rdb.Subscribe(flowCtx, "result-queue")
+	defer results.Close()
+	if _, err := results.Receive(flowCtx); err != nil {
+		t.Fatal(err)
+	}
+	stopConsuming()
+	time.Sleep(100 * time.Millisecond)
+
+	// Due retries are left in the sorted set for another processor.
+	member, err := json.Marshal(api.RequestMessage{Id: "test-id", DeadlineUnixSec: "9999999999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb.ZAdd(flowCtx, "retry-sortedset", goredis.Z{Score: 0, Member: string(member)})
+	time.Sleep(1500 * time.Millisecond)
+	if n, _ := rdb.ZCard(flowCtx, "retry-sortedset").Result(); n != 1 {
+		t.Errorf("Expected the retry to stay in the sorted set while draining, got %d retries", n)
+	}
+
+	// The results of the requests being drained are still published.
+	flow.ResultChannel() <- api.ResultMessage{Id: "drained-id", Payload: "{}"}
+	select {
+	case msg := <-results.Channel():
+		if !strings.Contains(msg.Payload, "drained-id") {
+			t.Errorf("Expected the result of the drained request, got %s", msg.Payload)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected the result to be published while draining")
+	}
+}